@@ -0,0 +1,352 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	defaultSearchLimit = 20
+)
+
+func (wr *WaveRider) routes(e *echo.Echo) {
+	e.GET("/health", wr.health)
+	e.GET("/traces", wr.listTraces)
+	e.GET("/traces/:id", wr.exportTrace)
+	e.GET("/dependencies", wr.listDependencies)
+	e.GET("/metrics", wr.promMetrics)
+	e.GET("/metrics/red", wr.listRedMetrics)
+
+	// Jaeger query's metrics API, for the Monitor tab
+	e.GET("/api/metrics/latencies", wr.spmLatencies)
+	e.GET("/api/metrics/calls", wr.spmCallRates)
+	e.GET("/api/metrics/errors", wr.spmErrorRates)
+	e.GET("/api/metrics/minstep", wr.spmMinStep)
+
+	// Zipkin collector's API, for services reporting Zipkin v2 JSON
+	e.POST(zipkinSpansPath, wr.postZipkinSpans)
+
+	// consistent backup archives of the wave, restored with the restore command
+	e.GET("/admin/backup", wr.getBackup)
+}
+
+// listTraces returns trace summaries, newest first. Query parameters are service,
+// start and end in microseconds since Unix epoch, and limit.
+func (wr *WaveRider) listTraces(c echo.Context) error {
+	start, err := int64Param(c, "start", 0)
+	if err != nil {
+		return err
+	}
+	end, err := int64Param(c, "end", math.MaxInt64)
+	if err != nil {
+		return err
+	}
+	limit, err := int64Param(c, "limit", defaultSearchLimit)
+	if err != nil {
+		return err
+	}
+
+	found, err := wr.summaries.find(c.QueryParam("service"), start, end, int(limit))
+	if err != nil {
+		return err
+	}
+	if found == nil {
+		found = []*traceSummary{}
+	}
+
+	return c.JSON(http.StatusOK, found)
+}
+
+// dependencyEdge is a dependency link with error count and child span duration
+// percentiles in microseconds.
+type dependencyEdge struct {
+	Parent     string `json:"parent"`
+	Child      string `json:"child"`
+	Type       string `json:"type"`
+	CallCount  uint64 `json:"callCount"`
+	ErrorCount uint64 `json:"errorCount"`
+	P50        int64  `json:"p50"`
+	P99        int64  `json:"p99"`
+}
+
+// listDependencies returns dependency edges like Jaeger's /api/dependencies, endTs and
+// lookback are in milliseconds, lookback defaults to a day.
+func (wr *WaveRider) listDependencies(c echo.Context) error {
+	endTs, err := int64Param(c, "endTs", time.Now().UnixNano()/int64(time.Millisecond))
+	if err != nil {
+		return err
+	}
+	lookback, err := int64Param(c, "lookback", int64(24*time.Hour/time.Millisecond))
+	if err != nil {
+		return err
+	}
+
+	end := endTs * int64(time.Millisecond/time.Microsecond)
+	links, err := wr.deps.links(c.Request().Context(), max64(0, end-lookback*int64(time.Millisecond/time.Microsecond)), end)
+	if err != nil {
+		return err
+	}
+
+	edges := make([]dependencyEdge, len(links))
+	for i, l := range links {
+		edges[i] = dependencyEdge{
+			Parent:     l.Parent,
+			Child:      l.Child,
+			Type:       l.Type,
+			CallCount:  l.CallCount,
+			ErrorCount: l.ErrorCount,
+			P50:        l.Durations.percentile(50),
+			P99:        l.Durations.percentile(99),
+		}
+	}
+
+	return c.JSON(http.StatusOK, edges)
+}
+
+type health struct {
+	Status string     `json:"status"`
+	Disk   diskHealth `json:"disk"`
+}
+
+// health reports the plugin is up, with disk usage and evictions. It's OK in degraded
+// mode too, where spans are rejected until evictions free enough disk.
+func (wr *WaveRider) health(c echo.Context) error {
+	return c.JSON(http.StatusOK, health{Status: http.StatusText(http.StatusOK), Disk: wr.disk.health()})
+}
+
+// promMetrics exposes RED counters since start, write failures, duplicates and disk usage in
+// Prometheus text format.
+func (wr *WaveRider) promMetrics(c echo.Context) error {
+	c.Response().Header().Set(echo.HeaderContentType, "text/plain; version=0.0.4; charset=utf-8")
+	c.Response().WriteHeader(http.StatusOK)
+	if err := wr.metrics.writeProm(c.Response()); err != nil {
+		return err
+	}
+	if err := wr.batcher.writeProm(c.Response()); err != nil {
+		return err
+	}
+	if err := wr.dedup.writeProm(c.Response()); err != nil {
+		return err
+	}
+	return wr.disk.writeProm(c.Response())
+}
+
+// redPoint is a RED metrics row for Grafana, durations are in microseconds.
+type redPoint struct {
+	Time      int64   `json:"time"` // milliseconds since Unix epoch
+	Service   string  `json:"service"`
+	Operation string  `json:"operation"`
+	Kind      string  `json:"kind"`
+	Calls     uint64  `json:"calls"`
+	Errors    uint64  `json:"errors"`
+	Rate      float64 `json:"rate"` // calls per second
+	P50       int64   `json:"p50"`
+	P95       int64   `json:"p95"`
+	P99       int64   `json:"p99"`
+}
+
+// listRedMetrics returns RED metrics rows, oldest first, of spans started within from
+// and to in milliseconds, the last hour by default. Buckets are summed into steps of
+// step milliseconds, rounded up to chronowave.metrics.bucket. Rows can be filtered by
+// service, operation and kind.
+func (wr *WaveRider) listRedMetrics(c echo.Context) error {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	from, err := int64Param(c, "from", now-int64(time.Hour/time.Millisecond))
+	if err != nil {
+		return err
+	}
+	to, err := int64Param(c, "to", now)
+	if err != nil {
+		return err
+	}
+	step, err := int64Param(c, "step", 0)
+	if err != nil {
+		return err
+	}
+
+	ms := int64(time.Millisecond / time.Microsecond)
+	size := wr.metrics.size
+	step = (step*ms + size - 1) / size * size
+	if step < size {
+		step = size
+	}
+
+	buckets, err := wr.metrics.buckets(c.Request().Context(), wr.metrics.floor(from*ms), to*ms)
+	if err != nil {
+		return err
+	}
+
+	service, operation, kind := c.QueryParam("service"), c.QueryParam("operation"), c.QueryParam("kind")
+	type stepKey struct {
+		start int64
+		redKey
+	}
+	steps := map[stepKey]*redSeries{}
+	for b, bucket := range buckets {
+		for k, s := range bucket {
+			if (len(service) > 0 && k.service != service) ||
+				(len(operation) > 0 && k.operation != operation) ||
+				(len(kind) > 0 && k.kind != kind) {
+				continue
+			}
+			sk := stepKey{start: b - b%step, redKey: k}
+			if cur, ok := steps[sk]; ok {
+				cur.merge(s)
+				continue
+			}
+			sum := &redSeries{Service: k.service, Operation: k.operation, Kind: k.kind}
+			sum.merge(s)
+			steps[sk] = sum
+		}
+	}
+
+	points := make([]redPoint, 0, len(steps))
+	for sk, s := range steps {
+		points = append(points, redPoint{
+			Time:      sk.start / ms,
+			Service:   s.Service,
+			Operation: s.Operation,
+			Kind:      s.Kind,
+			Calls:     s.Calls,
+			Errors:    s.Errors,
+			Rate:      float64(s.Calls) / (float64(step) / float64(time.Second/time.Microsecond)),
+			P50:       s.Durations.percentile(50),
+			P95:       s.Durations.percentile(95),
+			P99:       s.Durations.percentile(99),
+		})
+	}
+	sort.Slice(points, func(i, j int) bool {
+		a, b := points[i], points[j]
+		if a.Time != b.Time {
+			return a.Time < b.Time
+		}
+		if a.Service != b.Service {
+			return a.Service < b.Service
+		}
+		if a.Operation != b.Operation {
+			return a.Operation < b.Operation
+		}
+		return a.Kind < b.Kind
+	})
+
+	return c.JSON(http.StatusOK, points)
+}
+
+func (wr *WaveRider) spmLatencies(c echo.Context) error {
+	params, err := spmParams(c)
+	if err != nil {
+		return err
+	}
+
+	text := c.QueryParam("quantile")
+	q, err := strconv.ParseFloat(text, 64)
+	if err != nil || q <= 0 || q > 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid quantile: "+text)
+	}
+
+	family, err := wr.GetLatencies(c.Request().Context(), &latenciesQueryParameters{baseQueryParameters: *params, Quantile: q})
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, family)
+}
+
+func (wr *WaveRider) spmCallRates(c echo.Context) error {
+	params, err := spmParams(c)
+	if err != nil {
+		return err
+	}
+
+	family, err := wr.GetCallRates(c.Request().Context(), params)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, family)
+}
+
+func (wr *WaveRider) spmErrorRates(c echo.Context) error {
+	params, err := spmParams(c)
+	if err != nil {
+		return err
+	}
+
+	family, err := wr.GetErrorRates(c.Request().Context(), params)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, family)
+}
+
+// spmMinStep returns the min step in milliseconds, as data of Jaeger query's response.
+func (wr *WaveRider) spmMinStep(c echo.Context) error {
+	step, err := wr.GetMinStepDuration(c.Request().Context())
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, map[string]int64{"data": int64(step / time.Millisecond)})
+}
+
+// spmParams reads metrics query parameters as Jaeger query does: service and spanKind
+// repeated, groupByOperation, and endTs, lookback, step and ratePer in milliseconds.
+// Span kind defaults to server.
+func spmParams(c echo.Context) (*baseQueryParameters, error) {
+	ms := func(v int64) time.Duration { return time.Duration(v) * time.Millisecond }
+
+	endTs, err := int64Param(c, "endTs", time.Now().UnixNano()/int64(time.Millisecond))
+	if err != nil {
+		return nil, err
+	}
+	lookback, err := int64Param(c, "lookback", int64(time.Hour/time.Millisecond))
+	if err != nil {
+		return nil, err
+	}
+	step, err := int64Param(c, "step", int64(5*time.Second/time.Millisecond))
+	if err != nil {
+		return nil, err
+	}
+	ratePer, err := int64Param(c, "ratePer", int64(10*time.Minute/time.Millisecond))
+	if err != nil {
+		return nil, err
+	}
+
+	params := &baseQueryParameters{
+		ServiceNames: c.QueryParams()["service"],
+		EndTime:      time.Unix(0, int64(ms(endTs))),
+		Lookback:     ms(lookback),
+		Step:         ms(step),
+		RatePer:      ms(ratePer),
+		SpanKinds:    c.QueryParams()["spanKind"],
+	}
+	if len(params.ServiceNames) == 0 {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, errNoServiceNames.Error())
+	}
+	if len(params.SpanKinds) == 0 {
+		params.SpanKinds = []string{"server"}
+	}
+	if text := c.QueryParam("groupByOperation"); len(text) > 0 {
+		if params.GroupByOperation, err = strconv.ParseBool(text); err != nil {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "invalid groupByOperation: "+text)
+		}
+	}
+
+	return params, nil
+}
+
+// int64Param returns query parameter name, or def if it's absent.
+func int64Param(c echo.Context, name string, def int64) (int64, error) {
+	text := c.QueryParam(name)
+	if len(text) == 0 {
+		return def, nil
+	}
+
+	v, err := strconv.ParseInt(text, 10, 64)
+	if err != nil || v < 0 {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, "invalid "+name+": "+text)
+	}
+	return v, nil
+}
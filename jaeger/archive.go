@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/plugin/storage/es/spanstore/dbmodel"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+)
+
+const (
+	archiveExt = ".json"
+)
+
+// ArchiveRider keeps archived traces apart from the wave. embed.WaveStream holds its
+// directory and index database in package state, so a second stream can't live in the
+// same process; instead every archived trace is saved as one newline delimited file of
+// dbmodel spans, which is also what the wave would have stored.
+type ArchiveRider struct {
+	logger    hclog.Logger
+	dir       string
+	from      dbmodel.FromDomain
+	to        dbmodel.ToDomain
+	ttlTicker *time.Ticker
+	lock      sync.Mutex
+}
+
+// newArchiveRider keeps traces in dir for ttl, zero keeps them forever.
+func newArchiveRider(logger hclog.Logger, dir string, ttl time.Duration) *ArchiveRider {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		panic(err)
+	}
+
+	ar := &ArchiveRider{
+		logger: logger,
+		dir:    dir,
+		from:   dbmodel.FromDomain{},
+		to:     dbmodel.ToDomain{},
+	}
+
+	if ttl > 0 {
+		if ttl < time.Hour {
+			ar.ttlTicker = time.NewTicker(ttl)
+		} else {
+			ar.ttlTicker = time.NewTicker(time.Hour)
+		}
+		go ar.purge(ttl)
+	}
+
+	return ar
+}
+
+func (ar *ArchiveRider) Close() {
+	if ar.ttlTicker != nil {
+		ar.ttlTicker.Stop()
+	}
+}
+
+func (ar *ArchiveRider) path(traceID string) string {
+	return filepath.Join(ar.dir, traceID+archiveExt)
+}
+
+func (ar *ArchiveRider) WriteSpan(ctx context.Context, span *model.Span) error {
+	json, err := json.Marshal(ar.from.FromDomainEmbedProcess(span))
+	if err != nil {
+		return err
+	}
+
+	return ar.append(span.TraceID.String(), append(json, '\n'))
+}
+
+// writeTrace saves spans of trace traceID as stored in the wave.
+func (ar *ArchiveRider) writeTrace(traceID string, spans []*dbmodel.Span) error {
+	var lines []byte
+	for _, s := range spans {
+		json, err := json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		lines = append(append(lines, json...), '\n')
+	}
+
+	return ar.append(traceID, lines)
+}
+
+func (ar *ArchiveRider) append(traceID string, lines []byte) error {
+	ar.lock.Lock()
+	defer ar.lock.Unlock()
+
+	f, err := os.OpenFile(ar.path(traceID), os.O_CREATE|os.O_APPEND|os.O_WRONLY, os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(lines)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// GetTrace retrieves the archived trace with a given id.
+//
+// If the trace was never archived, it returns ErrTraceNotFound.
+func (ar *ArchiveRider) GetTrace(ctx context.Context, traceID model.TraceID) (*model.Trace, error) {
+	ar.lock.Lock()
+	defer ar.lock.Unlock()
+
+	f, err := os.Open(ar.path(traceID.String()))
+	if os.IsNotExist(err) {
+		return nil, spanstore.ErrTraceNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// archiving the same trace twice appends it twice, a Zipkin shared span has the span
+	// ID of its client span so spans are told apart as the deduper does
+	seen := map[spanKey]void{}
+
+	var spans []*model.Span
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var s dbmodel.Span
+		if err = json.Unmarshal(scanner.Bytes(), &s); err != nil {
+			return nil, err
+		}
+
+		span, err := ar.to.SpanToDomain(&s)
+		if err != nil {
+			return nil, err
+		}
+
+		k := keyOf(span)
+		if _, ok := seen[k]; !ok {
+			seen[k] = void{}
+			spans = append(spans, span)
+		}
+	}
+
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(spans) == 0 {
+		return nil, spanstore.ErrTraceNotFound
+	}
+
+	return &model.Trace{Spans: spans}, nil
+}
+
+// GetServices is not used by Jaeger on archive storage, which only loads traces by id.
+func (ar *ArchiveRider) GetServices(ctx context.Context) ([]string, error) {
+	return nil, nil
+}
+
+// GetOperations is not used by Jaeger on archive storage, which only loads traces by id.
+func (ar *ArchiveRider) GetOperations(ctx context.Context, query spanstore.OperationQueryParameters) ([]spanstore.Operation, error) {
+	return nil, nil
+}
+
+// FindTraces is not used by Jaeger on archive storage, which only loads traces by id.
+func (ar *ArchiveRider) FindTraces(ctx context.Context, query *spanstore.TraceQueryParameters) ([]*model.Trace, error) {
+	return nil, nil
+}
+
+// FindTraceIDs is not used by Jaeger on archive storage, which only loads traces by id.
+func (ar *ArchiveRider) FindTraceIDs(ctx context.Context, query *spanstore.TraceQueryParameters) ([]model.TraceID, error) {
+	return nil, nil
+}
+
+func (ar *ArchiveRider) purge(ttl time.Duration) {
+	ar.logger.Warn("purge archive ttl", "ttl", ttl)
+	for range ar.ttlTicker.C {
+		pt := time.Now().Add(-1 * ttl)
+		if err := ar.purgeBefore(pt); err != nil {
+			ar.logger.Error("failed to list archive", "dir", ar.dir, "error", err)
+			continue
+		}
+		ar.logger.Warn("purge archive before", "time", pt)
+	}
+}
+
+// purgeBefore removes traces last written before pt.
+func (ar *ArchiveRider) purgeBefore(pt time.Time) error {
+	files, err := ioutil.ReadDir(ar.dir)
+	if err != nil {
+		return err
+	}
+
+	ar.lock.Lock()
+	defer ar.lock.Unlock()
+	for _, f := range files {
+		if f.IsDir() || filepath.Ext(f.Name()) != archiveExt || !f.ModTime().Before(pt) {
+			continue
+		}
+		if err = os.Remove(filepath.Join(ar.dir, f.Name())); err != nil && !os.IsNotExist(err) {
+			ar.logger.Error("failed to purge archived trace", "file", f.Name(), "error", err)
+		}
+	}
+	return nil
+}
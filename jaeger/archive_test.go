@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/plugin/storage/es/spanstore/dbmodel"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+)
+
+func TestArchiveRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ar := newArchiveRider(logger, dir, 0)
+	defer ar.Close()
+
+	start := time.Unix(1600000000, 0).UTC()
+	root := testSpan(1, 11, "frontend", start)
+	root.Tags = []model.KeyValue{model.Bool("error", true), model.Int64("http.status_code", 500)}
+	root.Logs = []model.Log{{Timestamp: start.Add(time.Millisecond), Fields: []model.KeyValue{model.String("event", "retry")}}}
+	// a Zipkin shared span
+	client := testKind(testChild(1, 12, "frontend", start.Add(time.Millisecond), childOf(1, 11)), "client")
+	server := testKind(testChild(1, 12, "driver", start.Add(2*time.Millisecond), childOf(1, 12)), "server")
+
+	tests := []struct {
+		name  string
+		write func() error
+		trace uint64
+		want  []*model.Span
+	}{
+		{
+			"spans", func() error {
+				for _, s := range []*model.Span{root, client, server} {
+					if err := ar.WriteSpan(context.Background(), s); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+			1, []*model.Span{root, client, server},
+		},
+		{
+			"archived twice", func() error { return ar.WriteSpan(context.Background(), root) },
+			1, []*model.Span{root, client, server},
+		},
+		{
+			"as stored in the wave", func() error {
+				return ar.writeTrace(model.NewTraceID(0, 2).String(), []*dbmodel.Span{dbmodel.FromDomain{}.FromDomainEmbedProcess(testSpan(2, 21, "driver", start))})
+			},
+			2, []*model.Span{testSpan(2, 21, "driver", start)},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.write(); err != nil {
+				t.Fatalf("write error = %v", err)
+			}
+			trace, err := ar.GetTrace(context.Background(), model.NewTraceID(0, tt.trace))
+			if err != nil {
+				t.Fatalf("GetTrace() error = %v", err)
+			}
+			// spans come back as converted from the stored documents
+			want := make([]*model.Span, len(tt.want))
+			for i, s := range tt.want {
+				if want[i], err = (dbmodel.ToDomain{}).SpanToDomain(dbmodel.FromDomain{}.FromDomainEmbedProcess(s)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if !reflect.DeepEqual(trace.Spans, want) {
+				t.Errorf("GetTrace() = %v, want %v", trace.Spans, want)
+			}
+		})
+	}
+
+	if _, err = ar.GetTrace(context.Background(), model.NewTraceID(0, 3)); err != spanstore.ErrTraceNotFound {
+		t.Errorf("GetTrace() of a trace never archived error = %v, want %v", err, spanstore.ErrTraceNotFound)
+	}
+}
+
+func TestArchivePurge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ar := newArchiveRider(logger, dir, 0)
+	defer ar.Close()
+
+	// traces archived a day, an hour and a minute ago
+	now := time.Now()
+	ages := []time.Duration{24 * time.Hour, time.Hour, time.Minute}
+	for i, age := range ages {
+		span := testSpan(uint64(i+1), 1, "frontend", now.Add(-1*age))
+		if err = ar.WriteSpan(context.Background(), span); err != nil {
+			t.Fatal(err)
+		}
+		at := now.Add(-1 * age)
+		if err = os.Chtimes(ar.path(span.TraceID.String()), at, at); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// not an archived trace
+	other := filepath.Join(dir, "notes.txt")
+	if err = ioutil.WriteFile(other, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chtimes(other, now.Add(-48*time.Hour), now.Add(-48*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		name string
+		ttl  time.Duration
+		want []bool // trace found by age
+	}{
+		{"none expired", 48 * time.Hour, []bool{true, true, true}},
+		{"past the ttl", 2 * time.Hour, []bool{false, true, true}},
+		{"written since are kept", 10 * time.Minute, []bool{false, false, true}},
+	}
+	for _, s := range steps {
+		if err = ar.purgeBefore(now.Add(-1 * s.ttl)); err != nil {
+			t.Fatalf("%s: purgeBefore() error = %v", s.name, err)
+		}
+		for i, want := range s.want {
+			_, err := ar.GetTrace(context.Background(), model.NewTraceID(0, uint64(i+1)))
+			if got := err == nil; got != want {
+				t.Errorf("%s: trace archived %v ago found = %v, want %v", s.name, ages[i], got, want)
+			}
+		}
+	}
+	if _, err = os.Stat(other); err != nil {
+		t.Errorf("purgeBefore() removed a file that isn't an archived trace: %v", err)
+	}
+}
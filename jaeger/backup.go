@@ -0,0 +1,932 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chronowave/chronowave/embed"
+	"github.com/chronowave/chronowave/ssd"
+	ssdexec "github.com/chronowave/chronowave/ssd/exec"
+	ssdidx "github.com/chronowave/chronowave/ssd/index"
+	"github.com/chronowave/chronowave/ssql"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	backupVersion = 1
+
+	// archive entries besides index/<segment>, wal/<n>, archive/<trace> and kept/<trace>,
+	// the manifest comes last
+	backupManifestName = "manifest.json"
+	backupCatalogName  = "catalog.json"
+	backupSummaryName  = "summary.ndjson"
+
+	// WAL documents restored per segment, as many as the wave indexes at once
+	restoreBatch = 256
+)
+
+var (
+	backupSegmentName = regexp.MustCompile(`^index/[0-9A-F]{16}$`)
+	backupWALName     = regexp.MustCompile(`^wal/[0-9]+$`)
+	backupTraceName   = regexp.MustCompile(`^(archive|kept)/[0-9a-f]+\.json$`)
+)
+
+// backupManifest describes a backup archive of the wave.
+type backupManifest struct {
+	Version  int             `json:"version"`
+	Start    int64           `json:"start"` // microseconds since Unix epoch
+	End      int64           `json:"end"`
+	Created  time.Time       `json:"created"`
+	Since    int64           `json:"since"` // trace summaries cover traces started from since
+	Segments []backupSegment `json:"segments"`
+	WAL      int             `json:"wal"`      // documents in wal/, numbered from 1
+	Archived int             `json:"archived"` // traces in archive/
+	Kept     int             `json:"kept"`     // traces in kept/, kept by tail retention
+}
+
+// backupSegment is an index segment as the wave table lists it.
+type backupSegment struct {
+	WID     int64  `json:"wid"`
+	Begin   int64  `json:"begin"`
+	End     int64  `json:"end"`
+	Created string `json:"created"` // as stored, ChronoWave purges by it
+}
+
+// walDoc is a document copied from the WAL.
+type walDoc struct {
+	name    string // file name when it was copied, without the segment ChronoWave appends
+	segment string // the .<segment> appended when it was copied, if it was being indexed
+	data    []byte
+}
+
+// backup writes archives of the wave in dir while it's written to.
+type backup struct {
+	dir        string
+	archiveDir string
+	index      *waveIndex
+	catalog    *catalog
+	summaries  *summaries
+}
+
+// write writes a gzip compressed tar archive of documents started within [from, to],
+// with index segments, WAL documents, and the service catalog and trace summaries.
+// Segments are archived whole, so the archive may hold documents outside the range,
+// and the catalog and summaries are those of the range the segments span.
+func (b *backup) write(w io.Writer, from, to int64) (*backupManifest, error) {
+	// ChronoWave removes WAL files once the segment they're indexed into is registered,
+	// so documents gone from the WAL by now are in the segments listed next, or in those
+	// registered by the time they are found gone
+	docs, err := readWAL(b.dir, from, to)
+	if err != nil {
+		return nil, err
+	}
+	segments, err := b.index.segments(from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	// documents indexed since they were copied are left to their segment
+	listed := map[string]bool{}
+	for _, s := range segments {
+		listed["."+strconv.FormatInt(s.WID, 10)] = true
+	}
+	wal := filepath.Join(b.dir, "wal")
+	var kept, gone []walDoc
+	for _, d := range docs {
+		path := walFile(wal, d.name)
+		if path == "" {
+			gone = append(gone, d)
+			continue
+		}
+		if ext := filepath.Ext(path); ext != "" {
+			d.segment = ext
+		}
+		if !listed[d.segment] {
+			kept = append(kept, d)
+		}
+	}
+
+	// a document gone since it was copied is in a segment registered since segments
+	// were listed, those are archived with it
+	if len(gone) > 0 {
+		now, err := b.index.segments(from, to)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range now {
+			if seg := "." + strconv.FormatInt(s.WID, 10); !listed[seg] {
+				listed[seg] = true
+				segments = append(segments, s)
+			}
+		}
+		var still []walDoc
+		for _, d := range kept {
+			if !listed[d.segment] {
+				still = append(still, d)
+			}
+		}
+		// one seen being indexed into a segment purged already is kept, one not seen
+		// being indexed was, into a segment listed by now
+		for _, d := range gone {
+			if d.segment != "" && !listed[d.segment] {
+				still = append(still, d)
+			}
+		}
+		kept = still
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	m := &backupManifest{
+		Version: backupVersion,
+		Start:   from,
+		End:     to,
+		Created: time.Now().UTC(),
+		Since:   b.summaries.since,
+	}
+
+	for _, d := range kept {
+		m.WAL++
+		if err = addEntry(tw, "wal/"+strconv.Itoa(m.WAL), int64(len(d.data)), bytes.NewReader(d.data)); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, s := range segments {
+		added, err := addSegment(tw, b.dir, s.WID)
+		if err != nil {
+			return nil, err
+		}
+		if !added {
+			logger.Warn("segment purged while it was backed up", "segment", s.WID)
+			continue
+		}
+		m.Segments = append(m.Segments, s)
+	}
+
+	// summaries cover every trace started from since once restored, so they have to
+	// include those of documents outside the range too
+	lo, hi := from, to
+	for _, s := range m.Segments {
+		lo, hi = min64(lo, s.Begin), max64(hi, s.End)
+	}
+
+	data, err := json.Marshal(b.catalog.within(lo, hi))
+	if err != nil {
+		return nil, err
+	}
+	if err = addEntry(tw, backupCatalogName, int64(len(data)), bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+
+	if err = b.addSummaries(tw, lo, hi); err != nil {
+		return nil, err
+	}
+
+	// traces archived or kept by tail retention live apart from the wave
+	if m.Archived, err = addTraces(tw, b.archiveDir, "archive/", lo, hi); err != nil {
+		return nil, err
+	}
+	if m.Kept, err = addTraces(tw, filepath.Join(b.dir, keptDir), "kept/", lo, hi); err != nil {
+		return nil, err
+	}
+
+	if data, err = json.Marshal(m); err != nil {
+		return nil, err
+	}
+	if err = addEntry(tw, backupManifestName, int64(len(data)), bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+
+	if err = tw.Close(); err != nil {
+		return nil, err
+	}
+	return m, gz.Close()
+}
+
+// addSummaries spools summaries to a file first, a tar entry needs its size upfront.
+func (b *backup) addSummaries(tw *tar.Writer, from, to int64) error {
+	tmp, err := ioutil.TempFile(b.dir, ".backup-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	if err = b.summaries.within(from, to, func(ts *traceSummary) error { return enc.Encode(ts) }); err != nil {
+		return err
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+
+	size, err := tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return addEntry(tw, backupSummaryName, size, tmp)
+}
+
+// segments returns segments with documents started within [from, to].
+func (x *waveIndex) segments(from, to int64) ([]backupSegment, error) {
+	rows, err := x.db.Query(`SELECT wid, beg, end, CAST(created AS TEXT) FROM wave WHERE beg <= ? AND end >= ? ORDER BY wid`, to, from)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var segments []backupSegment
+	for rows.Next() {
+		var s backupSegment
+		if err = rows.Scan(&s.WID, &s.Begin, &s.End, &s.Created); err != nil {
+			return nil, err
+		}
+		segments = append(segments, s)
+	}
+	return segments, rows.Err()
+}
+
+// readWAL copies WAL documents started within [from, to]. ChronoWave renames a file to
+// <name>.<segment> while it indexes it.
+func readWAL(dir string, from, to int64) ([]walDoc, error) {
+	wal := filepath.Join(dir, "wal")
+	files, err := ioutil.ReadDir(wal)
+	if err != nil {
+		return nil, err
+	}
+
+	var docs []walDoc
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		name := strings.SplitN(f.Name(), ".", 2)[0]
+		data, segment, err := readWALFile(wal, name)
+		if err != nil {
+			return nil, err
+		}
+
+		// a document still being written doesn't parse yet, it's newer than the backup
+		var doc struct {
+			StartTime *int64 `json:"startTime"`
+		}
+		if json.Unmarshal(data, &doc) != nil || doc.StartTime == nil || *doc.StartTime < from || *doc.StartTime > to {
+			continue
+		}
+		docs = append(docs, walDoc{name: name, segment: segment, data: data})
+	}
+	return docs, nil
+}
+
+// readWALFile reads WAL document name, nil if it's been indexed and removed, and the
+// .<segment> of the file it's read from if it's being indexed.
+func readWALFile(wal, name string) ([]byte, string, error) {
+	for {
+		path := walFile(wal, name)
+		if path == "" {
+			return nil, "", nil
+		}
+		data, err := ioutil.ReadFile(path)
+		if !os.IsNotExist(err) {
+			return data, filepath.Ext(path), err
+		}
+		// renamed or removed since it was found
+	}
+}
+
+// walFile returns the file of WAL document name, "" if there is none.
+func walFile(wal, name string) string {
+	path := filepath.Join(wal, name)
+	if _, err := os.Stat(path); err == nil {
+		return path
+	}
+	if matches, _ := filepath.Glob(path + ".*"); len(matches) > 0 {
+		return matches[0]
+	}
+	return ""
+}
+
+// addSegment adds the file of segment wid, false if it's been purged. An opened file
+// can still be read once it's removed.
+func addSegment(tw *tar.Writer, dir string, wid int64) (bool, error) {
+	path := segmentPath(dir, wid)
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	return true, addEntry(tw, "index/"+filepath.Base(path), fi.Size(), f)
+}
+
+// addTraces adds trace files in dir with spans started within [from, to] as prefix<file>,
+// and returns how many. A trace file is appended to while it's read, a span cut short
+// is left out.
+func addTraces(tw *tar.Writer, dir, prefix string, from, to int64) (int, error) {
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	var n int
+	for _, f := range files {
+		if f.IsDir() || !backupTraceName.MatchString(prefix+f.Name()) {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+		if os.IsNotExist(err) {
+			// purged since it was listed
+			continue
+		} else if err != nil {
+			return n, err
+		}
+		data = data[:bytes.LastIndexByte(data, '\n')+1]
+		if !tracesWithin(data, from, to) {
+			continue
+		}
+
+		// archived traces are purged by when they were last written
+		if err = addEntryAt(tw, prefix+f.Name(), int64(len(data)), bytes.NewReader(data), f.ModTime()); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// tracesWithin returns true if a span of newline delimited spans data started within
+// [from, to].
+func tracesWithin(data []byte, from, to int64) bool {
+	for _, line := range bytes.Split(data, []byte{'\n'}) {
+		var span struct {
+			StartTime int64 `json:"startTime"`
+		}
+		if json.Unmarshal(line, &span) == nil && span.StartTime >= from && span.StartTime <= to {
+			return true
+		}
+	}
+	return false
+}
+
+func addEntry(tw *tar.Writer, name string, size int64, r io.Reader) error {
+	return addEntryAt(tw, name, size, r, time.Now())
+}
+
+func addEntryAt(tw *tar.Writer, name string, size int64, r io.Reader, modTime time.Time) error {
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    size,
+		ModTime: modTime,
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := io.CopyN(tw, r, size)
+	return err
+}
+
+// getBackup streams a backup archive of documents started within start and end, in
+// microseconds since Unix epoch, all by default. Pending spans are flushed first.
+func (wr *WaveRider) getBackup(c echo.Context) error {
+	start, err := int64Param(c, "start", 0)
+	if err != nil {
+		return err
+	}
+	end, err := int64Param(c, "end", math.MaxInt64)
+	if err != nil {
+		return err
+	}
+	if start > end {
+		return echo.NewHTTPError(http.StatusBadRequest, "start is after end")
+	}
+
+	wr.batcher.flush()
+
+	b := &backup{dir: wr.dir, archiveDir: wr.archiveDir, index: wr.index, catalog: wr.catalog, summaries: wr.summaries}
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "application/gzip")
+	res.Header().Set(echo.HeaderContentDisposition,
+		fmt.Sprintf(`attachment; filename="chronowave-%s.tar.gz"`, time.Now().UTC().Format("20060102T150405Z")))
+	res.WriteHeader(http.StatusOK)
+
+	if _, err = b.write(res, start, end); err != nil {
+		// the status is sent, the truncated archive fails to restore
+		logger.Error("backup failed", "error", err)
+	}
+	return nil
+}
+
+// runBackup is the backup command:
+//
+//	chronowave-jaeger -config plugin.yaml backup [-start time] [-end time] archive
+//
+// It reads chronowave.dir without writing the wave, a running plugin is backed up with
+// GET /admin/backup instead, which includes its pending spans.
+func runBackup(conf *conf, args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	start := fs.String("start", "", "Back up documents started from this RFC 3339 time, the oldest by default")
+	end := fs.String("end", "", "Back up documents started until this RFC 3339 time, the newest by default")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("give one archive to write")
+	}
+
+	from, to := int64(0), int64(math.MaxInt64)
+	if *start != "" {
+		t, err := time.Parse(time.RFC3339, *start)
+		if err != nil {
+			return err
+		}
+		from = micros(t)
+	}
+	if *end != "" {
+		t, err := time.Parse(time.RFC3339, *end)
+		if err != nil {
+			return err
+		}
+		to = micros(t)
+	}
+
+	if _, err := os.Stat(filepath.Join(conf.dir, "db")); err != nil {
+		return fmt.Errorf("no wave in %s: %v", conf.dir, err)
+	}
+	index, err := openWaveIndex(conf.dir)
+	if err != nil {
+		return err
+	}
+	defer index.Close()
+	cat, err := openCatalog(conf.dir)
+	if err != nil {
+		return err
+	}
+	defer cat.Close()
+	sum, err := openSummaries(conf.dir)
+	if err != nil {
+		return err
+	}
+	defer sum.Close()
+
+	archive := fs.Arg(0)
+	f, err := os.Create(archive)
+	if err != nil {
+		return err
+	}
+	b := &backup{dir: conf.dir, archiveDir: conf.archiveDir, index: index, catalog: cat, summaries: sum}
+	m, err := b.write(f, from, to)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(archive)
+		return err
+	}
+
+	logger.Info("backup written", "archive", archive, "segments", len(m.Segments), "wal", m.WAL, "archived", m.Archived, "kept", m.Kept)
+	return nil
+}
+
+// runRestore is the restore command:
+//
+//	chronowave-jaeger -config plugin.yaml restore archive
+//
+// It loads a backup archive into chronowave.dir, empty or not. The plugin must not run
+// on the same directory.
+func runRestore(conf *conf, args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("give one archive to restore")
+	}
+
+	m, err := restoreBackup(conf, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	logger.Info("backup restored", "archive", fs.Arg(0), "segments", len(m.Segments), "wal", m.WAL, "archived", m.Archived, "kept", m.Kept)
+	return nil
+}
+
+// restoreBackup loads archive into the wave in chronowave.dir. Segments are numbered
+// after those in dir and keep when they were created, so they are purged as they would
+// have been. WAL documents are indexed into segments of their own.
+func restoreBackup(conf *conf, archive string) (*backupManifest, error) {
+	dir := conf.dir
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	tmp, err := ioutil.TempDir(dir, ".restore-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+
+	m, err := extractBackup(archive, tmp)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = restoreWAL(dir, tmp, m.WAL); err != nil {
+		return nil, err
+	}
+	if err = restoreSegments(dir, tmp, m.Segments); err != nil {
+		return nil, err
+	}
+	if err = restoreCatalog(dir, tmp); err != nil {
+		return nil, err
+	}
+	if err = restoreSummaries(dir, tmp, m.Since); err != nil {
+		return nil, err
+	}
+	if _, err = restoreTraces(filepath.Join(tmp, "archive"), conf.archiveDir); err != nil {
+		return nil, err
+	}
+	kept, err := restoreTraces(filepath.Join(tmp, "kept"), filepath.Join(dir, keptDir))
+	if err != nil {
+		return nil, err
+	}
+	if err = restoreKept(dir, kept); err != nil {
+		return nil, err
+	}
+	return m, restoreDependencies(conf, m)
+}
+
+// restoreDependencies computes dependency buckets stored in the wave again with the
+// spans restored, within the backup range widened to the segments restored.
+func restoreDependencies(conf *conf, m *backupManifest) error {
+	from, to := m.Start, m.End
+	for _, s := range m.Segments {
+		from, to = min64(from, s.Begin), max64(to, s.End)
+	}
+
+	wave := embed.NewWave(conf.dir, timestamp, keys)
+	defer wave.Close()
+	return recomputeDependencies(wave, conf.dir, conf.depBucket, from, to)
+}
+
+// extractBackup extracts archive into tmp and returns its manifest. An archive cut short
+// has no manifest.
+func extractBackup(archive, tmp string) (*backupManifest, error) {
+	f, err := os.Open(archive)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(bufio.NewReader(f))
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	var m *backupManifest
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		switch name := hdr.Name; {
+		case name == backupManifestName:
+			m = &backupManifest{}
+			if err = json.NewDecoder(tr).Decode(m); err != nil {
+				return nil, err
+			}
+		case name == backupCatalogName, name == backupSummaryName, backupSegmentName.MatchString(name), backupWALName.MatchString(name),
+			backupTraceName.MatchString(name):
+			path := filepath.Join(tmp, filepath.FromSlash(name))
+			if err = os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+				return nil, err
+			}
+			out, err := os.Create(path)
+			if err != nil {
+				return nil, err
+			}
+			_, err = io.Copy(out, tr)
+			if cerr := out.Close(); err == nil {
+				err = cerr
+			}
+			if err == nil {
+				err = os.Chtimes(path, hdr.ModTime, hdr.ModTime)
+			}
+			if err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("unexpected entry %s in backup archive", name)
+		}
+	}
+
+	if m == nil {
+		return nil, errors.New("no manifest, not a complete backup archive")
+	}
+	if m.Version != backupVersion {
+		return nil, fmt.Errorf("backup archive version %d, expected %d", m.Version, backupVersion)
+	}
+	return m, nil
+}
+
+// restoreWAL indexes n WAL documents extracted to tmp. WAL files can't be restored as
+// they are, the wave numbers them from 1 again every time it's opened. It opens the
+// wave either way, which creates it in an empty dir.
+func restoreWAL(dir, tmp string, n int) error {
+	wave := embed.NewWave(dir, timestamp, keys)
+	defer wave.Close()
+
+	batch := filepath.Join(tmp, "batch")
+	for i := 1; i <= n; i += restoreBatch {
+		var buf bytes.Buffer
+		for j := i; j < i+restoreBatch && j <= n; j++ {
+			data, err := ioutil.ReadFile(filepath.Join(tmp, "wal", strconv.Itoa(j)))
+			if err != nil {
+				return err
+			}
+			buf.Write(data)
+		}
+		if err := ioutil.WriteFile(batch, buf.Bytes(), 0644); err != nil {
+			return err
+		}
+		if err := embed.Build(batch, timestamp, keys); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreSegments moves segments extracted to tmp into the wave, and registers them
+// with their keys.
+func restoreSegments(dir, tmp string, segments []backupSegment) error {
+	db, err := sql.Open("sqlite3", filepath.Join(dir, "db"))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	for _, s := range segments {
+		src := filepath.Join(tmp, "index", filepath.Base(segmentPath(tmp, s.WID)))
+		data, err := ioutil.ReadFile(src)
+		if err != nil {
+			return err
+		}
+		values, err := segmentKeys(data)
+		if err != nil {
+			return fmt.Errorf("segment %d: %v", s.WID, err)
+		}
+
+		var wid int64
+		if err = db.QueryRow(`SELECT IFNULL(MAX(wid), 0) + 1 FROM wave`).Scan(&wid); err != nil {
+			return err
+		}
+		path := segmentPath(dir, wid)
+		if err = os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+			return err
+		}
+		if err = os.Rename(src, path); err != nil {
+			return err
+		}
+
+		if err = registerSegment(db, wid, s, values); err != nil {
+			os.Remove(path)
+			return err
+		}
+	}
+	return nil
+}
+
+// registerSegment adds segment s as wid to the wave and key tables, as ChronoWave does
+// once it built a segment.
+func registerSegment(db *sql.DB, wid int64, s backupSegment, values [][]string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if _, err = tx.Exec(`INSERT INTO wave (wid, beg, end, created) VALUES (?, ?, ?, ?)`, wid, s.Begin, s.End, s.Created); err != nil {
+		tx.Rollback()
+		return err
+	}
+	for i, path := range keys {
+		for _, key := range values[i] {
+			_, err = tx.Exec(`INSERT INTO waveloc (path, key, wid, created) VALUES (?, ?, ?, ?) ON CONFLICT DO NOTHING`,
+				path, key, wid, s.Created)
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+// segmentKeys returns the values of keys in segment data, read as ChronoWave reads them
+// when it builds a segment.
+func segmentKeys(data []byte) ([][]string, error) {
+	indexed, err := ssdidx.DecodeIndexBlock(data)
+	if err != nil {
+		return nil, err
+	}
+
+	stmt := &ssql.Statement{
+		Find: []*ssql.Attribute{{Name: "ts"}},
+		Where: []*ssql.Expr{{Field: &ssql.Expr_Tuple{
+			Tuple: &ssql.Tuple{Name: "ts", Path: timestamp},
+		}}},
+	}
+	for i, key := range keys {
+		name := strconv.Itoa(i)
+		stmt.Find = append(stmt.Find, &ssql.Attribute{Name: name})
+		stmt.Where = append(stmt.Where, &ssql.Expr{Field: &ssql.Expr_Tuple{
+			Tuple: &ssql.Tuple{Name: name, Path: key},
+		}})
+	}
+
+	values := make([][]string, len(keys))
+	rs := ssdexec.Exec(indexed, stmt)
+	if rs == nil {
+		return values, nil
+	}
+	for i := range keys {
+		col := i + 1
+		seen := map[string]bool{}
+		for j := range rs.RowId {
+			if rs.Column[col].RowIdx[j] == 0 {
+				continue
+			}
+			v := rs.Column[col].Value[j]
+			var key string
+			switch rs.ColumnType[col] {
+			case ssd.TEXT:
+				key = string(rs.Text[v])
+			case ssd.INT64:
+				key = strconv.FormatUint(v, 16)
+			}
+			if key != "" && !seen[key] {
+				seen[key] = true
+				values[i] = append(values[i], key)
+			}
+		}
+	}
+	return values, nil
+}
+
+func restoreCatalog(dir, tmp string) error {
+	data, err := ioutil.ReadFile(filepath.Join(tmp, backupCatalogName))
+	if err != nil {
+		return err
+	}
+	var records []catalogRecord
+	if err = json.Unmarshal(data, &records); err != nil {
+		return err
+	}
+
+	cat, err := openCatalog(dir)
+	if err != nil {
+		return err
+	}
+	defer cat.Close()
+	return cat.merge(records)
+}
+
+// restoreSummaries merges summaries of the archive, which cover traces from since. The
+// summaries in dir then cover traces from the later since, or from since if there were
+// none.
+func restoreSummaries(dir, tmp string, since int64) error {
+	_, err := os.Stat(filepath.Join(dir, summaryFile))
+	fresh := os.IsNotExist(err)
+
+	f, err := os.Open(filepath.Join(tmp, backupSummaryName))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sum, err := openSummaries(dir)
+	if err != nil {
+		return err
+	}
+	defer sum.Close()
+
+	dec := json.NewDecoder(bufio.NewReader(f))
+	batch := make([]*traceSummary, 0, summaryPage)
+	for {
+		var ts traceSummary
+		err = dec.Decode(&ts)
+		if err == nil {
+			batch = append(batch, &ts)
+		} else if err != io.EOF {
+			return err
+		}
+		if len(batch) == summaryPage || (err == io.EOF && len(batch) > 0) {
+			if err := sum.merge(batch); err != nil {
+				return err
+			}
+			batch = batch[:0]
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+
+	if fresh || since > sum.since {
+		return sum.cover(since)
+	}
+	return nil
+}
+
+// restoreTraces appends trace files extracted to tmp to those in dir, and returns their
+// trace IDs. A trace new to dir keeps when it was last written, to be purged as it
+// would have been.
+func restoreTraces(tmp, dir string) ([]string, error) {
+	files, err := ioutil.ReadDir(tmp)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	tids := make([]string, 0, len(files))
+	for _, f := range files {
+		data, err := ioutil.ReadFile(filepath.Join(tmp, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		path := filepath.Join(dir, f.Name())
+		_, err = os.Stat(path)
+		fresh := os.IsNotExist(err)
+		out, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, os.ModePerm)
+		if err != nil {
+			return nil, err
+		}
+		_, err = out.Write(data)
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil && fresh {
+			err = os.Chtimes(path, f.ModTime(), f.ModTime())
+		}
+		if err != nil {
+			return nil, err
+		}
+		tids = append(tids, strings.TrimSuffix(f.Name(), archiveExt))
+	}
+	return tids, nil
+}
+
+// restoreKept records traces restored to kept/ as kept, so tail retention doesn't keep
+// their summaries again.
+func restoreKept(dir string, tids []string) error {
+	if len(tids) == 0 {
+		return nil
+	}
+
+	sum, err := openSummaries(dir)
+	if err != nil {
+		return err
+	}
+	defer sum.Close()
+
+	kept := make(map[string]bool, len(tids))
+	for _, tid := range tids {
+		kept[tid] = true
+	}
+	return sum.classify(kept)
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/chronowave/chronowave/embed"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/plugin/storage/es/spanstore/dbmodel"
+
+	"chronowave-jaeger/builder"
+)
+
+// TestBackupRestore backs up a range within the oldest of two segments and a WAL
+// document, and reads spans, catalog and summaries back from another wave.
+func TestBackupRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Now().Truncate(time.Second)
+	doc := func(span *model.Span) []byte {
+		data, err := json.Marshal(dbmodel.FromDomain{}.FromDomainEmbedProcess(span))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	// a segment per import
+	src := &conf{dir: filepath.Join(dir, "src"), archiveDir: filepath.Join(dir, "src", "archive"), ttl: 24 * time.Hour, depBucket: time.Hour}
+	dumps := [][]*model.Span{
+		{testSpan(1, 11, "redis", now.Add(-3*time.Hour)), testSpan(2, 21, "frontend", now.Add(-2*time.Hour))},
+		{testSpan(3, 31, "driver", now.Add(-30*time.Minute))},
+	}
+	for i, spans := range dumps {
+		var dump []byte
+		for _, span := range spans {
+			dump = append(append(dump, doc(span)...), '\n')
+		}
+		file := filepath.Join(dir, fmt.Sprintf("dump-%d.json", i))
+		if err = ioutil.WriteFile(file, dump, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err = runImport(src, []string{"-progress", "1h", file}); err != nil {
+			t.Fatalf("runImport() error = %v", err)
+		}
+	}
+
+	wave := embed.NewWave(src.dir, timestamp, keys)
+	err = wave.OnNewDocument(doc(testSpan(4, 41, "customer", now.Add(-2*time.Hour))))
+	wave.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// traces archived and kept by tail retention, within the range and before it
+	archived := newArchiveRider(logger, src.archiveDir, 0)
+	kept := newArchiveRider(logger, filepath.Join(src.dir, keptDir), 0)
+	for _, span := range []*model.Span{testSpan(5, 51, "frontend", now.Add(-2*time.Hour)), testSpan(6, 61, "frontend", now.Add(-5*time.Hour))} {
+		if err = archived.WriteSpan(context.Background(), span); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, span := range []*model.Span{testSpan(7, 71, "frontend", now.Add(-2*time.Hour)), testSpan(8, 81, "frontend", now.Add(-5*time.Hour))} {
+		if err = kept.WriteSpan(context.Background(), span); err != nil {
+			t.Fatal(err)
+		}
+	}
+	archived.Close()
+	kept.Close()
+
+	archive := filepath.Join(dir, "backup.tar.gz")
+	from, to := now.Add(-2*time.Hour-10*time.Minute), now.Add(-110*time.Minute)
+	err = runBackup(src, []string{"-start", from.Format(time.RFC3339), "-end", to.Format(time.RFC3339), archive})
+	if err != nil {
+		t.Fatalf("runBackup() error = %v", err)
+	}
+
+	dst := filepath.Join(dir, "dst")
+	m, err := restoreBackup(&conf{dir: dst, archiveDir: filepath.Join(dst, "archive"), depBucket: time.Hour}, archive)
+	if err != nil {
+		t.Fatalf("restoreBackup() error = %v", err)
+	}
+	if m.Start != micros(from) || m.End != micros(to) {
+		t.Errorf("manifest range = [%d, %d], want [%d, %d]", m.Start, m.End, micros(from), micros(to))
+	}
+	if m.Archived != 1 || m.Kept != 1 {
+		t.Errorf("manifest archived %d, kept %d traces, want 1, 1", m.Archived, m.Kept)
+	}
+
+	// archived and kept traces of the range are restored
+	traces := []struct {
+		dir   string
+		trace uint64
+		want  bool
+	}{
+		{"archive", 5, true},
+		{"archive", 6, false},
+		{keptDir, 7, true},
+		{keptDir, 8, false},
+	}
+	for _, tt := range traces {
+		ar := newArchiveRider(logger, filepath.Join(dst, tt.dir), 0)
+		_, err := ar.GetTrace(context.Background(), model.NewTraceID(0, tt.trace))
+		ar.Close()
+		if got := err == nil; got != tt.want {
+			t.Errorf("trace %d restored to %s = %v, want %v, error %v", tt.trace, tt.dir, got, tt.want, err)
+		}
+	}
+
+	// the segment is archived whole, trace 1 is restored with trace 2
+	wave = embed.NewWave(dst, timestamp, keys)
+	defer wave.Close()
+	for i, want := range []bool{true, true, false, true} {
+		traceID := model.NewTraceID(0, uint64(i+1)).String()
+		qry, err := builder.Find("s").
+			Where(builder.Path("/traceID").Key(traceID), builder.Var("s", "/")).
+			Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		jdoc, err := wave.Query(context.Background(), qry)
+		if err != nil {
+			t.Fatalf("Query() error = %v", err)
+		}
+		var rs []struct{ S dbmodel.Span }
+		if err = json.Unmarshal(jdoc, &rs); err != nil {
+			t.Fatal(err)
+		}
+		if got := len(rs) == 1; got != want {
+			t.Errorf("trace %d restored = %v (%d spans), want %v", i+1, got, len(rs), want)
+		}
+	}
+
+	// so are its catalog entries and summaries, spans from the WAL only have their own
+	cat, err := openCatalog(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var services []string
+	for _, r := range cat.within(0, micros(now)) {
+		services = append(services, r.Service)
+	}
+	cat.Close()
+	sort.Strings(services)
+	if want := []string{"frontend", "redis"}; !reflect.DeepEqual(services, want) {
+		t.Errorf("restored catalog services = %v, want %v", services, want)
+	}
+
+	sum, err := openSummaries(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sum.Close()
+	var tids []string
+	err = sum.within(0, micros(now), func(ts *traceSummary) error {
+		tids = append(tids, ts.TraceID)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := traceIDs(1, 2); !reflect.DeepEqual(tids, want) {
+		t.Errorf("restored summaries = %v, want %v", tids, want)
+	}
+	var k bool
+	if err = sum.db.QueryRow(`SELECT kept FROM summary_kept WHERE trace_id = ?`, traceIDs(7)[0]).Scan(&k); err != nil || !k {
+		t.Errorf("restored kept trace is classified kept = %v, %v, want true", k, err)
+	}
+}
+
+func TestReadWALFile(t *testing.T) {
+	wal, err := ioutil.TempDir("", "wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(wal)
+
+	for _, name := range []string{"1", "2.7"} {
+		if err = ioutil.WriteFile(filepath.Join(wal, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		data    string
+		segment string
+	}{
+		{"1", "1", ""},
+		{"2", "2.7", ".7"},
+		{"3", "", ""},
+	}
+	for _, tt := range tests {
+		data, segment, err := readWALFile(wal, tt.name)
+		if err != nil {
+			t.Fatalf("readWALFile(%s) error = %v", tt.name, err)
+		}
+		if string(data) != tt.data || segment != tt.segment {
+			t.Errorf("readWALFile(%s) = %q, %q, want %q, %q", tt.name, data, segment, tt.data, tt.segment)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/chronowave/chronowave/embed"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/opentracing/opentracing-go/ext"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	// ErrBackPressure is returned by WriteSpan when the write buffer holds more than
+	// chronowave.write.inflight bytes. Unavailable tells the collector to retry later.
+	ErrBackPressure = status.Error(codes.Unavailable, "chronowave write buffer is full, retry later")
+
+	// ErrWriterClosed is returned by WriteSpan once the plugin is shutting down, spans
+	// added after the last flush would be lost.
+	ErrWriterClosed = status.Error(codes.Unavailable, "chronowave is shutting down, retry later")
+)
+
+type pendingSpan struct {
+	doc       []byte
+	traceID   string
+	service   string
+	op        string
+	kind      string
+	startTime int64 // microseconds since Unix epoch
+	duration  int64 // microseconds
+	root      bool  // no ChildOf reference, links of other kinds don't make a child
+	failed    bool
+}
+
+func newPendingSpan(span *model.Span, doc []byte) pendingSpan {
+	kind, _ := span.GetSpanKind()
+	failed := false
+	if kv, ok := model.KeyValues(span.Tags).FindByKey(string(ext.Error)); ok {
+		failed = kv.AsString() == "true"
+	}
+
+	return pendingSpan{
+		doc:       doc,
+		traceID:   span.TraceID.String(),
+		service:   span.Process.ServiceName,
+		op:        span.OperationName,
+		kind:      kind,
+		startTime: int64(model.TimeAsEpochMicroseconds(span.StartTime)),
+		duration:  int64(model.DurationAsMicroseconds(span.Duration)),
+		root:      span.ParentSpanID() == 0,
+		failed:    failed,
+	}
+}
+
+// spanBatcher decouples WriteSpan from the wave. Spans are queued in memory and
+// handed to the wave in batches, either when batch size is reached or on every
+// flush interval.
+type spanBatcher struct {
+	stream   *embed.WaveStream
+	onFlush  func([]pendingSpan)
+	size     int
+	maxBytes int64
+	inflight int64
+	failed   uint64 // spans the wave failed to write, after add accepted them
+	pending  []pendingSpan
+	closing  bool
+	lock     sync.Mutex
+	flushing sync.Mutex // held for a whole flush, spans taken are written when it's released
+	kick     chan void
+	done     chan void
+	closed   sync.WaitGroup
+}
+
+type void struct{}
+
+func newSpanBatcher(stream *embed.WaveStream, conf *conf, onFlush func([]pendingSpan)) *spanBatcher {
+	b := &spanBatcher{
+		stream:   stream,
+		onFlush:  onFlush,
+		size:     conf.batchSize,
+		maxBytes: conf.maxInflight,
+		pending:  make([]pendingSpan, 0, conf.batchSize),
+		kick:     make(chan void, 1),
+		done:     make(chan void),
+	}
+
+	b.closed.Add(1)
+	go b.loop(conf.flushInterval)
+
+	return b
+}
+
+func (b *spanBatcher) add(span *model.Span, doc []byte) error {
+	sz := int64(len(doc))
+	if atomic.AddInt64(&b.inflight, sz) > b.maxBytes {
+		atomic.AddInt64(&b.inflight, -sz)
+		return ErrBackPressure
+	}
+
+	b.lock.Lock()
+	if b.closing {
+		b.lock.Unlock()
+		atomic.AddInt64(&b.inflight, -sz)
+		return ErrWriterClosed
+	}
+	b.pending = append(b.pending, newPendingSpan(span, doc))
+	full := len(b.pending) >= b.size
+	b.lock.Unlock()
+
+	if full {
+		select {
+		case b.kick <- void{}:
+		default:
+		}
+	}
+
+	return nil
+}
+
+func (b *spanBatcher) loop(interval time.Duration) {
+	defer b.closed.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-b.kick:
+		case <-b.done:
+			b.flush()
+			return
+		}
+		b.flush()
+	}
+}
+
+// flush writes pending spans to the wave and hands those written to onFlush. It
+// returns once spans taken by a flush running at the same time are written too.
+func (b *spanBatcher) flush() {
+	b.flushing.Lock()
+	defer b.flushing.Unlock()
+
+	b.lock.Lock()
+	batch := b.pending
+	b.pending = make([]pendingSpan, 0, b.size)
+	b.lock.Unlock()
+
+	if len(batch) == 0 {
+		return
+	}
+
+	// spans the wave failed to write are left out of the catalog, summaries and metrics
+	var sz int64
+	written := batch[:0]
+	for _, s := range batch {
+		sz += int64(len(s.doc))
+		if err := b.stream.OnNewDocument(s.doc); err != nil {
+			atomic.AddUint64(&b.failed, 1)
+			logger.Error("failed to write span", "error", err)
+			continue
+		}
+		written = append(written, s)
+	}
+	atomic.AddInt64(&b.inflight, -sz)
+
+	if len(written) > 0 {
+		b.onFlush(written)
+	}
+}
+
+// Close flushes pending spans and waits for the flush to complete. Spans added
+// afterwards are rejected with ErrWriterClosed.
+func (b *spanBatcher) Close() {
+	b.lock.Lock()
+	b.closing = true
+	b.lock.Unlock()
+
+	close(b.done)
+	b.closed.Wait()
+}
+
+func (b *spanBatcher) writeProm(w io.Writer) error {
+	_, err := fmt.Fprintf(w, `# HELP chronowave_span_write_failures_total Spans accepted by WriteSpan which the wave failed to write.
+# TYPE chronowave_span_write_failures_total counter
+chronowave_span_write_failures_total %d
+`, atomic.LoadUint64(&b.failed))
+	return err
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/chronowave/chronowave/embed"
+)
+
+func TestSpanBatcherBackPressure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "batch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wave := embed.NewWave(dir, timestamp, keys)
+	defer wave.Close()
+	var flushed int
+	b := newSpanBatcher(wave, &conf{batchSize: 100, flushInterval: time.Hour, maxInflight: 100}, func(batch []pendingSpan) {
+		flushed += len(batch)
+	})
+
+	doc := make([]byte, 40)
+	span := testSpan(1, 1, "frontend", time.Now())
+	steps := []struct {
+		name  string
+		flush bool // flush before add
+		want  error
+	}{
+		{"first", false, nil},
+		{"second", false, nil},
+		{"over the limit", false, ErrBackPressure},
+		{"still over", false, ErrBackPressure},
+		{"after a flush", true, nil},
+	}
+	for _, s := range steps {
+		if s.flush {
+			b.flush()
+		}
+		if err := b.add(span, doc); err != s.want {
+			t.Errorf("%s: add() error = %v, want %v", s.name, err, s.want)
+		}
+	}
+	if got := atomic.LoadInt64(&b.inflight); got != 40 {
+		t.Errorf("inflight = %d, want 40", got)
+	}
+
+	// Close flushes what's pending and rejects spans added afterwards
+	b.Close()
+	if flushed != 3 {
+		t.Errorf("flushed = %d spans, want 3", flushed)
+	}
+	if got := atomic.LoadInt64(&b.inflight); got != 0 {
+		t.Errorf("inflight after Close() = %d, want 0", got)
+	}
+	if err := b.add(span, doc); err != ErrWriterClosed {
+		t.Errorf("add() after Close() error = %v, want %v", err, ErrWriterClosed)
+	}
+}
+
+func TestSpanBatcherFlush(t *testing.T) {
+	tests := []struct {
+		name   string
+		spans  int
+		block  []string // WAL files the wave can't write
+		want   []string // services handed to onFlush
+		failed uint64
+	}{
+		{"written", 3, nil, []string{"s1", "s2", "s3"}, 0},
+		{"one failed", 3, []string{"2"}, []string{"s1", "s3"}, 1},
+		{"all failed", 2, []string{"1", "2"}, nil, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "batch")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			wave := embed.NewWave(dir, timestamp, keys)
+			defer wave.Close()
+			// a directory in place of the next WAL file fails the write
+			for _, name := range tt.block {
+				if err = os.MkdirAll(filepath.Join(dir, "wal", name), 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var got []string
+			calls := 0
+			b := newSpanBatcher(wave, &conf{batchSize: 100, flushInterval: time.Hour, maxInflight: 1 << 20}, func(batch []pendingSpan) {
+				calls++
+				for _, s := range batch {
+					got = append(got, s.service)
+				}
+			})
+			for i := 1; i <= tt.spans; i++ {
+				span := testSpan(1, uint64(i), fmt.Sprintf("s%d", i), time.Now())
+				if err = b.add(span, []byte(`{}`)); err != nil {
+					t.Fatalf("add() error = %v", err)
+				}
+			}
+			b.Close()
+
+			if len(got) != len(tt.want) {
+				t.Fatalf("onFlush() got %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("onFlush() got %v, want %v", got, tt.want)
+					break
+				}
+			}
+			wantCalls := 1
+			if len(tt.want) == 0 {
+				wantCalls = 0
+			}
+			if calls != wantCalls {
+				t.Errorf("onFlush() called %d times, want %d", calls, wantCalls)
+			}
+			if b.failed != tt.failed {
+				t.Errorf("failed = %d, want %d", b.failed, tt.failed)
+			}
+			if b.inflight != 0 {
+				t.Errorf("inflight = %d, want 0", b.inflight)
+			}
+		})
+	}
+}
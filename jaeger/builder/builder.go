@@ -0,0 +1,140 @@
+// Package builder builds SSQL statements for ChronoWave, quoting user input
+// so it can't change the meaning of a query.
+//
+// A statement is started with Find, filtered by clauses in Where, and rendered
+// with Build:
+//
+//	qry, err := builder.Find("s").
+//		Where(builder.Path("/traceID").Key(traceID), builder.Var("s", "/")).
+//		Build()
+package builder
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrEmptyWhere is returned by Build when the statement has no clause, SSQL requires at least one.
+	ErrEmptyWhere = errors.New("ssql: statement has no where clause")
+
+	name = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.-]*$`)
+	path = regexp.MustCompile(`^/([A-Za-z_][A-Za-z0-9_.-]*(/[A-Za-z_][A-Za-z0-9_.-]*)*)?$`)
+)
+
+// Clause is a term of the WHERE part of a statement.
+type Clause interface {
+	write(sb *strings.Builder) error
+}
+
+type order struct {
+	name string
+	desc bool
+}
+
+// Query is a SSQL statement under construction.
+type Query struct {
+	find    []string
+	where   []Clause
+	orderBy []order
+	limit   int
+}
+
+// Find starts a statement selecting variables, names are given without leading '$'.
+func Find(names ...string) *Query {
+	return &Query{find: names}
+}
+
+// Where appends clauses, all of them must match.
+func (q *Query) Where(clauses ...Clause) *Query {
+	q.where = append(q.where, clauses...)
+	return q
+}
+
+// OrderBy sorts results by variable, ascending unless desc.
+func (q *Query) OrderBy(name string, desc bool) *Query {
+	q.orderBy = append(q.orderBy, order{name: name, desc: desc})
+	return q
+}
+
+// Limit caps the number of results, zero means no limit.
+func (q *Query) Limit(n int) *Query {
+	q.limit = n
+	return q
+}
+
+// Build renders the statement.
+func (q *Query) Build() (string, error) {
+	if len(q.find) == 0 {
+		return "", errors.New("ssql: statement selects nothing")
+	}
+	if len(q.where) == 0 {
+		return "", ErrEmptyWhere
+	}
+
+	sb := strings.Builder{}
+	sb.WriteString("FIND ")
+	for i, n := range q.find {
+		if err := validName(n); err != nil {
+			return "", err
+		}
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		sb.WriteByte('$')
+		sb.WriteString(n)
+	}
+
+	sb.WriteString(" WHERE ")
+	for _, c := range q.where {
+		if err := c.write(&sb); err != nil {
+			return "", err
+		}
+	}
+
+	for i, o := range q.orderBy {
+		if err := validName(o.name); err != nil {
+			return "", err
+		}
+		if i == 0 {
+			sb.WriteString(" ORDER-BY ")
+		} else {
+			sb.WriteString(", ")
+		}
+		sb.WriteByte('$')
+		sb.WriteString(o.name)
+		if o.desc {
+			sb.WriteString(" DESC")
+		} else {
+			sb.WriteString(" ASC")
+		}
+	}
+
+	if q.limit < 0 {
+		return "", fmt.Errorf("ssql: negative limit %d", q.limit)
+	} else if q.limit > 0 {
+		sb.WriteString(" LIMIT ")
+		sb.WriteString(strconv.Itoa(q.limit))
+	}
+
+	return sb.String(), nil
+}
+
+// MustBuild is like Build but panics on error, for statements without user input.
+func (q *Query) MustBuild() string {
+	qry, err := q.Build()
+	if err != nil {
+		panic(err)
+	}
+	return qry
+}
+
+func validName(n string) error {
+	if !name.MatchString(n) {
+		return fmt.Errorf("ssql: invalid variable name %q", n)
+	}
+	return nil
+}
@@ -0,0 +1,194 @@
+package builder
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/chronowave/chronowave/ssql"
+	"github.com/chronowave/chronowave/ssql/parser"
+)
+
+func parse(t *testing.T, q *Query) *ssql.Statement {
+	t.Helper()
+
+	qry, err := q.Build()
+	if err != nil {
+		t.Fatalf("Build() error = %v", err)
+	}
+
+	stmt, errs := parser.Parse(qry)
+	if len(errs) > 0 {
+		t.Fatalf("Parse(%s) errors = %v", qry, errs)
+	}
+
+	return stmt
+}
+
+func tuple(expr *ssql.Expr) *ssql.Tuple {
+	return expr.Field.(*ssql.Expr_Tuple).Tuple
+}
+
+func text(op *ssql.Operand) string {
+	return op.Value.(*ssql.Operand_Text).Text
+}
+
+func TestFind(t *testing.T) {
+	stmt := parse(t, Find("tid", "st").
+		Where(Var("tid", "/traceID"), Var("st", "/startTime").Timeframe(10, 20)).
+		OrderBy("st", true).
+		Limit(5))
+
+	want := &ssql.Statement{
+		Find: []*ssql.Attribute{{Name: "tid"}, {Name: "st"}},
+		Where: []*ssql.Expr{
+			{Field: &ssql.Expr_Tuple{Tuple: &ssql.Tuple{Name: "tid", Path: "/traceID"}}},
+			{Field: &ssql.Expr_Tuple{Tuple: &ssql.Tuple{
+				Name: "st",
+				Path: "/startTime",
+				Predicate: &ssql.Tuple_Timeframe{Timeframe: &ssql.Binary{
+					First:  &ssql.Operand{Value: &ssql.Operand_Int{Int: 10}},
+					Second: &ssql.Operand{Value: &ssql.Operand_Int{Int: 20}},
+				}},
+			}}},
+		},
+		OrderBy: []*ssql.OrderBy{{Name: "st", Direction: ssql.OrderBy_DESC}},
+		Limit:   5,
+	}
+
+	if !reflect.DeepEqual(stmt, want) {
+		t.Errorf("Parse() = %v, want %v", stmt, want)
+	}
+}
+
+func TestQuoted(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+	}{
+		{"plain", "00000000000000010000000000000001"},
+		{"single quote", "it's"},
+		{"single and double quote", `it's "quoted"`},
+		{"bracket", "a')] [$s /"},
+		{"escaped backslash", `a\\`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stmt := parse(t, Find("s").Where(Var("s", "/"), Path("/traceID").Key(tt.value)))
+			key := tuple(stmt.Where[1]).Predicate.(*ssql.Tuple_Key).Key
+			if got := text(key.First); got != tt.value {
+				t.Errorf("KEY = %q, want %q", got, tt.value)
+			}
+
+			stmt = parse(t, Find("s").Where(Var("s", "/"), Path("/traceID").In(tt.value, "b")))
+			in := tuple(stmt.Where[1]).Predicate.(*ssql.Tuple_In).In.First.Value.(*ssql.Operand_List).List.Text
+			if !reflect.DeepEqual(in, []string{tt.value, "b"}) {
+				t.Errorf("IN = %q, want %q", in, []string{tt.value, "b"})
+			}
+		})
+	}
+}
+
+func TestQuotedError(t *testing.T) {
+	for _, value := range []string{"'\"`", `a\`} {
+		if qry, err := Find("s").Where(Path("/traceID").Key(value)).Build(); err == nil {
+			t.Errorf("Build() = %s, want error for %q", qry, value)
+		}
+	}
+}
+
+func TestContain(t *testing.T) {
+	tests := []struct {
+		name    string
+		vector  *Vector
+		pattern string
+	}{
+		{"equal", Path("/operationName").Equal("GET /a"), "^GET /a$"},
+		{"equal quote", Path("/operationName").Equal("it's')]"), "^it's')]$"},
+		{"equal all quotes", Path("/operationName").Equal("it's \"a\" `b`"), "^it*s \"a\" `b`$"},
+		{"equal backslash", Path("/operationName").Equal(`a\b`), "^a*b$"},
+		{"equal anchors", Path("/operationName").Equal("^a$"), "*a*"},
+		{"prefix", Path("/operationName").Prefix("a$"), "^a*"},
+		{"prefix wild card", Path("/operationName").Prefix("*a"), "*a"},
+		{"contain", Path("/operationName").Contain("a b"), "a b"},
+		{"match", Path("/operationName").Match("^a*'$"), `^a*'$`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stmt := parse(t, Find("s").Where(Var("s", "/"), tt.vector))
+			contain := tuple(stmt.Where[1]).Predicate.(*ssql.Tuple_Contain).Contain
+			if got := text(contain.First); got != tt.pattern {
+				t.Errorf("CONTAIN = %q, want %q", got, tt.pattern)
+			}
+		})
+	}
+}
+
+func TestNumeric(t *testing.T) {
+	stmt := parse(t, Find("d").Where(
+		Var("d", "/duration").Between(1, 2),
+		Path("/duration").Ge(Int(500)),
+		Path("/duration").Lt(Float(2.5)),
+		Path("/duration").Eq(Float(3)),
+	))
+
+	between := tuple(stmt.Where[0]).Predicate.(*ssql.Tuple_Between).Between
+	if between.First.GetInt() != 1 || between.Second.GetInt() != 2 {
+		t.Errorf("BETWEEN = %v", between)
+	}
+	if ge := tuple(stmt.Where[1]).Predicate.(*ssql.Tuple_Ge).Ge; ge.First.GetInt() != 500 {
+		t.Errorf("GE = %v", ge)
+	}
+	if lt := tuple(stmt.Where[2]).Predicate.(*ssql.Tuple_Lt).Lt; lt.First.GetDouble() != 2.5 {
+		t.Errorf("LT = %v", lt)
+	}
+	if eq := tuple(stmt.Where[3]).Predicate.(*ssql.Tuple_Eq).Eq; eq.First.GetDouble() != 3 {
+		t.Errorf("EQ = %v", eq)
+	}
+
+	if qry, err := Find("d").Where(Path("/duration").Ge(Int(-1))).Build(); err == nil {
+		t.Errorf("Build() = %s, want error for negative number", qry)
+	}
+}
+
+func TestNestedAndOr(t *testing.T) {
+	stmt := parse(t, Find("tid").Where(
+		Var("tid", "/traceID"),
+		Path("/tags").Nested(Path("/key").Equal("error"), Path("/value").Equal("true")),
+		Or(Path("/operationName").Equal("a"), All(Path("/operationName").Prefix("b"), Path("/duration").Ge(Int(1)))),
+	))
+
+	nested := tuple(stmt.Where[1]).Predicate.(*ssql.Tuple_Nested).Nested.Expr
+	if len(nested) != 2 || tuple(nested[0]).Path != "/key" || tuple(nested[1]).Path != "/value" {
+		t.Errorf("nested = %v", nested)
+	}
+
+	or := stmt.Where[2].Field.(*ssql.Expr_Or).Or.Expr
+	if len(or) != 3 {
+		t.Errorf("OR = %v, want 3 expressions", or)
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		q    *Query
+	}{
+		{"no where", Find("s")},
+		{"no find", Find().Where(Path("/"))},
+		{"variable", Find("s)").Where(Var("s)", "/"))},
+		{"path", Find("s").Where(Var("s", "/a')]"))},
+		{"empty text", Find("s").Where(Var("s", "/a").Equal(""))},
+		{"empty in", Find("s").Where(Var("s", "/a").In())},
+		{"empty or", Find("s").Where(Or())},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if qry, err := tt.q.Build(); err == nil {
+				t.Errorf("Build() = %s, want error", qry)
+			}
+		})
+	}
+}
@@ -0,0 +1,349 @@
+package builder
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Number is a numeric operand, SSQL has no negative literals.
+type Number struct {
+	text string
+	err  error
+}
+
+// Int is an integer operand.
+func Int(v int64) Number {
+	if v < 0 {
+		return Number{err: fmt.Errorf("ssql: negative number %d", v)}
+	}
+	return Number{text: strconv.FormatInt(v, 10)}
+}
+
+// Float is a real number operand.
+func Float(v float64) Number {
+	if v < 0 || math.IsNaN(v) || math.IsInf(v, 0) {
+		return Number{err: fmt.Errorf("ssql: invalid number %v", v)}
+	}
+	text := strconv.FormatFloat(v, 'f', -1, 64)
+	if !strings.Contains(text, ".") {
+		text += ".0"
+	}
+	return Number{text: text}
+}
+
+// Vector matches a JSON path, optionally binding it to a variable and filtering it
+// with a predicate or nested vectors.
+type Vector struct {
+	name   string
+	path   string
+	pred   func(sb *strings.Builder) error
+	nested []Clause
+}
+
+// Path matches JSON path.
+func Path(path string) *Vector {
+	return &Vector{path: path}
+}
+
+// Var binds JSON path to variable name, given without leading '$'.
+func Var(name, path string) *Vector {
+	return &Vector{name: name, path: path}
+}
+
+func (v *Vector) predicate(op string, operand func(sb *strings.Builder) error) *Vector {
+	v.pred = func(sb *strings.Builder) error {
+		sb.WriteString(op)
+		sb.WriteByte('(')
+		if err := operand(sb); err != nil {
+			return err
+		}
+		sb.WriteByte(')')
+		return nil
+	}
+	return v
+}
+
+func (v *Vector) unary(op string, n Number) *Vector {
+	return v.predicate(op, func(sb *strings.Builder) error {
+		if n.err != nil {
+			return n.err
+		}
+		sb.WriteString(n.text)
+		return nil
+	})
+}
+
+// Eq matches numbers equal to n.
+func (v *Vector) Eq(n Number) *Vector { return v.unary("EQ", n) }
+
+// Neq matches numbers not equal to n.
+func (v *Vector) Neq(n Number) *Vector { return v.unary("NEQ", n) }
+
+// Gt matches numbers greater than n.
+func (v *Vector) Gt(n Number) *Vector { return v.unary("GT", n) }
+
+// Ge matches numbers greater than or equal to n.
+func (v *Vector) Ge(n Number) *Vector { return v.unary("GE", n) }
+
+// Lt matches numbers less than n.
+func (v *Vector) Lt(n Number) *Vector { return v.unary("LT", n) }
+
+// Le matches numbers less than or equal to n.
+func (v *Vector) Le(n Number) *Vector { return v.unary("LE", n) }
+
+// Between matches integers in [min, max].
+func (v *Vector) Between(min, max int64) *Vector {
+	return v.predicate("BETWEEN", func(sb *strings.Builder) error {
+		a, b := Int(min), Int(max)
+		if a.err != nil {
+			return a.err
+		}
+		if b.err != nil {
+			return b.err
+		}
+		sb.WriteString(a.text)
+		sb.WriteByte(',')
+		sb.WriteString(b.text)
+		return nil
+	})
+}
+
+// Timeframe matches timestamps in [from, to], it also selects index files by time.
+func (v *Vector) Timeframe(from, to int64) *Vector {
+	return v.predicate("TIMEFRAME", func(sb *strings.Builder) error {
+		a, b := Int(from), Int(to)
+		if a.err != nil {
+			return a.err
+		}
+		if b.err != nil {
+			return b.err
+		}
+		sb.WriteString(a.text)
+		sb.WriteByte(',')
+		sb.WriteString(b.text)
+		return nil
+	})
+}
+
+// Key looks up secondary key index.
+func (v *Vector) Key(key string) *Vector {
+	return v.predicate("KEY", func(sb *strings.Builder) error {
+		return writeQuoted(sb, key)
+	})
+}
+
+// In matches any of values.
+func (v *Vector) In(values ...string) *Vector {
+	return v.predicate("IN", func(sb *strings.Builder) error {
+		if len(values) == 0 {
+			return errors.New("ssql: IN without values")
+		}
+		for i, val := range values {
+			if i > 0 {
+				sb.WriteByte(',')
+			}
+			if err := writeQuoted(sb, val); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Match matches text against pattern as is, '^' and '$' anchor the pattern and '*'
+// is a single character wild card.
+func (v *Vector) Match(pattern string) *Vector {
+	return v.contain([]byte(pattern))
+}
+
+// Equal matches text equal to value.
+func (v *Vector) Equal(value string) *Vector {
+	return v.literal(true, value, true)
+}
+
+// Prefix matches text starting with value.
+func (v *Vector) Prefix(value string) *Vector {
+	return v.literal(true, value, false)
+}
+
+// Contain matches text containing value.
+func (v *Vector) Contain(value string) *Vector {
+	return v.literal(false, value, false)
+}
+
+// literal matches value as text. ChronoWave has no working escape in patterns, so a
+// character that can't be matched as is becomes the '*' wild card, and an anchor next
+// to a wild card is dropped. The match may be wider than value, but never narrower.
+func (v *Vector) literal(prefix bool, value string, suffix bool) *Vector {
+	if len(value) == 0 {
+		v.pred = func(*strings.Builder) error {
+			return errors.New("ssql: empty text to match")
+		}
+		return v
+	}
+
+	body := []byte(value)
+	for i, b := range body {
+		if b == '\\' {
+			body[i] = '*'
+		}
+	}
+	if body[0] == '^' || body[0] == '*' {
+		body[0], prefix = '*', false
+	}
+	if last := len(body) - 1; body[last] == '$' || body[last] == '*' {
+		body[last], suffix = '*', false
+	}
+
+	pattern := make([]byte, 0, len(body)+2)
+	if prefix {
+		pattern = append(pattern, '^')
+	}
+	pattern = append(pattern, body...)
+	if suffix {
+		pattern = append(pattern, '$')
+	}
+
+	return v.contain(pattern)
+}
+
+// contain wraps pattern in a quote it doesn't contain. If it has all of them, single
+// quotes become wild cards.
+func (v *Vector) contain(pattern []byte) *Vector {
+	return v.predicate("CONTAIN", func(sb *strings.Builder) error {
+		if len(pattern) == 0 {
+			return errors.New("ssql: empty pattern")
+		}
+
+		q := quoteFor(string(pattern))
+		if q == 0 {
+			q = '\''
+			for i, b := range pattern {
+				if b == q {
+					pattern[i] = '*'
+				}
+			}
+		}
+		sb.WriteByte(q)
+		sb.Write(pattern)
+		sb.WriteByte(q)
+		return nil
+	})
+}
+
+// Exist matches documents having path.
+func (v *Vector) Exist() *Vector {
+	v.pred = func(sb *strings.Builder) error {
+		sb.WriteString("EXIST()")
+		return nil
+	}
+	return v
+}
+
+// Nested matches when every clause matches within the same element of path.
+func (v *Vector) Nested(clauses ...Clause) *Vector {
+	v.pred = nil
+	v.nested = append(v.nested, clauses...)
+	return v
+}
+
+func (v *Vector) write(sb *strings.Builder) error {
+	sb.WriteByte('[')
+	if len(v.name) > 0 {
+		if err := validName(v.name); err != nil {
+			return err
+		}
+		sb.WriteByte('$')
+		sb.WriteString(v.name)
+		sb.WriteByte(' ')
+	}
+
+	if !path.MatchString(v.path) {
+		return fmt.Errorf("ssql: invalid path %q", v.path)
+	}
+	sb.WriteString(v.path)
+
+	if v.pred != nil {
+		sb.WriteByte(' ')
+		if err := v.pred(sb); err != nil {
+			return err
+		}
+	}
+
+	for _, c := range v.nested {
+		sb.WriteByte(' ')
+		if err := c.write(sb); err != nil {
+			return err
+		}
+	}
+	sb.WriteByte(']')
+
+	return nil
+}
+
+type group struct {
+	open    string
+	clauses []Clause
+}
+
+// Or matches when any of clauses matches.
+func Or(clauses ...Clause) Clause {
+	return &group{open: "{", clauses: clauses}
+}
+
+// All matches when all of clauses match, it groups clauses inside Or.
+func All(clauses ...Clause) Clause {
+	return &group{open: "{&", clauses: clauses}
+}
+
+func (g *group) write(sb *strings.Builder) error {
+	if len(g.clauses) == 0 {
+		return errors.New("ssql: empty clause group")
+	}
+
+	sb.WriteString(g.open)
+	for _, c := range g.clauses {
+		if err := c.write(sb); err != nil {
+			return err
+		}
+	}
+	sb.WriteByte('}')
+
+	return nil
+}
+
+// writeQuoted writes value as a string literal. SSQL keeps the text between quotes
+// as is, so the value is wrapped in a quote it doesn't contain.
+func writeQuoted(sb *strings.Builder, value string) error {
+	// a trailing odd backslash would escape the closing quote
+	n := 0
+	for i := len(value) - 1; i >= 0 && value[i] == '\\'; i-- {
+		n++
+	}
+	if n%2 == 1 {
+		return fmt.Errorf("ssql: can't quote %q ending with backslash", value)
+	}
+
+	q := quoteFor(value)
+	if q == 0 {
+		return fmt.Errorf("ssql: can't quote %q containing all quote characters", value)
+	}
+	sb.WriteByte(q)
+	sb.WriteString(value)
+	sb.WriteByte(q)
+
+	return nil
+}
+
+// quoteFor returns a quote character not in value, or 0 if it has all of them.
+func quoteFor(value string) byte {
+	for _, q := range []byte{'\'', '"', '`'} {
+		if strings.IndexByte(value, q) < 0 {
+			return q
+		}
+	}
+	return 0
+}
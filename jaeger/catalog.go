@@ -0,0 +1,392 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	catalogFile = "catalog"
+
+	// last seen is only written back once it moved by more than resolution,
+	// so busy operations don't turn every batch into a sqlite write.
+	catalogResolution = int64(time.Minute / time.Microsecond)
+
+	catalogUpsert = `INSERT INTO catalog (service, operation, kind, first_seen, last_seen, written) VALUES (?, ?, ?, ?, ?, ?)
+                     ON CONFLICT (service, operation, kind) DO UPDATE SET
+                       first_seen = MIN(first_seen, excluded.first_seen),
+                       last_seen = MAX(last_seen, excluded.last_seen),
+                       written = MAX(written, excluded.written)`
+)
+
+type catalogEntry struct {
+	firstSeen    int64 // microseconds since Unix epoch
+	lastSeen     int64
+	written      int64 // when its latest span was written, the wave purges by it
+	saved        int64
+	savedWritten int64
+}
+
+// catalogRecord is a catalog entry as it's backed up.
+type catalogRecord struct {
+	Service   string `json:"service"`
+	Operation string `json:"operation"`
+	SpanKind  string `json:"spanKind"`
+	FirstSeen int64  `json:"firstSeen"`
+	LastSeen  int64  `json:"lastSeen"`
+	Written   int64  `json:"written,omitempty"` // last seen in archives of older releases
+}
+
+// catalog keeps services and their operations by span kind with first and last
+// seen span start time, persisted in sqlite next to the wave data. Entries expire by
+// when their spans were written, as the wave purges segments by when they were.
+type catalog struct {
+	db      *sql.DB
+	lock    sync.RWMutex
+	entries map[string]map[spanstore.Operation]*catalogEntry
+}
+
+func openCatalog(dir string) (*catalog, error) {
+	db, err := sql.Open("sqlite3", filepath.Join(dir, catalogFile))
+	if err != nil {
+		return nil, err
+	}
+
+	if err = migrateCatalog(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	c := &catalog{
+		db:      db,
+		entries: map[string]map[spanstore.Operation]*catalogEntry{},
+	}
+
+	return c, c.load()
+}
+
+// migrateCatalog creates the catalog table, a table from before span kind was
+// recorded is copied over with empty span kind. Entries from before write time was
+// recorded take last seen, spans are mostly written right after they start.
+func migrateCatalog(db *sql.DB) error {
+	var kinds, written int
+	err := db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('catalog') WHERE name = 'kind'`).Scan(&kinds)
+	if err != nil {
+		return err
+	}
+	err = db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('catalog') WHERE name = 'written'`).Scan(&written)
+	if err != nil {
+		return err
+	}
+
+	var cols int
+	if err = db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('catalog')`).Scan(&cols); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	migrate := cols > 0 && kinds == 0
+	if migrate {
+		if _, err = tx.Exec(`ALTER TABLE catalog RENAME TO catalog_v1`); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	_, err = tx.Exec(`CREATE TABLE IF NOT EXISTS catalog
+         (
+           service TEXT,
+           operation TEXT,
+           kind TEXT,
+           first_seen INTEGER NOT NULL,
+           last_seen INTEGER NOT NULL,
+           written INTEGER NOT NULL,
+           PRIMARY KEY (service, operation, kind)
+         ) WITHOUT ROWID`)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	var qry []string
+	if migrate {
+		qry = []string{
+			`INSERT INTO catalog (service, operation, kind, first_seen, last_seen, written)
+             SELECT service, operation, '', first_seen, last_seen, last_seen FROM catalog_v1`,
+			`DROP TABLE catalog_v1`,
+		}
+	} else if cols > 0 && written == 0 {
+		qry = []string{
+			`ALTER TABLE catalog ADD COLUMN written INTEGER NOT NULL DEFAULT 0`,
+			`UPDATE catalog SET written = last_seen`,
+		}
+	}
+	for _, q := range qry {
+		if _, err = tx.Exec(q); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (c *catalog) Close() error {
+	return c.db.Close()
+}
+
+func (c *catalog) load() error {
+	rows, err := c.db.Query(`SELECT service, operation, kind, first_seen, last_seen, written FROM catalog`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for rows.Next() {
+		var (
+			svc, op, kind        string
+			first, last, written int64
+		)
+		if err = rows.Scan(&svc, &op, &kind, &first, &last, &written); err != nil {
+			return err
+		}
+		c.entry(svc, spanstore.Operation{Name: op, SpanKind: kind},
+			&catalogEntry{firstSeen: first, lastSeen: last, written: written, saved: last, savedWritten: written})
+	}
+
+	return rows.Err()
+}
+
+// entry returns the entry of service and operation, it adds e if there is none.
+// Caller must hold the write lock.
+func (c *catalog) entry(svc string, op spanstore.Operation, e *catalogEntry) *catalogEntry {
+	ops, ok := c.entries[svc]
+	if !ok {
+		ops = map[spanstore.Operation]*catalogEntry{}
+		c.entries[svc] = ops
+	}
+
+	if cur, ok := ops[op]; ok {
+		return cur
+	}
+	ops[op] = e
+
+	return e
+}
+
+func (c *catalog) isEmpty() bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return len(c.entries) == 0
+}
+
+// observe records spans written at written in the catalog, zero if that's unknown,
+// and persists entries which are new or whose last seen or written moved past
+// catalogResolution.
+func (c *catalog) observe(batch []pendingSpan, written int64) error {
+	type dirty struct {
+		svc                  string
+		op                   spanstore.Operation
+		first, last, written int64
+	}
+
+	var changed []dirty
+
+	c.lock.Lock()
+	for _, s := range batch {
+		// spans found in the wave were written long ago, start time is the closest guess
+		w := written
+		if w == 0 {
+			w = s.startTime
+		}
+
+		op := spanstore.Operation{Name: s.op, SpanKind: s.kind}
+		e := c.entry(s.service, op, &catalogEntry{firstSeen: s.startTime, lastSeen: s.startTime, written: w, saved: -1})
+		if s.startTime < e.firstSeen {
+			e.firstSeen = s.startTime
+			e.saved = -1
+		}
+		if s.startTime > e.lastSeen {
+			e.lastSeen = s.startTime
+		}
+		if w > e.written {
+			e.written = w
+		}
+		if e.saved < 0 || e.lastSeen-e.saved >= catalogResolution || e.written-e.savedWritten >= catalogResolution {
+			e.saved, e.savedWritten = e.lastSeen, e.written
+			changed = append(changed, dirty{svc: s.service, op: op, first: e.firstSeen, last: e.lastSeen, written: e.written})
+		}
+	}
+	c.lock.Unlock()
+
+	if len(changed) == 0 {
+		return nil
+	}
+
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	for _, d := range changed {
+		if _, err = tx.Exec(catalogUpsert, d.svc, d.op.Name, d.op.SpanKind, d.first, d.last, d.written); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// expire removes services and operations without spans written since before.
+func (c *catalog) expire(before time.Time) error {
+	ts := micros(before)
+	return c.expireBy(func(string, string) int64 { return ts })
+}
+
+// expireBy removes entries of operations written before the time before returns for
+// them, in microseconds.
+func (c *catalog) expireBy(before func(service, operation string) int64) error {
+	var expired []catalogRecord
+
+	c.lock.Lock()
+	for svc, ops := range c.entries {
+		for op, e := range ops {
+			if ts := before(svc, op.Name); e.written < ts {
+				delete(ops, op)
+				expired = append(expired, catalogRecord{Service: svc, Operation: op.Name, SpanKind: op.SpanKind, Written: ts})
+			}
+		}
+		if len(ops) == 0 {
+			delete(c.entries, svc)
+		}
+	}
+	c.lock.Unlock()
+
+	if len(expired) == 0 {
+		return nil
+	}
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, r := range expired {
+		_, err = tx.Exec(`DELETE FROM catalog WHERE service = ? AND operation = ? AND kind = ? AND written < ?`,
+			r.Service, r.Operation, r.SpanKind, r.Written)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// within returns entries seen within [from, to].
+func (c *catalog) within(from, to int64) []catalogRecord {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	records := []catalogRecord{}
+	for svc, ops := range c.entries {
+		for op, e := range ops {
+			if e.firstSeen <= to && e.lastSeen >= from {
+				records = append(records, catalogRecord{
+					Service:   svc,
+					Operation: op.Name,
+					SpanKind:  op.SpanKind,
+					FirstSeen: e.firstSeen,
+					LastSeen:  e.lastSeen,
+					Written:   e.written,
+				})
+			}
+		}
+	}
+
+	return records
+}
+
+// merge adds entries restored from a backup, widening first and last seen and
+// written of entries it has. Restored segments keep when they were written.
+func (c *catalog) merge(records []catalogRecord) error {
+	tx, err := c.db.Begin()
+	if err != nil {
+		return err
+	}
+	for i := range records {
+		r := &records[i]
+		if r.Written == 0 {
+			r.Written = r.LastSeen
+		}
+		if _, err = tx.Exec(catalogUpsert, r.Service, r.Operation, r.SpanKind, r.FirstSeen, r.LastSeen, r.Written); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, r := range records {
+		op := spanstore.Operation{Name: r.Operation, SpanKind: r.SpanKind}
+		e := c.entry(r.Service, op, &catalogEntry{firstSeen: r.FirstSeen, lastSeen: r.LastSeen, written: r.Written, saved: r.LastSeen, savedWritten: r.Written})
+		if r.FirstSeen < e.firstSeen {
+			e.firstSeen = r.FirstSeen
+		}
+		if r.LastSeen > e.lastSeen {
+			e.lastSeen, e.saved = r.LastSeen, r.LastSeen
+		}
+		if r.Written > e.written {
+			e.written, e.savedWritten = r.Written, r.Written
+		}
+	}
+
+	return nil
+}
+
+func (c *catalog) services() []string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	svc := make([]string, 0, len(c.entries))
+	for k := range c.entries {
+		svc = append(svc, k)
+	}
+	sort.Strings(svc)
+
+	return svc
+}
+
+// operations returns operations of service, empty kind returns operations of all span kinds.
+func (c *catalog) operations(service, kind string) []spanstore.Operation {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	ops := make([]spanstore.Operation, 0, len(c.entries[service]))
+	for k := range c.entries[service] {
+		if len(kind) == 0 || k.SpanKind == kind {
+			ops = append(ops, k)
+		}
+	}
+	sort.Slice(ops, func(i, j int) bool {
+		if ops[i].Name == ops[j].Name {
+			return ops[i].SpanKind < ops[j].SpanKind
+		}
+		return ops[i].Name < ops[j].Name
+	})
+
+	return ops
+}
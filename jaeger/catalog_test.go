@@ -0,0 +1,141 @@
+package main
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestMigrateCatalog(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup []string
+		want  []catalogRecord
+	}{
+		{"new", nil, []catalogRecord{}},
+		{
+			"v1",
+			[]string{
+				`CREATE TABLE catalog (service TEXT, operation TEXT, first_seen INTEGER NOT NULL, last_seen INTEGER NOT NULL,
+                 PRIMARY KEY (service, operation)) WITHOUT ROWID`,
+				`INSERT INTO catalog VALUES ('frontend', 'GET /dispatch', 10, 20), ('frontend', 'HTTP GET', 11, 19), ('redis', 'GetDriver', 12, 18)`,
+			},
+			[]catalogRecord{
+				{Service: "frontend", Operation: "GET /dispatch", FirstSeen: 10, LastSeen: 20, Written: 20},
+				{Service: "frontend", Operation: "HTTP GET", FirstSeen: 11, LastSeen: 19, Written: 19},
+				{Service: "redis", Operation: "GetDriver", FirstSeen: 12, LastSeen: 18, Written: 18},
+			},
+		},
+		{
+			"v2 without write time",
+			[]string{
+				`CREATE TABLE catalog (service TEXT, operation TEXT, kind TEXT, first_seen INTEGER NOT NULL, last_seen INTEGER NOT NULL,
+                 PRIMARY KEY (service, operation, kind)) WITHOUT ROWID`,
+				`INSERT INTO catalog VALUES ('frontend', 'GET /dispatch', 'server', 10, 20), ('frontend', 'GET /dispatch', '', 11, 19)`,
+			},
+			[]catalogRecord{
+				{Service: "frontend", Operation: "GET /dispatch", FirstSeen: 11, LastSeen: 19, Written: 19},
+				{Service: "frontend", Operation: "GET /dispatch", SpanKind: "server", FirstSeen: 10, LastSeen: 20, Written: 20},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "catalog")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			db, err := sql.Open("sqlite3", filepath.Join(dir, catalogFile))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, q := range tt.setup {
+				if _, err = db.Exec(q); err != nil {
+					t.Fatalf("%s: %v", q, err)
+				}
+			}
+			db.Close()
+
+			// a migrated catalog opens again as it is
+			for i := 0; i < 2; i++ {
+				c, err := openCatalog(dir)
+				if err != nil {
+					t.Fatalf("openCatalog() error = %v", err)
+				}
+				got := c.within(math.MinInt64, math.MaxInt64)
+				c.Close()
+
+				sort.Slice(got, func(i, j int) bool {
+					if got[i].Service != got[j].Service {
+						return got[i].Service < got[j].Service
+					}
+					if got[i].Operation != got[j].Operation {
+						return got[i].Operation < got[j].Operation
+					}
+					return got[i].SpanKind < got[j].SpanKind
+				})
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("open %d: within() = %v, want %v", i+1, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestCatalogExpire(t *testing.T) {
+	dir, err := ioutil.TempDir("", "catalog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := openCatalog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { c.Close() }()
+
+	now := time.Now()
+	day := micros64(24 * time.Hour)
+	// imported spans started long ago but were just written, late spans the other way round
+	batches := []struct {
+		spans   []pendingSpan
+		written int64
+	}{
+		{[]pendingSpan{{service: "imported", op: "GET", startTime: micros(now) - 30*day}}, micros(now)},
+		{[]pendingSpan{{service: "frontend", op: "GET", startTime: micros(now)}}, micros(now) - 3*day},
+		{[]pendingSpan{{service: "backfill", op: "GET", startTime: micros(now) - 3*day}}, 0},
+		{[]pendingSpan{{service: "redis", op: "SET", startTime: micros(now) - 3*day}}, micros(now) - day},
+	}
+	for _, b := range batches {
+		if err = c.observe(b.spans, b.written); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = c.expire(now.Add(-2 * 24 * time.Hour)); err != nil {
+		t.Fatalf("expire() error = %v", err)
+	}
+	want := []string{"imported", "redis"}
+	if got := c.services(); !reflect.DeepEqual(got, want) {
+		t.Errorf("services() = %v, want %v", got, want)
+	}
+
+	// as persisted
+	c.Close()
+	if c, err = openCatalog(dir); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.services(); !reflect.DeepEqual(got, want) {
+		t.Errorf("services() reopened = %v, want %v", got, want)
+	}
+}
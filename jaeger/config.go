@@ -2,6 +2,7 @@ package main
 
 import (
 	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
@@ -12,18 +13,87 @@ const (
 	dataDir  = "chronowave.dir"
 	dataTTL  = "chronowave.ttl"
 	httpPort = "chronowave.http"
+
+	archiveDir = "chronowave.archive.dir"
+	archiveTTL = "chronowave.archive.ttl"
+
+	writeBatch    = "chronowave.write.batch"
+	writeFlush    = "chronowave.write.flush"
+	writeInflight = "chronowave.write.inflight"
+
+	tagsScope   = "chronowave.tags.scope"
+	searchMatch = "chronowave.search.mode"
+
+	dependenciesBucket = "chronowave.dependencies.bucket"
+
+	metricsBucketSize = "chronowave.metrics.bucket"
+
+	retentionRules = "chronowave.retention"
+
+	diskQuotaBytes = "chronowave.disk.quota"
+
+	tailTTL      = "chronowave.tail.ttl"
+	tailSettle   = "chronowave.tail.settle"
+	tailErrors   = "chronowave.tail.errors"
+	tailDuration = "chronowave.tail.duration"
+	tailTags     = "chronowave.tail.tags"
+	tailSample   = "chronowave.tail.sample"
+
+	dedupWindow = "chronowave.dedup.window"
+
+	otlpHTTPPort = "chronowave.otlp.http"
+	otlpGRPCPort = "chronowave.otlp.grpc"
 )
 
 type conf struct {
 	dir  string
 	port int
 	ttl  time.Duration
+
+	archiveDir string
+	archiveTTL time.Duration
+
+	batchSize     int
+	flushInterval time.Duration
+	maxInflight   int64
+
+	tagScope   tagScope
+	searchMode searchMode
+
+	depBucket time.Duration
+
+	metricsBucket time.Duration
+
+	// spans matching no rule are kept for ttl
+	retention []retentionRule
+
+	diskQuota int64
+
+	tailTTL    time.Duration
+	tailSettle time.Duration
+	tailRules  tailRules
+
+	dedupWindow time.Duration
+
+	// OTLP receivers listen only if a port is given
+	otlpHTTP int
+	otlpGRPC int
 }
 
 func readConfig(file string) *conf {
 	v := viper.New()
 	v.AutomaticEnv()
 	v.SetEnvKeyReplacer(strings.NewReplacer("-", "_", ".", "_"))
+	v.SetDefault(writeBatch, 256)
+	v.SetDefault(writeFlush, "1s")
+	v.SetDefault(writeInflight, 64*1024*1024)
+	v.SetDefault(tagsScope, "span,process,log")
+	v.SetDefault(searchMatch, string(spanSearch))
+	v.SetDefault(dependenciesBucket, "1h")
+	v.SetDefault(metricsBucketSize, "1m")
+	v.SetDefault(tailSettle, "5m")
+	v.SetDefault(tailErrors, true)
+	v.SetDefault(dedupWindow, "1m")
 
 	if file != "" {
 		v.SetConfigFile(file)
@@ -41,9 +111,141 @@ func readConfig(file string) *conf {
 		ttl = time.Hour * 3 * 24
 	}
 
+	// archived traces are kept forever unless an archive TTL is given
+	var attl time.Duration
+	if len(v.GetString(archiveTTL)) > 0 {
+		attl, err = time.ParseDuration(v.GetString(archiveTTL))
+		if err != nil {
+			logger.Error("failed to parse archive TTL duration, archived traces are kept forever", "ttl", v.GetString(archiveTTL), "error", err)
+			attl = 0
+		}
+	}
+
+	adir := v.GetString(archiveDir)
+	if len(adir) == 0 {
+		adir = filepath.Join(v.GetString(dataDir), "archive")
+	}
+
+	flush, err := time.ParseDuration(v.GetString(writeFlush))
+	if err != nil || flush <= 0 {
+		logger.Error("failed to parse write flush interval, default to 1s", "flush", v.GetString(writeFlush), "error", err)
+		flush = time.Second
+	}
+
+	batch := v.GetInt(writeBatch)
+	if batch <= 0 {
+		batch = 256
+	}
+
+	inflight := v.GetInt64(writeInflight)
+	if inflight <= 0 {
+		inflight = 64 * 1024 * 1024
+	}
+
+	scope, err := parseTagScope(v.GetString(tagsScope))
+	if err != nil {
+		logger.Error("failed to parse tag search scope, default to span,process,log", "scope", v.GetString(tagsScope), "error", err)
+		scope = allTags
+	}
+
+	mode, err := parseSearchMode(v.GetString(searchMatch))
+	if err != nil {
+		logger.Error("failed to parse search mode, default to span", "mode", v.GetString(searchMatch), "error", err)
+		mode = spanSearch
+	}
+
+	bucket, err := time.ParseDuration(v.GetString(dependenciesBucket))
+	if err != nil || bucket < time.Minute {
+		logger.Error("failed to parse dependencies bucket, default to 1h", "bucket", v.GetString(dependenciesBucket), "error", err)
+		bucket = time.Hour
+	}
+
+	mbucket, err := time.ParseDuration(v.GetString(metricsBucketSize))
+	if err != nil || mbucket < 10*time.Second {
+		logger.Error("failed to parse metrics bucket, default to 1m", "bucket", v.GetString(metricsBucketSize), "error", err)
+		mbucket = time.Minute
+	}
+
+	var (
+		rcs   []retentionRuleConfig
+		rules []retentionRule
+	)
+	if err = v.UnmarshalKey(retentionRules, &rcs); err != nil {
+		logger.Error("failed to parse retention rules, keep all spans for chronowave.ttl", "error", err)
+	}
+	for i, rc := range rcs {
+		rule, err := parseRetentionRule(rc)
+		if err != nil {
+			logger.Error("failed to parse retention rule, skip it", "rule", i, "error", err)
+			continue
+		}
+		rules = append(rules, rule)
+	}
+
+	quota := v.GetInt64(diskQuotaBytes)
+	if quota < 0 {
+		quota = 0
+	}
+
+	// traces are kept by tail retention only if a tail TTL is given
+	var kttl time.Duration
+	if len(v.GetString(tailTTL)) > 0 {
+		kttl, err = time.ParseDuration(v.GetString(tailTTL))
+		if err != nil || kttl < 0 {
+			logger.Error("failed to parse tail TTL duration, tail retention is off", "ttl", v.GetString(tailTTL), "error", err)
+			kttl = 0
+		}
+	}
+
+	settle, err := time.ParseDuration(v.GetString(tailSettle))
+	if err != nil || settle <= 0 {
+		logger.Error("failed to parse tail settle delay, default to 5m", "settle", v.GetString(tailSettle), "error", err)
+		settle = 5 * time.Minute
+	}
+
+	trules := tailRules{errors: v.GetBool(tailErrors), sample: v.GetFloat64(tailSample)}
+	if len(v.GetString(tailDuration)) > 0 {
+		trules.duration, err = time.ParseDuration(v.GetString(tailDuration))
+		if err != nil {
+			logger.Error("failed to parse tail duration, no trace is kept by duration", "duration", v.GetString(tailDuration), "error", err)
+			trules.duration = 0
+		}
+	}
+	for _, text := range v.GetStringSlice(tailTags) {
+		tag, err := parseTailTag(text)
+		if err != nil {
+			logger.Error("failed to parse tail tag, skip it", "tag", text, "error", err)
+			continue
+		}
+		trules.tags = append(trules.tags, tag)
+	}
+
+	window, err := time.ParseDuration(v.GetString(dedupWindow))
+	if err != nil || window < 0 {
+		logger.Error("failed to parse de-duplication window, default to 1m", "window", v.GetString(dedupWindow), "error", err)
+		window = time.Minute
+	}
+
 	return &conf{
-		dir:  v.GetString(dataDir),
-		port: v.GetInt(httpPort),
-		ttl:  ttl,
+		dir:           v.GetString(dataDir),
+		port:          v.GetInt(httpPort),
+		ttl:           ttl,
+		archiveDir:    adir,
+		archiveTTL:    attl,
+		batchSize:     batch,
+		flushInterval: flush,
+		maxInflight:   inflight,
+		tagScope:      scope,
+		searchMode:    mode,
+		depBucket:     bucket,
+		metricsBucket: mbucket,
+		retention:     rules,
+		diskQuota:     quota,
+		tailTTL:       kttl,
+		tailSettle:    settle,
+		tailRules:     trules,
+		dedupWindow:   window,
+		otlpHTTP:      v.GetInt(otlpHTTPPort),
+		otlpGRPC:      v.GetInt(otlpGRPCPort),
 	}
 }
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+)
+
+// spanKey identifies a span, a span reported again has the same key.
+type spanKey struct {
+	traceID model.TraceID
+	spanID  model.SpanID
+	start   uint64 // microseconds since Unix epoch, as stored
+	// only there for Zipkin shared spans: the server span of an RPC reported with
+	// shared=true has the span ID of its client span, and may start at the same
+	// time, so trace ID, span ID and start alone would drop it as a duplicate
+	kind string
+}
+
+func keyOf(span *model.Span) spanKey {
+	kind, _ := span.GetSpanKind()
+	return spanKey{traceID: span.TraceID, spanID: span.SpanID, start: model.TimeAsEpochMicroseconds(span.StartTime), kind: kind}
+}
+
+// spanDeduper drops spans written again within window, and collapses duplicates
+// written earlier when read. Keys are kept in two generations of a window each, so a
+// duplicate is dropped if it comes within one to two windows.
+type spanDeduper struct {
+	window    time.Duration
+	lock      sync.Mutex
+	cur       map[spanKey]void
+	prev      map[spanKey]void
+	rotated   time.Time
+	dropped   uint64
+	collapsed uint64
+}
+
+// newSpanDeduper drops duplicates written within window, zero only collapses them when read.
+func newSpanDeduper(window time.Duration) *spanDeduper {
+	return &spanDeduper{
+		window:  window,
+		cur:     map[spanKey]void{},
+		prev:    map[spanKey]void{},
+		rotated: time.Now(),
+	}
+}
+
+// add returns false if span was added within the window, and counts it dropped.
+func (d *spanDeduper) add(span *model.Span) bool {
+	if d.window <= 0 {
+		return true
+	}
+	k := keyOf(span)
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if now := time.Now(); now.Sub(d.rotated) >= d.window {
+		d.prev, d.cur = d.cur, make(map[spanKey]void, len(d.cur))
+		d.rotated = now
+	}
+
+	_, inCur := d.cur[k]
+	_, inPrev := d.prev[k]
+	if inCur || inPrev {
+		atomic.AddUint64(&d.dropped, 1)
+		return false
+	}
+	d.cur[k] = void{}
+	return true
+}
+
+// forget removes span added but not written, so it's not dropped when retried.
+func (d *spanDeduper) forget(span *model.Span) {
+	if d.window <= 0 {
+		return
+	}
+	k := keyOf(span)
+
+	d.lock.Lock()
+	delete(d.cur, k)
+	delete(d.prev, k)
+	d.lock.Unlock()
+}
+
+// collapse returns spans of a trace without duplicates, keeping the first of each.
+func (d *spanDeduper) collapse(spans []*model.Span) []*model.Span {
+	seen := make(map[spanKey]void, len(spans))
+	unique := spans[:0]
+	for _, s := range spans {
+		k := keyOf(s)
+		if _, ok := seen[k]; ok {
+			continue
+		}
+		seen[k] = void{}
+		unique = append(unique, s)
+	}
+
+	if n := len(spans) - len(unique); n > 0 {
+		atomic.AddUint64(&d.collapsed, uint64(n))
+		// unused tail of spans still points to duplicates
+		for i := len(unique); i < len(spans); i++ {
+			spans[i] = nil
+		}
+	}
+	return unique
+}
+
+// writeProm writes duplicate counts in Prometheus text exposition format.
+func (d *spanDeduper) writeProm(w io.Writer) error {
+	_, err := fmt.Fprintf(w, `# HELP chronowave_duplicate_spans_dropped_total Spans not written as they were written within chronowave.dedup.window.
+# TYPE chronowave_duplicate_spans_dropped_total counter
+chronowave_duplicate_spans_dropped_total %d
+# HELP chronowave_duplicate_spans_collapsed_total Duplicate spans left out of traces read.
+# TYPE chronowave_duplicate_spans_collapsed_total counter
+chronowave_duplicate_spans_collapsed_total %d
+`, atomic.LoadUint64(&d.dropped), atomic.LoadUint64(&d.collapsed))
+	return err
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+)
+
+func TestKeyOf(t *testing.T) {
+	start := time.Unix(1600000000, 0)
+	span := func(id uint64, start time.Time, tags ...model.KeyValue) *model.Span {
+		s := testSpan(1, id, "frontend", start)
+		s.Tags = tags
+		return s
+	}
+
+	tests := []struct {
+		name string
+		a, b *model.Span
+		same bool
+	}{
+		{"reported again", span(1, start), span(1, start), true},
+		{"other tags", span(1, start, model.String("retry", "1")), span(1, start, model.String("retry", "2")), true},
+		{"other nanoseconds", span(1, start), span(1, start.Add(100*time.Nanosecond)), true},
+		{"other span", span(1, start), span(2, start), false},
+		{"other start", span(1, start), span(1, start.Add(time.Microsecond)), false},
+		{"other trace", span(1, start), testSpan(2, 1, "frontend", start), false},
+		{"zipkin shared span", span(1, start, model.String("span.kind", "client")), span(1, start, model.String("span.kind", "server")), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if same := keyOf(tt.a) == keyOf(tt.b); same != tt.same {
+				t.Errorf("keyOf() equal = %v, want %v", same, tt.same)
+			}
+		})
+	}
+}
+
+func TestSpanDeduperAdd(t *testing.T) {
+	start := time.Unix(1600000000, 0)
+	a, b := testSpan(1, 1, "frontend", start), testSpan(1, 2, "frontend", start)
+
+	off := newSpanDeduper(0)
+	if !off.add(a) || !off.add(a) {
+		t.Error("add() without window = false, want true")
+	}
+
+	d := newSpanDeduper(time.Minute)
+	steps := []struct {
+		name   string
+		span   *model.Span
+		rotate bool // the window passed before add
+		want   bool
+	}{
+		{"first", a, false, true},
+		{"again", a, false, false},
+		{"other span", b, false, true},
+		{"again a window later", a, true, false},
+		{"again two windows later", a, true, true},
+		{"after being added again", a, false, false},
+	}
+	for _, s := range steps {
+		if s.rotate {
+			d.rotated = d.rotated.Add(-time.Minute)
+		}
+		if got := d.add(s.span); got != s.want {
+			t.Errorf("%s: add() = %v, want %v", s.name, got, s.want)
+		}
+	}
+	if d.dropped != 3 {
+		t.Errorf("dropped = %d, want 3", d.dropped)
+	}
+
+	// a span the wave failed to take may be written again
+	d.forget(b)
+	if !d.add(b) {
+		t.Error("add() after forget() = false, want true")
+	}
+}
+
+func TestSpanDeduperCollapse(t *testing.T) {
+	start := time.Unix(1600000000, 0)
+	first := testSpan(1, 1, "frontend", start)
+	again := testSpan(1, 1, "frontend", start)
+	again.Tags = []model.KeyValue{model.String("retry", "1")}
+	other := testSpan(1, 2, "frontend", start)
+
+	tests := []struct {
+		name      string
+		spans     []*model.Span
+		want      []*model.Span
+		collapsed uint64
+	}{
+		{"none", nil, []*model.Span{}, 0},
+		{"unique", []*model.Span{first, other}, []*model.Span{first, other}, 0},
+		{"keeps the first", []*model.Span{first, other, again}, []*model.Span{first, other}, 1},
+		{"keeps the first reported again", []*model.Span{again, first, first}, []*model.Span{again}, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newSpanDeduper(0)
+			spans := append([]*model.Span{}, tt.spans...)
+			got := d.collapse(spans)
+			if len(got) != len(tt.want) {
+				t.Fatalf("collapse() = %d spans, want %d", len(got), len(tt.want))
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("collapse()[%d] = %v, want %v", i, got[i], tt.want[i])
+				}
+			}
+			// the tail left behind doesn't hold on to duplicates
+			for i := len(got); i < len(spans); i++ {
+				if spans[i] != nil {
+					t.Errorf("collapse() left %v at %d", spans[i], i)
+				}
+			}
+			if d.collapsed != tt.collapsed {
+				t.Errorf("collapsed = %d, want %d", d.collapsed, tt.collapsed)
+			}
+		})
+	}
+}
@@ -0,0 +1,645 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/chronowave/chronowave/embed"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/plugin/storage/es/spanstore/dbmodel"
+	"github.com/opentracing/opentracing-go/ext"
+
+	"chronowave-jaeger/builder"
+)
+
+const (
+	dependenciesPath = "/dependencies"
+
+	// a bucket is computed this long after it ends, or after spans are written late
+	// into it, for them to be indexed
+	dependencyDelay = 5 * time.Minute
+	// parents of spans in a bucket are looked up this far back
+	parentLookback = 24 * time.Hour
+	// span IDs per parent lookup query
+	parentBatch = 512
+
+	// Source of FollowsFrom links, ChildOf links have model.JaegerDependencyLinkSource
+	followsFromLinkSource = "jaeger.follows_from"
+)
+
+// dependencyDoc is a bucket of dependency links stored in the wave next to spans.
+// Span queries must filter a span path, a variable without predicate also matches
+// other documents, as null.
+type dependencyDoc struct {
+	StartTime    int64            `json:"startTime"`
+	Dependencies dependencyBucket `json:"dependencies"`
+}
+
+type dependencyBucket struct {
+	Bucket   int64            `json:"bucket"`             // bucket start, microseconds since Unix epoch
+	Computed int64            `json:"computed,omitempty"` // zero in buckets of older releases
+	Links    []dependencyLink `json:"links"`
+}
+
+// dependencyLink is an edge from parent to child service by reference type, with
+// child span durations as a histogram, so buckets can be summed into percentiles.
+type dependencyLink struct {
+	Parent     string            `json:"parent"`
+	Child      string            `json:"child"`
+	Type       string            `json:"type,omitempty"` // dbmodel.ReferenceType, empty in buckets of older releases
+	CallCount  uint64            `json:"callCount"`
+	ErrorCount uint64            `json:"errorCount"`
+	Durations  durationHistogram `json:"durations,omitempty"`
+}
+
+func (l *dependencyLink) refType() dbmodel.ReferenceType {
+	if len(l.Type) == 0 {
+		return dbmodel.ChildOf
+	}
+	return dbmodel.ReferenceType(l.Type)
+}
+
+// toDomain returns l for Jaeger, FollowsFrom edges are marked by Source.
+func (l *dependencyLink) toDomain() model.DependencyLink {
+	link := model.DependencyLink{
+		Parent:    l.Parent,
+		Child:     l.Child,
+		CallCount: l.CallCount,
+		Source:    model.JaegerDependencyLinkSource,
+	}
+	if l.refType() == dbmodel.FollowsFrom {
+		link.Source = followsFromLinkSource
+	}
+	return link
+}
+
+// linkSet merges links by parent, child and reference type.
+type linkSet struct {
+	links []*dependencyLink
+	index map[string]int
+}
+
+func (ls *linkSet) add(l *dependencyLink) {
+	if ls.index == nil {
+		ls.index = map[string]int{}
+	}
+
+	key := l.Parent + "&&&" + l.Child + "&&&" + string(l.refType())
+	if i, ok := ls.index[key]; ok {
+		cur := ls.links[i]
+		cur.CallCount += l.CallCount
+		cur.ErrorCount += l.ErrorCount
+		cur.Durations = cur.Durations.merge(l.Durations)
+		return
+	}
+
+	ls.index[key] = len(ls.links)
+	ls.links = append(ls.links, &dependencyLink{
+		Parent:     l.Parent,
+		Child:      l.Child,
+		Type:       string(l.refType()),
+		CallCount:  l.CallCount,
+		ErrorCount: l.ErrorCount,
+		Durations:  durationHistogram{}.merge(l.Durations),
+	})
+}
+
+// dependencyBuckets computes dependency links per time bucket in the background and
+// stores them as documents in the wave. Links of time not yet in a bucket are
+// computed from spans when asked for, so are those of buckets spans were written
+// into late, until they are computed again.
+type dependencyBuckets struct {
+	stream *embed.WaveStream
+	index  *waveIndex
+	size   int64 // microseconds
+	next   int64 // start of the first bucket not computed yet, zero until known
+	lock   sync.Mutex
+	dirty  map[int64]int64 // computed buckets by when spans were last written into them
+	done   chan void
+	closed sync.WaitGroup
+}
+
+func newDependencyBuckets(stream *embed.WaveStream, index *waveIndex, size, ttl time.Duration) *dependencyBuckets {
+	d := &dependencyBuckets{
+		stream: stream,
+		index:  index,
+		size:   micros64(size),
+		dirty:  map[int64]int64{},
+		done:   make(chan void),
+	}
+
+	d.closed.Add(1)
+	go d.loop(ttl)
+
+	return d
+}
+
+func (d *dependencyBuckets) Close() {
+	close(d.done)
+	d.closed.Wait()
+}
+
+func (d *dependencyBuckets) floor(ts int64) int64 {
+	return ts - ts%d.size
+}
+
+// observe marks buckets computed already which a flushed batch has spans of.
+func (d *dependencyBuckets) observe(batch []pendingSpan) {
+	next := atomic.LoadInt64(&d.next)
+	if next == 0 {
+		return
+	}
+
+	now := micros(time.Now())
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for _, p := range batch {
+		if p.startTime < next {
+			d.dirty[d.floor(p.startTime)] = now
+		}
+	}
+}
+
+// dirtyWithin returns marked buckets starting within [from, to].
+func (d *dependencyBuckets) dirtyWithin(from, to int64) []int64 {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	var buckets []int64
+	for b := range d.dirty {
+		if b >= from && b <= to {
+			buckets = append(buckets, b)
+		}
+	}
+	return buckets
+}
+
+// recompute computes marked buckets again once no spans were written into them for
+// dependencyDelay. It returns when the next one is due, zero if none is marked.
+func (d *dependencyBuckets) recompute(ctx context.Context) int64 {
+	now := micros(time.Now())
+	due := map[int64]int64{}
+	var next int64
+	d.lock.Lock()
+	for b, written := range d.dirty {
+		if at := written + micros64(dependencyDelay); at <= now {
+			due[b] = written
+		} else if next == 0 || at < next {
+			next = at
+		}
+	}
+	d.lock.Unlock()
+
+	for b, written := range due {
+		if err := d.compute(ctx, b); err != nil {
+			logger.Error("failed to recompute dependency bucket", "bucket", b, "error", err)
+			continue
+		}
+		d.lock.Lock()
+		// unless spans were written into it meanwhile
+		if d.dirty[b] == written {
+			delete(d.dirty, b)
+		}
+		d.lock.Unlock()
+	}
+	return next
+}
+
+func (d *dependencyBuckets) loop(ttl time.Duration) {
+	defer d.closed.Done()
+
+	ctx := context.Background()
+	now := micros(time.Now())
+	next := d.floor(now - micros64(ttl))
+	if latest, ok := d.latest(ctx, next, now); ok {
+		next = latest + d.size
+	}
+	atomic.StoreInt64(&d.next, next)
+
+	for {
+		for next+d.size+micros64(dependencyDelay) <= micros(time.Now()) {
+			if err := d.compute(ctx, next); err != nil {
+				logger.Error("failed to compute dependency bucket", "bucket", next, "error", err)
+				break
+			}
+			next += d.size
+			atomic.StoreInt64(&d.next, next)
+
+			select {
+			case <-d.done:
+				return
+			default:
+			}
+		}
+
+		due := next + d.size + micros64(dependencyDelay)
+		if at := d.recompute(ctx); at > 0 && at < due {
+			due = at
+		}
+		wait := time.Until(time.Unix(0, due*int64(time.Microsecond)))
+		if wait < time.Minute {
+			wait = time.Minute
+		}
+		select {
+		case <-time.After(wait):
+		case <-d.done:
+			return
+		}
+	}
+}
+
+// recomputeDependencies computes buckets stored within [from, to] again, after spans
+// were imported or restored into them. Buckets not computed yet are left to the
+// plugin. The wave in dir must be open.
+func recomputeDependencies(stream *embed.WaveStream, dir string, size time.Duration, from, to int64) error {
+	index, err := openWaveIndex(dir)
+	if err != nil {
+		return err
+	}
+	defer index.Close()
+
+	ctx := context.Background()
+	d := &dependencyBuckets{stream: stream, index: index, size: micros64(size)}
+	buckets, err := d.stored(ctx, d.floor(from), to)
+	if err != nil || len(buckets) == 0 {
+		return err
+	}
+
+	var buf bytes.Buffer
+	for _, b := range buckets {
+		data, err := d.bucketDoc(ctx, b.Bucket)
+		if err != nil {
+			return err
+		}
+		buf.Write(data)
+	}
+
+	// indexed into a segment right away, like imported spans
+	batch := filepath.Join(dir, ".dependencies")
+	defer os.Remove(batch)
+	if err = ioutil.WriteFile(batch, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	return embed.Build(batch, timestamp, keys)
+}
+
+// latest returns the start of the newest stored bucket within [from, to].
+func (d *dependencyBuckets) latest(ctx context.Context, from, to int64) (int64, bool) {
+	buckets, err := d.stored(ctx, from, to)
+	if err != nil || len(buckets) == 0 {
+		return 0, false
+	}
+
+	latest := buckets[0].Bucket
+	for _, b := range buckets[1:] {
+		if b.Bucket > latest {
+			latest = b.Bucket
+		}
+	}
+	return latest, true
+}
+
+// compute stores links of spans started within the bucket starting at start. An
+// empty bucket is stored too, so it isn't computed again.
+func (d *dependencyBuckets) compute(ctx context.Context, start int64) error {
+	data, err := d.bucketDoc(ctx, start)
+	if err != nil {
+		return err
+	}
+
+	return d.stream.OnNewDocument(data)
+}
+
+// bucketDoc returns the document of the bucket starting at start.
+func (d *dependencyBuckets) bucketDoc(ctx context.Context, start int64) ([]byte, error) {
+	links, err := d.spanDependencies(ctx, start, start+d.size-1)
+	if err != nil {
+		return nil, err
+	}
+
+	doc := dependencyDoc{
+		StartTime: start,
+		Dependencies: dependencyBucket{
+			Bucket:   start,
+			Computed: micros(time.Now()),
+			Links:    make([]dependencyLink, len(links)),
+		},
+	}
+	for i, l := range links {
+		doc.Dependencies.Links[i] = *l
+	}
+
+	return json.Marshal(doc)
+}
+
+// stored returns buckets starting within [from, to], a bucket computed more than once
+// is returned once, as computed last. Of buckets computed twice by older releases,
+// across a restart, the one with more calls is returned.
+func (d *dependencyBuckets) stored(ctx context.Context, from, to int64) ([]dependencyBucket, error) {
+	qry, err := builder.Find("d").
+		Where(
+			d.index.frame(from, to),
+			builder.Var("d", dependenciesPath),
+			// unfiltered variables also match spans as null
+			builder.Path(dependenciesPath+"/bucket").Exist(),
+			builder.Path(timestamp).Timeframe(from, to),
+		).
+		Build()
+	if err != nil {
+		return nil, err
+	}
+
+	jdoc, err := d.stream.Query(ctx, qry)
+	if err != nil {
+		return nil, err
+	}
+
+	var rs []struct{ D dependencyBucket }
+	if err = json.Unmarshal(jdoc, &rs); err != nil {
+		return nil, err
+	}
+
+	seen := make(map[int64]int, len(rs))
+	buckets := make([]dependencyBucket, 0, len(rs))
+	for _, r := range rs {
+		// a bucket computed again saw at least the spans of the first one
+		if i, ok := seen[r.D.Bucket]; ok {
+			if later(r.D, buckets[i]) {
+				buckets[i] = r.D
+			}
+			continue
+		}
+		seen[r.D.Bucket] = len(buckets)
+		buckets = append(buckets, r.D)
+	}
+
+	return buckets, nil
+}
+
+// later returns true if a was computed after b.
+func later(a, b dependencyBucket) bool {
+	if a.Computed != b.Computed {
+		return a.Computed > b.Computed
+	}
+	return calls(a) > calls(b)
+}
+
+func calls(b dependencyBucket) uint64 {
+	var n uint64
+	for _, l := range b.Links {
+		n += l.CallCount
+	}
+	return n
+}
+
+// links sums stored buckets overlapping [from, to], and computes the rest from spans,
+// as well as buckets spans were written into since they were stored.
+func (d *dependencyBuckets) links(ctx context.Context, from, to int64) ([]*dependencyLink, error) {
+	var ls linkSet
+
+	next := atomic.LoadInt64(&d.next)
+	if next > 0 && from < next {
+		buckets, err := d.stored(ctx, d.floor(from), min64(next-1, to))
+		if err != nil {
+			return nil, err
+		}
+		dirty := map[int64]bool{}
+		for _, b := range d.dirtyWithin(d.floor(from), min64(next-1, to)) {
+			dirty[b] = true
+			links, err := d.spanDependencies(ctx, b, b+d.size-1)
+			if err != nil {
+				return nil, err
+			}
+			for _, l := range links {
+				ls.add(l)
+			}
+		}
+		for _, b := range buckets {
+			if dirty[b.Bucket] {
+				continue
+			}
+			for i := range b.Links {
+				ls.add(&b.Links[i])
+			}
+		}
+		from = next
+	}
+
+	if from <= to {
+		links, err := d.spanDependencies(ctx, from, to)
+		if err != nil {
+			return nil, err
+		}
+		for _, l := range links {
+			ls.add(l)
+		}
+	}
+
+	return ls.links, nil
+}
+
+type depSpan struct {
+	Ref  []dbmodel.Reference
+	Tid  string
+	Sid  string
+	Svc  string
+	Dur  int64
+	Tags []dbmodel.KeyValue
+}
+
+// failed returns true if the span has tag error=true.
+func (s *depSpan) failed() bool {
+	for _, kv := range s.Tags {
+		if kv.Key == string(ext.Error) {
+			v, _ := kv.Value.(string)
+			return v == "true"
+		}
+	}
+	return false
+}
+
+// server returns true if the span has tag span.kind=server.
+func (s *depSpan) server() bool {
+	for _, kv := range s.Tags {
+		if kv.Key == string(ext.SpanKind) {
+			v, _ := kv.Value.(string)
+			return v == string(ext.SpanKindRPCServerEnum)
+		}
+	}
+	return false
+}
+
+// spanServices maps spans by trace and span ID to their service. A Zipkin shared server
+// span has the span ID of its client span and references it as its parent: it links to
+// the client service, while other children of the ID link to the server service, as
+// Jaeger query has it once the server span has an ID of its own.
+type spanServices map[string]*spanService
+
+type spanService struct {
+	client, server string
+}
+
+func (m spanServices) add(s *depSpan) {
+	ss, ok := m[s.Tid+s.Sid]
+	if !ok {
+		ss = &spanService{}
+		m[s.Tid+s.Sid] = ss
+	}
+	if s.server() {
+		ss.server = s.Svc
+	} else {
+		ss.client = s.Svc
+	}
+}
+
+// parent returns the service of the parent pid of span s.
+func (m spanServices) parent(s *depSpan, pid string) (string, bool) {
+	ss, ok := m[s.Tid+pid]
+	switch {
+	case !ok:
+		return "", false
+	case pid == s.Sid:
+		// a shared server span, of which the client span may not be found yet
+		return ss.client, ss.client != ""
+	case ss.server != "":
+		return ss.server, true
+	}
+	return ss.client, true
+}
+
+// spanDependencies computes links of spans started within [from, to] to their parents,
+// parents started before from are looked up by span ID.
+func (d *dependencyBuckets) spanDependencies(ctx context.Context, from, to int64) ([]*dependencyLink, error) {
+	rs, err := d.queryDepSpans(ctx, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	spanMap := make(spanServices, len(rs))
+	for i := range rs {
+		spanMap.add(&rs[i])
+	}
+
+	var missing []string
+	for _, v := range rs {
+		if pid, _ := parentID(v.Ref); len(pid) > 0 {
+			if _, ok := spanMap.parent(&v, pid); !ok {
+				missing = append(missing, pid)
+			}
+		}
+	}
+
+	for len(missing) > 0 {
+		n := len(missing)
+		if n > parentBatch {
+			n = parentBatch
+		}
+		parents, err := d.queryDepSpans(ctx, max64(0, from-micros64(parentLookback)), to, missing[:n]...)
+		if err != nil {
+			return nil, err
+		}
+		for i := range parents {
+			spanMap.add(&parents[i])
+		}
+		missing = missing[n:]
+	}
+
+	var ls linkSet
+	for i := range rs {
+		v := &rs[i]
+		pid, refType := parentID(v.Ref)
+		if len(pid) == 0 {
+			continue
+		}
+
+		if parent, ok := spanMap.parent(v, pid); ok {
+			if parent == v.Svc {
+				continue
+			}
+			l := &dependencyLink{
+				Parent:    parent,
+				Child:     v.Svc,
+				Type:      string(refType),
+				CallCount: 1,
+				Durations: durationHistogram{}.add(v.Dur),
+			}
+			if v.failed() {
+				l.ErrorCount = 1
+			}
+			ls.add(l)
+		}
+	}
+
+	return ls.links, nil
+}
+
+// queryDepSpans returns spans started within [from, to], only spans sids if given.
+func (d *dependencyBuckets) queryDepSpans(ctx context.Context, from, to int64, sids ...string) ([]depSpan, error) {
+	qry := builder.Find("ref", "tid", "sid", "svc", "dur", "tags").
+		Where(
+			d.index.frame(from, to),
+			builder.Var("ref", "/references"),
+			builder.Var("tid", "/traceID").Exist(),
+			builder.Var("sid", "/spanID"),
+			builder.Var("svc", "/process/serviceName"),
+			builder.Var("dur", "/duration"),
+			builder.Var("tags", "/tags"),
+			builder.Path(timestamp).Timeframe(from, to),
+		)
+	if len(sids) > 0 {
+		qry.Where(builder.Path("/spanID").In(sids...))
+	}
+
+	stmt, err := qry.Build()
+	if err != nil {
+		return nil, err
+	}
+
+	jdoc, err := d.stream.Query(ctx, stmt)
+	if err != nil {
+		return nil, err
+	}
+
+	var rs []depSpan
+	err = json.Unmarshal(jdoc, &rs)
+
+	return rs, err
+}
+
+// parentID returns the span referenced as ChildOf, or else as FollowsFrom.
+func parentID(refs []dbmodel.Reference) (string, dbmodel.ReferenceType) {
+	var (
+		pid     string
+		refType dbmodel.ReferenceType
+	)
+	for _, r := range refs {
+		if r.RefType == dbmodel.ChildOf {
+			return string(r.SpanID), r.RefType
+		}
+		if r.RefType == dbmodel.FollowsFrom && len(pid) == 0 {
+			pid, refType = string(r.SpanID), r.RefType
+		}
+	}
+	return pid, refType
+}
+
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/plugin/storage/es/spanstore/dbmodel"
+)
+
+// testLink is a dependency link without durations, for comparison.
+type testLink struct {
+	parent, child string
+	refType       dbmodel.ReferenceType
+	calls, errors uint64
+}
+
+func testLinks(links []*dependencyLink) []testLink {
+	got := make([]testLink, len(links))
+	for i, l := range links {
+		got[i] = testLink{l.Parent, l.Child, l.refType(), l.CallCount, l.ErrorCount}
+	}
+	sort.Slice(got, func(i, j int) bool {
+		if got[i].parent != got[j].parent {
+			return got[i].parent < got[j].parent
+		}
+		return got[i].child < got[j].child
+	})
+	return got
+}
+
+// testChild returns a span of service with references to its parents.
+func testChild(trace, span uint64, service string, start time.Time, refs ...model.SpanRef) *model.Span {
+	s := testSpan(trace, span, service, start)
+	s.References = refs
+	return s
+}
+
+func childOf(trace, span uint64) model.SpanRef {
+	return model.NewChildOfRef(model.NewTraceID(0, trace), model.NewSpanID(span))
+}
+
+func followsFrom(trace, span uint64) model.SpanRef {
+	return model.NewFollowsFromRef(model.NewTraceID(0, trace), model.NewSpanID(span))
+}
+
+// testKind returns span s of kind.
+func testKind(s *model.Span, kind string) *model.Span {
+	s.Tags = append(s.Tags, model.String("span.kind", kind))
+	return s
+}
+
+func TestParentID(t *testing.T) {
+	tests := []struct {
+		name    string
+		refs    []dbmodel.Reference
+		pid     string
+		refType dbmodel.ReferenceType
+	}{
+		{"root", nil, "", ""},
+		{"child of", []dbmodel.Reference{{RefType: dbmodel.ChildOf, SpanID: "a"}}, "a", dbmodel.ChildOf},
+		{"follows from", []dbmodel.Reference{{RefType: dbmodel.FollowsFrom, SpanID: "a"}}, "a", dbmodel.FollowsFrom},
+		{
+			"child of first",
+			[]dbmodel.Reference{{RefType: dbmodel.FollowsFrom, SpanID: "a"}, {RefType: dbmodel.ChildOf, SpanID: "b"}},
+			"b", dbmodel.ChildOf,
+		},
+		{
+			"first follows from",
+			[]dbmodel.Reference{{RefType: dbmodel.FollowsFrom, SpanID: "a"}, {RefType: dbmodel.FollowsFrom, SpanID: "b"}},
+			"a", dbmodel.FollowsFrom,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pid, refType := parentID(tt.refs)
+			if pid != tt.pid || refType != tt.refType {
+				t.Errorf("parentID() = %q, %q, want %q, %q", pid, refType, tt.pid, tt.refType)
+			}
+		})
+	}
+}
+
+func TestSpanDependencies(t *testing.T) {
+	bucket := time.Unix(1599998400, 0) // on the hour
+	failed := testChild(1, 13, "redis", bucket.Add(12*time.Minute), childOf(1, 12))
+	failed.Tags = []model.KeyValue{model.Bool("error", true)}
+
+	wr, close := testWaveRider(t, []*model.Span{
+		testSpan(1, 11, "frontend", bucket.Add(10*time.Minute)),
+		testChild(1, 12, "driver", bucket.Add(11*time.Minute), childOf(1, 11)),
+		failed,
+		testChild(1, 14, "driver", bucket.Add(13*time.Minute), childOf(1, 12)),
+		// the parent is in the bucket before
+		testSpan(2, 21, "frontend", bucket.Add(-30*time.Minute)),
+		testChild(2, 22, "queue", bucket.Add(20*time.Minute), followsFrom(2, 21)),
+		testChild(2, 23, "mailer", bucket.Add(21*time.Minute), followsFrom(2, 21), childOf(2, 22)),
+		// the parent isn't stored
+		testChild(3, 31, "customer", bucket.Add(30*time.Minute), childOf(3, 30)),
+		// Zipkin shared spans: the server span references its client span
+		testSpan(4, 40, "frontend", bucket.Add(40*time.Minute)),
+		testKind(testChild(4, 41, "frontend", bucket.Add(41*time.Minute), childOf(4, 40)), "client"),
+		testKind(testChild(4, 41, "billing", bucket.Add(41*time.Minute), childOf(4, 41)), "server"),
+		testChild(4, 42, "postgres", bucket.Add(42*time.Minute), childOf(4, 41)),
+		// the client span is in the bucket before
+		testKind(testSpan(5, 51, "frontend", bucket.Add(-10*time.Minute)), "client"),
+		testKind(testChild(5, 51, "billing", bucket.Add(50*time.Minute), childOf(5, 51)), "server"),
+	})
+	defer close()
+	d := &dependencyBuckets{stream: wr.stream, index: wr.index, size: micros64(time.Hour)}
+
+	tests := []struct {
+		name     string
+		from, to time.Time
+		want     []testLink
+	}{
+		{
+			"bucket",
+			bucket, bucket.Add(time.Hour - time.Microsecond),
+			[]testLink{
+				{"billing", "postgres", dbmodel.ChildOf, 1, 0},
+				{"driver", "redis", dbmodel.ChildOf, 1, 1},
+				{"frontend", "billing", dbmodel.ChildOf, 2, 0},
+				{"frontend", "driver", dbmodel.ChildOf, 1, 0},
+				{"frontend", "queue", dbmodel.FollowsFrom, 1, 0},
+				{"queue", "mailer", dbmodel.ChildOf, 1, 0},
+			},
+		},
+		{
+			"parents started before from",
+			bucket.Add(15 * time.Minute), bucket.Add(time.Hour - time.Microsecond),
+			[]testLink{
+				{"billing", "postgres", dbmodel.ChildOf, 1, 0},
+				{"frontend", "billing", dbmodel.ChildOf, 2, 0},
+				{"frontend", "queue", dbmodel.FollowsFrom, 1, 0},
+				{"queue", "mailer", dbmodel.ChildOf, 1, 0},
+			},
+		},
+		{"roots only", bucket.Add(-time.Hour), bucket.Add(-time.Microsecond), []testLink{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			links, err := d.spanDependencies(context.Background(), micros(tt.from), micros(tt.to))
+			if err != nil {
+				t.Fatalf("spanDependencies() error = %v", err)
+			}
+			if got := testLinks(links); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("spanDependencies() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDependencyBucketsLate(t *testing.T) {
+	bucket := time.Unix(1599998400, 0)
+	wr, close := testWaveRider(t, []*model.Span{
+		testSpan(1, 11, "frontend", bucket.Add(10*time.Minute)),
+		testChild(1, 12, "driver", bucket.Add(11*time.Minute), childOf(1, 11)),
+	})
+	defer close()
+
+	ctx := context.Background()
+	d := &dependencyBuckets{stream: wr.stream, index: wr.index, size: micros64(time.Hour), dirty: map[int64]int64{}}
+	start, end := micros(bucket), micros(bucket.Add(time.Hour))-1
+	d.next = micros(bucket.Add(time.Hour))
+	doc, err := d.bucketDoc(ctx, start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = testSegment(wr.dir, doc); err != nil {
+		t.Fatal(err)
+	}
+
+	late := testChild(1, 13, "redis", bucket.Add(12*time.Minute), childOf(1, 12))
+	data, err := json.Marshal(dbmodel.FromDomain{}.FromDomainEmbedProcess(late))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = testSegment(wr.dir, data); err != nil {
+		t.Fatal(err)
+	}
+
+	stored := []testLink{{"frontend", "driver", dbmodel.ChildOf, 1, 0}}
+	withLate := []testLink{{"driver", "redis", dbmodel.ChildOf, 1, 0}, {"frontend", "driver", dbmodel.ChildOf, 1, 0}}
+	steps := []struct {
+		name    string
+		observe []pendingSpan
+		want    []testLink
+	}{
+		{"stored until marked", nil, stored},
+		{"not marked by spans after next", []pendingSpan{{startTime: d.next}}, stored},
+		{"computed from spans once marked", []pendingSpan{newPendingSpan(late, data)}, withLate},
+	}
+	for _, s := range steps {
+		d.observe(s.observe)
+		links, err := d.links(ctx, start, end)
+		if err != nil {
+			t.Fatalf("%s: links() error = %v", s.name, err)
+		}
+		if got := testLinks(links); !reflect.DeepEqual(got, s.want) {
+			t.Errorf("%s: links() = %v, want %v", s.name, got, s.want)
+		}
+	}
+
+	// stored again once no spans were written for dependencyDelay
+	if at := d.recompute(ctx); at <= micros(time.Now()) {
+		t.Errorf("recompute() next due = %d, want after now", at)
+	}
+	if len(d.dirtyWithin(start, end)) != 1 {
+		t.Fatal("recompute() before due unmarked the bucket")
+	}
+	d.dirty[start] -= micros64(dependencyDelay)
+	if at := d.recompute(ctx); at != 0 || len(d.dirtyWithin(start, end)) != 0 {
+		t.Errorf("recompute() when due = %d, %v marked, want none", at, d.dirtyWithin(start, end))
+	}
+
+	// as imported spans are, the bucket computed last is read
+	if err = recomputeDependencies(wr.stream, wr.dir, time.Hour, start, end); err != nil {
+		t.Fatalf("recomputeDependencies() error = %v", err)
+	}
+	buckets, err := d.stored(ctx, start, end)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buckets) != 1 {
+		t.Fatalf("stored() = %d buckets, want 1", len(buckets))
+	}
+	links := make([]*dependencyLink, len(buckets[0].Links))
+	for i := range buckets[0].Links {
+		links[i] = &buckets[0].Links[i]
+	}
+	if got := testLinks(links); !reflect.DeepEqual(got, withLate) {
+		t.Errorf("stored() after recomputeDependencies() = %v, want %v", got, withLate)
+	}
+}
+
+func TestDependencyBucketLater(t *testing.T) {
+	one := []dependencyLink{{Parent: "a", Child: "b", CallCount: 1}}
+	two := []dependencyLink{{Parent: "a", Child: "b", CallCount: 2}}
+	tests := []struct {
+		name string
+		a, b dependencyBucket
+		want bool
+	}{
+		{"computed after", dependencyBucket{Computed: 2, Links: one}, dependencyBucket{Computed: 1, Links: two}, true},
+		{"computed before", dependencyBucket{Computed: 1, Links: two}, dependencyBucket{Computed: 2, Links: one}, false},
+		{"older release, more calls", dependencyBucket{Links: two}, dependencyBucket{Links: one}, true},
+		{"older release, fewer calls", dependencyBucket{Links: one}, dependencyBucket{Links: two}, false},
+		{"older release, as many calls", dependencyBucket{Links: one}, dependencyBucket{Links: one}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := later(tt.a, tt.b); got != tt.want {
+				t.Errorf("later() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/chronowave/chronowave/embed"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// disk usage is measured this often
+	diskCheck = 30 * time.Second
+	// eviction frees disk down to this fraction of the quota
+	diskLowWatermark = 0.9
+	// segments looked at per eviction
+	evictBatch = 1024
+)
+
+var (
+	// ErrDiskQuota is returned by WriteSpan while the data directory is over
+	// chronowave.disk.quota. Unavailable tells the collector to retry later.
+	ErrDiskQuota = status.Error(codes.Unavailable, "chronowave data directory is over its disk quota, retry later")
+)
+
+// diskQuota keeps the data directory of the wave within quota bytes: the write-ahead
+// log, index segments, sqlite databases and traces archived or kept under it. Over
+// quota, the oldest segments are evicted, the only files eviction can free, and writes
+// are rejected until usage is back within quota.
+type diskQuota struct {
+	dir      string
+	quota    int64
+	stream   *embed.WaveStream
+	index    *waveIndex
+	catalog  *catalog
+	sum      *summaries
+	kept     bool   // traces kept by tail retention outlive evicted segments
+	usage    int64  // bytes, as last measured
+	segments uint64 // evicted since start
+	degraded int32
+	done     chan void
+	closed   sync.WaitGroup
+}
+
+// newDiskQuota watches the wave in dir, a zero quota only measures usage. Catalog
+// entries and summaries of evicted spans are expired with them.
+func newDiskQuota(dir string, quota int64, stream *embed.WaveStream, index *waveIndex, cat *catalog, sum *summaries, kept bool) *diskQuota {
+	d := &diskQuota{
+		dir:     dir,
+		quota:   quota,
+		stream:  stream,
+		index:   index,
+		catalog: cat,
+		sum:     sum,
+		kept:    kept,
+		done:    make(chan void),
+	}
+
+	d.check()
+	d.closed.Add(1)
+	go d.loop()
+
+	return d
+}
+
+func (d *diskQuota) Close() {
+	close(d.done)
+	d.closed.Wait()
+}
+
+func (d *diskQuota) isDegraded() bool {
+	return atomic.LoadInt32(&d.degraded) == 1
+}
+
+func (d *diskQuota) loop() {
+	defer d.closed.Done()
+
+	ticker := time.NewTicker(diskCheck)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			d.check()
+		case <-d.done:
+			return
+		}
+	}
+}
+
+// check measures usage, and evicts segments if it's over quota.
+func (d *diskQuota) check() {
+	usage, err := dirSize(d.dir)
+	if err != nil {
+		logger.Error("failed to measure disk usage", "dir", d.dir, "error", err)
+		return
+	}
+	atomic.StoreInt64(&d.usage, usage)
+
+	if d.quota <= 0 {
+		return
+	}
+	if usage <= d.quota {
+		if atomic.CompareAndSwapInt32(&d.degraded, 1, 0) {
+			logger.Warn("disk usage is within quota, accept spans again", "usage", usage, "quota", d.quota)
+		}
+		return
+	}
+
+	if atomic.CompareAndSwapInt32(&d.degraded, 0, 1) {
+		logger.Warn("disk usage is over quota, reject spans and evict oldest segments", "usage", usage, "quota", d.quota)
+	}
+
+	if err = d.evict(usage - int64(float64(d.quota)*diskLowWatermark)); err != nil {
+		logger.Error("failed to evict segments", "error", err)
+		return
+	}
+
+	if usage, err = dirSize(d.dir); err == nil {
+		atomic.StoreInt64(&d.usage, usage)
+		if usage <= d.quota && atomic.CompareAndSwapInt32(&d.degraded, 1, 0) {
+			logger.Warn("disk usage is within quota, accept spans again", "usage", usage, "quota", d.quota)
+		}
+	}
+}
+
+// evict purges the oldest segments holding at least free bytes, or all segments.
+func (d *diskQuota) evict(free int64) error {
+	segments, err := d.index.oldest(evictBatch)
+	if err != nil || len(segments) == 0 {
+		return err
+	}
+
+	var (
+		freed int64
+		n     int
+	)
+	for n < len(segments) && freed < free {
+		if fi, err := os.Stat(segmentPath(d.dir, segments[n].wid)); err == nil {
+			freed += fi.Size()
+		}
+		n++
+	}
+
+	// ChronoWave purges by creation time, in seconds, segments created within the
+	// second of the last one go too
+	before := segments[n-1].created.UTC().Add(time.Second)
+	end, err := d.index.endBefore(before)
+	if err != nil {
+		return err
+	}
+	if err = d.stream.Purge(context.Background(), before); err != nil {
+		return err
+	}
+	d.expire(before, end)
+
+	var evicted int
+	for _, s := range segments {
+		if s.created.UTC().Before(before) {
+			evicted++
+		}
+	}
+	atomic.AddUint64(&d.segments, uint64(evicted))
+	logger.Warn("evicted oldest segments over disk quota", "segments", evicted, "bytes", freed, "before", before)
+
+	return nil
+}
+
+// expire removes summaries of traces started up to end, the start time of the last
+// span in the evicted segments, and catalog entries of operations last written before
+// before, when the segments were. Traces kept by tail retention keep both until the
+// purge expires them.
+func (d *diskQuota) expire(before time.Time, end int64) {
+	started := time.Unix(0, (end+1)*int64(time.Microsecond))
+	kept := started
+	if d.kept {
+		kept = time.Unix(0, 0)
+	}
+	if err := d.sum.expire(started, kept); err != nil {
+		logger.Error("failed to expire trace summaries of evicted segments", "error", err)
+	}
+
+	if d.kept {
+		return
+	}
+	if err := d.catalog.expire(before); err != nil {
+		logger.Error("failed to expire service catalog of evicted segments", "error", err)
+	}
+}
+
+// diskHealth is the disk part of /health.
+type diskHealth struct {
+	Usage    int64  `json:"usage"` // bytes of chronowave.dir
+	Quota    int64  `json:"quota"` // 0 is unlimited
+	Evicted  uint64 `json:"evictedSegments"`
+	Degraded bool   `json:"degraded"`
+}
+
+func (d *diskQuota) health() diskHealth {
+	return diskHealth{
+		Usage:    atomic.LoadInt64(&d.usage),
+		Quota:    d.quota,
+		Evicted:  atomic.LoadUint64(&d.segments),
+		Degraded: d.isDegraded(),
+	}
+}
+
+// writeProm writes disk usage and evictions in Prometheus text exposition format.
+func (d *diskQuota) writeProm(w io.Writer) error {
+	degraded := 0
+	if d.isDegraded() {
+		degraded = 1
+	}
+
+	_, err := fmt.Fprintf(w, `# HELP chronowave_disk_usage_bytes Size of the data directory of the wave.
+# TYPE chronowave_disk_usage_bytes gauge
+chronowave_disk_usage_bytes %d
+# HELP chronowave_disk_quota_bytes Disk quota of the data directory, 0 is unlimited.
+# TYPE chronowave_disk_quota_bytes gauge
+chronowave_disk_quota_bytes %d
+# HELP chronowave_disk_evicted_segments_total Index segments evicted over disk quota.
+# TYPE chronowave_disk_evicted_segments_total counter
+chronowave_disk_evicted_segments_total %d
+# HELP chronowave_degraded 1 while spans are rejected over disk quota.
+# TYPE chronowave_degraded gauge
+chronowave_degraded %d
+`, atomic.LoadInt64(&d.usage), d.quota, atomic.LoadUint64(&d.segments), degraded)
+	return err
+}
+
+// dirSize returns the size of files under dir.
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// files come and go as the wave indexes and purges
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/plugin/storage/es/spanstore/dbmodel"
+)
+
+func TestDiskQuota(t *testing.T) {
+	tests := []struct {
+		name     string
+		kept     bool // tail retention is on
+		services []string
+		traces   []string // summarized after the oldest segment is evicted, newest first
+	}{
+		{"evicted expire", false, []string{"s2", "s3"}, traceIDs(3, 2)},
+		{"kept by tail retention", true, []string{"s1", "s2", "s3"}, traceIDs(3, 2, 1)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wr, close := testWaveRider(t)
+			defer close()
+			cat, err := openCatalog(wr.dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer cat.Close()
+			sum, err := openSummaries(wr.dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sum.Close()
+			db, err := sql.Open("sqlite3", filepath.Join(wr.dir, "db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			// a segment per span, written 10s apart, large enough to outweigh sqlite files
+			created := time.Now().UTC().Add(-time.Hour).Truncate(time.Second)
+			start := time.Unix(1600000000, 0)
+			for i := uint64(1); i <= 3; i++ {
+				pad := make([]byte, 64*1024)
+				rand.Read(pad)
+				service := "s" + string(rune('0'+i))
+				span := testSpan(i, i, service, start.Add(time.Duration(i)*time.Second))
+				span.Tags = []model.KeyValue{model.String("pad", hex.EncodeToString(pad))}
+				doc, err := json.Marshal(dbmodel.FromDomain{}.FromDomainEmbedProcess(span))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err = testSegment(wr.dir, doc); err != nil {
+					t.Fatal(err)
+				}
+
+				at := created.Add(time.Duration(i) * 10 * time.Second)
+				if _, err = db.Exec(`UPDATE wave SET created = ? WHERE wid = (SELECT MAX(wid) FROM wave)`, at); err != nil {
+					t.Fatal(err)
+				}
+				p := newPendingSpan(span, doc)
+				if err = cat.observe([]pendingSpan{p}, micros(at)); err != nil {
+					t.Fatal(err)
+				}
+				if err = sum.observe([]pendingSpan{p}); err != nil {
+					t.Fatal(err)
+				}
+				if err = sum.classify(map[string]bool{p.traceID: true}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			d := &diskQuota{dir: wr.dir, stream: wr.stream, index: wr.index, catalog: cat, sum: sum, kept: tt.kept}
+			segments := func() int {
+				var n int
+				if err := db.QueryRow(`SELECT COUNT(*) FROM wave`).Scan(&n); err != nil {
+					t.Fatal(err)
+				}
+				return n
+			}
+
+			d.check()
+			usage := d.usage
+			steps := []struct {
+				name     string
+				quota    int64
+				segments int
+				degraded bool
+			}{
+				{"within quota", usage, 3, false},
+				// a tenth of usage is less than a segment
+				{"over quota evicts the oldest", usage - 1, 2, false},
+				{"over quota after evicting all", 1, 0, true},
+				{"unlimited", 0, 0, true},
+			}
+			for _, s := range steps {
+				d.quota = s.quota
+				d.check()
+				if got := segments(); got != s.segments {
+					t.Errorf("%s: segments = %d, want %d", s.name, got, s.segments)
+				}
+				if d.isDegraded() != s.degraded {
+					t.Errorf("%s: degraded = %v, want %v", s.name, d.isDegraded(), s.degraded)
+				}
+				if s.name == "over quota evicts the oldest" {
+					if got := cat.services(); !reflect.DeepEqual(got, tt.services) {
+						t.Errorf("services() after eviction = %v, want %v", got, tt.services)
+					}
+					got, err := sum.traceIDs("", 0, micros(start.Add(time.Minute)), 0)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if !reflect.DeepEqual(got, tt.traces) {
+						t.Errorf("summaries after eviction = %v, want %v", got, tt.traces)
+					}
+				}
+			}
+			if d.health().Evicted != 3 {
+				t.Errorf("health() evicted = %d, want 3", d.health().Evicted)
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/model/adjuster"
+	uiconv "github.com/jaegertracing/jaeger/model/converter/json"
+	ui "github.com/jaegertracing/jaeger/model/json"
+	"github.com/jaegertracing/jaeger/plugin/storage/es/spanstore/dbmodel"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"github.com/labstack/echo/v4"
+)
+
+// trace export formats
+const (
+	jaegerFormat  = "jaeger"
+	otlpFormat    = "otlp"
+	dbmodelFormat = "dbmodel"
+)
+
+// exportAdjusters are the adjusters Jaeger query applies, but clock skew, as exported
+// traces keep the timestamps they were stored with.
+var exportAdjusters = adjuster.Sequence(
+	adjuster.SpanIDDeduper(),
+	adjuster.IPTagAdjuster(),
+	adjuster.SortLogFields(),
+	adjuster.SpanReferences(),
+)
+
+// jaegerResponse is the envelope of Jaeger query's /api/traces/{id}.
+type jaegerResponse struct {
+	Data   []*ui.Trace   `json:"data"`
+	Total  int           `json:"total"`
+	Limit  int           `json:"limit"`
+	Offset int           `json:"offset"`
+	Errors []jaegerError `json:"errors"`
+}
+
+type jaegerError struct {
+	Code    int        `json:"code,omitempty"`
+	Msg     string     `json:"msg"`
+	TraceID ui.TraceID `json:"traceID,omitempty"`
+}
+
+// exportTrace returns a trace read by GetTrace in the format given by the format query
+// parameter:
+//   - jaeger, the default, as Jaeger query's /api/traces/{id} does, which Jaeger UI
+//     loads with Upload JSON; raw=true skips the adjusters
+//   - otlp, as an OTLP/JSON ExportTraceServiceRequest
+//   - dbmodel, as the array of span documents stored in the wave
+func (wr *WaveRider) exportTrace(c echo.Context) error {
+	traceID, err := model.TraceIDFromString(c.Param("id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid trace id "+c.Param("id"))
+	}
+
+	format := c.QueryParam("format")
+	switch format {
+	case "":
+		format = jaegerFormat
+	case jaegerFormat, otlpFormat, dbmodelFormat:
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, "unknown format "+format+", use jaeger, otlp or dbmodel")
+	}
+
+	trace, err := wr.GetTrace(c.Request().Context(), traceID)
+	if err == nil && len(trace.Spans) == 0 {
+		err = spanstore.ErrTraceNotFound
+	}
+	if err == spanstore.ErrTraceNotFound {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	} else if err != nil {
+		return err
+	}
+
+	switch format {
+	case otlpFormat:
+		return c.JSON(http.StatusOK, otlpFromDomain(trace))
+	case dbmodelFormat:
+		spans := make([]*dbmodel.Span, len(trace.Spans))
+		for i, s := range trace.Spans {
+			spans[i] = wr.from.FromDomainEmbedProcess(s)
+		}
+		return c.JSON(http.StatusOK, spans)
+	}
+
+	var errs []jaegerError
+	if c.QueryParam("raw") != "true" {
+		// adjusters return the trace with what they could adjust on error
+		if trace, err = exportAdjusters.Adjust(trace); err != nil {
+			errs = append(errs, jaegerError{Msg: err.Error(), TraceID: ui.TraceID(traceID.String())})
+		}
+	}
+
+	return c.JSON(http.StatusOK, jaegerResponse{Data: []*ui.Trace{uiconv.FromDomain(trace)}, Errors: errs})
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/plugin/storage/es/spanstore/dbmodel"
+	"github.com/labstack/echo/v4"
+)
+
+func TestExportTrace(t *testing.T) {
+	start := time.Unix(1600000000, 0)
+	traceID := model.NewTraceID(0, 1)
+	// a Zipkin shared span, of which Jaeger query gives the server span an ID of its own
+	client := testKind(testChild(1, 12, "frontend", start.Add(time.Millisecond), childOf(1, 11)), "client")
+	server := testKind(testChild(1, 12, "driver", start.Add(2*time.Millisecond), childOf(1, 12)), "server")
+	wr, close := testWaveRider(t, []*model.Span{testSpan(1, 11, "frontend", start), client, server})
+	defer close()
+	wr.dedup = newSpanDeduper(0)
+
+	stored, err := wr.GetTrace(context.Background(), traceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// sid returns span IDs of spans in the response, sorted
+	sid := func(ids ...string) []string {
+		sort.Strings(ids)
+		return ids
+	}
+
+	tests := []struct {
+		name   string
+		id     string
+		query  string
+		code   int
+		verify func(t *testing.T, body []byte)
+	}{
+		{
+			"jaeger by default", traceID.String(), "", http.StatusOK,
+			func(t *testing.T, body []byte) {
+				var resp struct {
+					Data []struct {
+						TraceID   string
+						Spans     []struct{ SpanID string }
+						Processes map[string]interface{}
+					}
+					Errors []jaegerError
+				}
+				if err := json.Unmarshal(body, &resp); err != nil {
+					t.Fatal(err)
+				}
+				if len(resp.Data) != 1 || len(resp.Errors) != 0 {
+					t.Fatalf("exported %d traces, errors %v, want 1 trace", len(resp.Data), resp.Errors)
+				}
+				trace := resp.Data[0]
+				if trace.TraceID != traceID.String() || len(trace.Spans) != 3 || len(trace.Processes) != 2 {
+					t.Fatalf("exported trace %s with %d spans of %d processes, want %s, 3 of 2", trace.TraceID, len(trace.Spans), len(trace.Processes), traceID)
+				}
+				ids := map[string]bool{}
+				for _, s := range trace.Spans {
+					ids[s.SpanID] = true
+				}
+				if len(ids) != 3 {
+					t.Errorf("exported span IDs %v, want the server span with an ID of its own", ids)
+				}
+			},
+		},
+		{
+			"jaeger raw", traceID.String(), "format=jaeger&raw=true", http.StatusOK,
+			func(t *testing.T, body []byte) {
+				var resp jaegerResponse
+				if err := json.Unmarshal(body, &resp); err != nil {
+					t.Fatal(err)
+				}
+				var ids []string
+				for _, s := range resp.Data[0].Spans {
+					ids = append(ids, string(s.SpanID))
+				}
+				if want := sid("000000000000000b", "000000000000000c", "000000000000000c"); !reflect.DeepEqual(sid(ids...), want) {
+					t.Errorf("exported span IDs %v, want %v", ids, want)
+				}
+			},
+		},
+		{
+			"otlp", traceID.String(), "format=otlp", http.StatusOK,
+			func(t *testing.T, body []byte) {
+				var traces otlpTraces
+				if err := json.Unmarshal(body, &traces); err != nil {
+					t.Fatal(err)
+				}
+				if len(traces.ResourceSpans) != 2 {
+					t.Errorf("exported %d resources, want one by process", len(traces.ResourceSpans))
+				}
+				spans, rejected, reason := traces.toDomain()
+				if rejected != 0 {
+					t.Fatalf("toDomain() of the export rejected %d spans, %s", rejected, reason)
+				}
+				if len(spans) != len(stored.Spans) {
+					t.Fatalf("exported %d spans, want %d", len(spans), len(stored.Spans))
+				}
+				for _, s := range spans {
+					var found bool
+					for _, want := range stored.Spans {
+						found = found || (s.SpanID == want.SpanID && s.Process.ServiceName == want.Process.ServiceName &&
+							s.StartTime.Equal(want.StartTime) && s.ParentSpanID() == want.ParentSpanID())
+					}
+					if !found {
+						t.Errorf("exported span %v isn't stored", s)
+					}
+				}
+			},
+		},
+		{
+			"dbmodel", traceID.String(), "format=dbmodel", http.StatusOK,
+			func(t *testing.T, body []byte) {
+				var spans []dbmodel.Span
+				if err := json.Unmarshal(body, &spans); err != nil {
+					t.Fatal(err)
+				}
+				var ids []string
+				for _, s := range spans {
+					if s.TraceID != dbmodel.TraceID(traceID.String()) || s.Process.ServiceName == "" {
+						t.Errorf("exported document %+v, want trace %s with its process", s, traceID)
+					}
+					ids = append(ids, string(s.SpanID))
+				}
+				if want := sid("000000000000000b", "000000000000000c", "000000000000000c"); !reflect.DeepEqual(sid(ids...), want) {
+					t.Errorf("exported span IDs %v, want %v", ids, want)
+				}
+			},
+		},
+		{"unknown format", traceID.String(), "format=zipkin", http.StatusBadRequest, nil},
+		{"invalid trace ID", "trace", "", http.StatusBadRequest, nil},
+		{"not found", model.NewTraceID(0, 2).String(), "", http.StatusNotFound, nil},
+	}
+
+	e := echo.New()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/traces/"+tt.id+"?"+tt.query, nil)
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+			c.SetParamNames("id")
+			c.SetParamValues(tt.id)
+
+			err := wr.exportTrace(c)
+			code := rec.Code
+			if he, ok := err.(*echo.HTTPError); ok {
+				code = he.Code
+			} else if err != nil {
+				t.Fatalf("exportTrace() error = %v", err)
+			}
+			if code != tt.code {
+				t.Fatalf("exportTrace() status = %d, want %d", code, tt.code)
+			}
+			if tt.verify != nil {
+				tt.verify(t, rec.Body.Bytes())
+			}
+		})
+	}
+}
@@ -7,5 +7,9 @@ require (
 	github.com/hashicorp/go-hclog v0.14.0
 	github.com/jaegertracing/jaeger v1.20.0
 	github.com/labstack/echo/v4 v4.1.17
+	github.com/mattn/go-sqlite3 v1.14.4
+	github.com/opentracing/opentracing-go v1.1.0
 	github.com/spf13/viper v1.6.2
+	google.golang.org/grpc v1.29.1
+	google.golang.org/protobuf v1.25.0
 )
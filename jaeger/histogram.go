@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"sort"
+)
+
+// histogramGrowth is the ratio of adjacent bin bounds, a percentile is off by at most 5%.
+const histogramGrowth = 1.1
+
+var logGrowth = math.Log(histogramGrowth)
+
+// durationHistogram counts durations in microseconds by logarithmic bin. Bin i holds
+// durations in [growth^i, growth^(i+1)), bin -1 holds zero durations.
+type durationHistogram map[int]uint64
+
+type histogramBinCount struct {
+	Bin   int    `json:"bin"`
+	Count uint64 `json:"count"`
+}
+
+// MarshalJSON encodes h as an array of bins in order rather than an object. When an
+// object is the last field of an array element, ChronoWave query results drop its
+// closing brace and the document no longer parses.
+func (h durationHistogram) MarshalJSON() ([]byte, error) {
+	bins := make([]histogramBinCount, 0, len(h))
+	for bin, n := range h {
+		bins = append(bins, histogramBinCount{Bin: bin, Count: n})
+	}
+	sort.Slice(bins, func(i, j int) bool { return bins[i].Bin < bins[j].Bin })
+
+	return json.Marshal(bins)
+}
+
+func (h *durationHistogram) UnmarshalJSON(data []byte) error {
+	var bins []histogramBinCount
+	if err := json.Unmarshal(data, &bins); err != nil {
+		return err
+	}
+
+	*h = make(durationHistogram, len(bins))
+	for _, b := range bins {
+		(*h)[b.Bin] += b.Count
+	}
+
+	return nil
+}
+
+func histogramBin(d int64) int {
+	if d <= 0 {
+		return -1
+	}
+	return int(math.Floor(math.Log(float64(d)) / logGrowth))
+}
+
+// add counts d, a nil histogram is allocated.
+func (h durationHistogram) add(d int64) durationHistogram {
+	if h == nil {
+		h = durationHistogram{}
+	}
+	h[histogramBin(d)]++
+	return h
+}
+
+// merge adds counts of other to h, a nil histogram is allocated.
+func (h durationHistogram) merge(other durationHistogram) durationHistogram {
+	if h == nil {
+		h = durationHistogram{}
+	}
+	for bin, n := range other {
+		h[bin] += n
+	}
+	return h
+}
+
+// subtract removes counts of other, which h has to hold, emptied bins are deleted.
+func (h durationHistogram) subtract(other durationHistogram) {
+	for bin, n := range other {
+		if h[bin] <= n {
+			delete(h, bin)
+			continue
+		}
+		h[bin] -= n
+	}
+}
+
+// percentile returns the duration at or below which p percent of durations fall,
+// as the geometric middle of its bin.
+func (h durationHistogram) percentile(p float64) int64 {
+	var total uint64
+	bins := make([]int, 0, len(h))
+	for bin, n := range h {
+		bins = append(bins, bin)
+		total += n
+	}
+	if total == 0 {
+		return 0
+	}
+	sort.Ints(bins)
+
+	rank := uint64(math.Ceil(p / 100 * float64(total)))
+	if rank == 0 {
+		rank = 1
+	}
+
+	var seen uint64
+	for _, bin := range bins {
+		seen += h[bin]
+		if seen >= rank {
+			if bin < 0 {
+				return 0
+			}
+			return int64(math.Round(math.Pow(histogramGrowth, float64(bin)+0.5)))
+		}
+	}
+
+	return 0
+}
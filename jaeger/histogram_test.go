@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestHistogramPercentile(t *testing.T) {
+	uniform := make([]int64, 1000)
+	for i := range uniform {
+		uniform[i] = int64(i + 1)
+	}
+
+	tests := []struct {
+		name      string
+		durations []int64
+		p         float64
+		want      int64
+	}{
+		{"empty", nil, 50, 0},
+		{"zero durations", []int64{0, 0, 0}, 99, 0},
+		{"single", []int64{1500}, 50, 1500},
+		{"single p99", []int64{1500}, 99, 1500},
+		{"p0 is the smallest", []int64{100, 2000, 30000}, 0, 100},
+		{"p100 is the largest", []int64{100, 2000, 30000}, 100, 30000},
+		{"median of three", []int64{30000, 100, 2000}, 50, 2000},
+		{"zero below median", []int64{0, 0, 0, 40, 40}, 50, 0},
+		{"uniform p50", uniform, 50, 500},
+		{"uniform p90", uniform, 90, 900},
+		{"uniform p99", uniform, 99, 990},
+		{"one outlier p99", append(make([]int64, 99), 1000000), 99, 0},
+		{"one outlier p100", append(make([]int64, 99), 1000000), 100, 1000000},
+		{"seconds", []int64{3600000000}, 50, 3600000000},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var h durationHistogram
+			for _, d := range tt.durations {
+				h = h.add(d)
+			}
+
+			got := h.percentile(tt.p)
+			if tt.want == 0 {
+				if got != 0 {
+					t.Errorf("percentile(%v) = %d, want 0", tt.p, got)
+				}
+				return
+			}
+			// the geometric middle of a bin is off by at most sqrt(histogramGrowth)
+			if off := math.Abs(float64(got-tt.want)) / float64(tt.want); off > math.Sqrt(histogramGrowth)-1 {
+				t.Errorf("percentile(%v) = %d, want %d within 5%%", tt.p, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHistogramMerge(t *testing.T) {
+	a := durationHistogram{}.add(10).add(10).add(1000)
+	b := durationHistogram{}.add(10).add(0)
+
+	sum := durationHistogram(nil).merge(a).merge(b)
+	want := durationHistogram{histogramBin(10): 3, histogramBin(1000): 1, -1: 1}
+	if !reflect.DeepEqual(sum, want) {
+		t.Errorf("merge() = %v, want %v", sum, want)
+	}
+
+	sum.subtract(b)
+	if !reflect.DeepEqual(sum, a) {
+		t.Errorf("subtract() = %v, want %v", sum, a)
+	}
+	sum.subtract(a)
+	if len(sum) != 0 {
+		t.Errorf("subtract() = %v, want empty", sum)
+	}
+}
+
+func TestHistogramJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		h    durationHistogram
+		json string
+	}{
+		{"empty", durationHistogram{}, `[]`},
+		{"sorted bins", durationHistogram{72: 2, -1: 1, 3: 5}, `[{"bin":-1,"count":1},{"bin":3,"count":5},{"bin":72,"count":2}]`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := json.Marshal(tt.h)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tt.json {
+				t.Errorf("Marshal() = %s, want %s", data, tt.json)
+			}
+
+			var got durationHistogram
+			if err = json.Unmarshal(data, &got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.h) {
+				t.Errorf("Unmarshal() = %v, want %v", got, tt.h)
+			}
+		})
+	}
+
+	// bins stored twice, e.g. by buckets flushed again, are summed
+	var got durationHistogram
+	if err := json.Unmarshal([]byte(`[{"bin":3,"count":1},{"bin":3,"count":2}]`), &got); err != nil {
+		t.Fatal(err)
+	}
+	if want := (durationHistogram{3: 3}); !reflect.DeepEqual(got, want) {
+		t.Errorf("Unmarshal() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/chronowave/chronowave/embed"
+	"github.com/jaegertracing/jaeger/plugin/storage/es/spanstore/dbmodel"
+)
+
+const (
+	// Elasticsearch span indices are named jaeger-span-<date>, or <prefix>-jaeger-span-<date>
+	esSpanIndex = "jaeger-span-"
+
+	// rejected documents logged one by one, the rest are only counted
+	maxLoggedRejects = 20
+
+	// spans indexed into a segment at once, as many as the wave indexes of its WAL
+	importBatch = 256
+)
+
+// importStats counts documents of an import, progress reads them while it runs.
+type importStats struct {
+	lines      int64 // non empty lines read
+	imported   int64
+	rejected   int64 // not a valid span
+	skipped    int64 // documents of other indices, e.g. jaeger-service, and bulk metadata
+	expired    int64 // spans past their retention ttl, which would be purged right away
+	duplicates int64 // spans read before in the same import
+}
+
+// spanImport reads Elasticsearch jaeger-span dumps into the wave in chronowave.dir.
+// The wave is opened by the process, so the plugin must not run on the same directory.
+// Spans are indexed into segments directly rather than through the WAL, which the
+// wave only indexes in the background.
+type spanImport struct {
+	dir       string
+	stream    *embed.WaveStream
+	catalog   *catalog
+	summaries *summaries
+	seen      map[spanKey]void // spans imported so far
+	retention *retentionPolicy
+	depBucket time.Duration
+	first     int64 // start time range of spans imported, microseconds since Unix epoch
+	last      int64
+	from      dbmodel.FromDomain
+	to        dbmodel.ToDomain
+	pending   []pendingSpan
+	batch     string // file pending spans are indexed from
+	rejects   io.Writer
+	stats     importStats
+}
+
+// runImport is the import command:
+//
+//	chronowave-jaeger -config plugin.yaml import [-rejects file] [-progress 10s] [-dot-replacement @] dump...
+//
+// A dump has a document per line, as written by elasticdump (with _index and _source),
+// as _bulk request bodies (an action line followed by the span), or as bare spans. Dumps
+// may be gzip compressed.
+func runImport(conf *conf, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	rejects := fs.String("rejects", "", "A file to write rejected documents to, one per line")
+	progress := fs.Duration("progress", 10*time.Second, "How often to report progress")
+	dot := fs.String("dot-replacement", "@", "The character replacing dots in tag keys of spans stored with es.tags-as-fields")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		return errors.New("no dump to import")
+	}
+
+	imp, err := newSpanImport(conf, *dot)
+	if err != nil {
+		return err
+	}
+
+	if *rejects != "" {
+		f, err := os.Create(*rejects)
+		if err != nil {
+			imp.Close()
+			return err
+		}
+		defer f.Close()
+		w := bufio.NewWriter(f)
+		defer w.Flush()
+		imp.rejects = w
+	}
+
+	done := make(chan void)
+	go func() {
+		ticker := time.NewTicker(*progress)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				imp.report("import progress")
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for _, file := range fs.Args() {
+		if err = imp.importFile(file); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = imp.build()
+	}
+	if err == nil {
+		err = imp.dependencies()
+	}
+	close(done)
+
+	imp.Close()
+	imp.report("import finished")
+	return err
+}
+
+func newSpanImport(conf *conf, dotReplacement string) (*spanImport, error) {
+	wave := embed.NewWave(conf.dir, timestamp, keys)
+	cat, err := openCatalog(conf.dir)
+	if err != nil {
+		wave.Close()
+		return nil, err
+	}
+	sum, err := openSummaries(conf.dir)
+	if err != nil {
+		cat.Close()
+		wave.Close()
+		return nil, err
+	}
+
+	imp := &spanImport{
+		dir:       conf.dir,
+		stream:    wave,
+		catalog:   cat,
+		summaries: sum,
+		seen:      map[spanKey]void{},
+		retention: &retentionPolicy{rules: conf.retention, ttl: conf.ttl, scope: conf.tagScope},
+		depBucket: conf.depBucket,
+		from:      dbmodel.FromDomain{},
+		to:        dbmodel.NewToDomain(dotReplacement),
+		pending:   make([]pendingSpan, 0, importBatch),
+		batch:     filepath.Join(conf.dir, ".import"),
+	}
+	return imp, nil
+}
+
+func (imp *spanImport) Close() {
+	os.Remove(imp.batch)
+	imp.catalog.Close()
+	imp.summaries.Close()
+	imp.stream.Close()
+}
+
+// build indexes pending spans into a segment, and fills the catalog and trace
+// summaries with them. RED metrics are only kept of spans written live.
+func (imp *spanImport) build() error {
+	if len(imp.pending) == 0 {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	for _, p := range imp.pending {
+		buf.Write(p.doc)
+	}
+	if err := ioutil.WriteFile(imp.batch, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	if err := embed.Build(imp.batch, timestamp, keys); err != nil {
+		return err
+	}
+	atomic.AddInt64(&imp.stats.imported, int64(len(imp.pending)))
+	for _, p := range imp.pending {
+		if imp.first == 0 || p.startTime < imp.first {
+			imp.first = p.startTime
+		}
+		if p.startTime > imp.last {
+			imp.last = p.startTime
+		}
+	}
+
+	// the segment was just created, the wave purges it by that time
+	if err := imp.catalog.observe(imp.pending, micros(time.Now())); err != nil {
+		logger.Error("failed to update service catalog", "error", err)
+	}
+	if err := imp.summaries.observe(imp.pending); err != nil {
+		logger.Error("failed to update trace summaries", "error", err)
+	}
+
+	imp.pending = imp.pending[:0]
+	return nil
+}
+
+// dependencies computes dependency buckets stored already again with the spans imported.
+func (imp *spanImport) dependencies() error {
+	if imp.first == 0 {
+		return nil
+	}
+	return recomputeDependencies(imp.stream, imp.dir, imp.depBucket, imp.first, imp.last)
+}
+
+func (imp *spanImport) report(msg string) {
+	s := &imp.stats
+	logger.Info(msg,
+		"lines", atomic.LoadInt64(&s.lines),
+		"imported", atomic.LoadInt64(&s.imported),
+		"rejected", atomic.LoadInt64(&s.rejected),
+		"skipped", atomic.LoadInt64(&s.skipped),
+		"expired", atomic.LoadInt64(&s.expired),
+		"duplicates", atomic.LoadInt64(&s.duplicates))
+}
+
+func (imp *spanImport) importFile(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var in io.Reader = r
+	if magic, _ := r.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+		defer gz.Close()
+		in = gz
+	}
+
+	logger.Info("importing", "file", file)
+
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	// index of the document following a _bulk action, nil if no action came before
+	var bulkIndex *string
+	for line := 1; scanner.Scan(); line++ {
+		data := bytes.TrimSpace(scanner.Bytes())
+		if len(data) == 0 {
+			continue
+		}
+		atomic.AddInt64(&imp.stats.lines, 1)
+
+		var doc map[string]json.RawMessage
+		if err = json.Unmarshal(data, &doc); err != nil {
+			imp.reject(file, line, data, err)
+			continue
+		}
+
+		index, source := "", data
+		switch {
+		case bulkIndex != nil:
+			index, bulkIndex = *bulkIndex, nil
+		case doc["_source"] != nil:
+			// elasticdump
+			var meta struct {
+				Index string `json:"_index"`
+			}
+			json.Unmarshal(data, &meta)
+			index, source = meta.Index, doc["_source"]
+		case len(doc) == 1 && (doc["index"] != nil || doc["create"] != nil):
+			// _bulk action, the span follows on the next line
+			var action map[string]struct {
+				Index string `json:"_index"`
+			}
+			json.Unmarshal(data, &action)
+			for _, a := range action {
+				bulkIndex = &a.Index
+			}
+			atomic.AddInt64(&imp.stats.skipped, 1)
+			continue
+		case len(doc) == 1 && (doc["delete"] != nil || doc["update"] != nil):
+			imp.reject(file, line, data, errors.New("only index and create bulk actions can be imported"))
+			continue
+		}
+
+		if index != "" && !strings.Contains(index, esSpanIndex) {
+			atomic.AddInt64(&imp.stats.skipped, 1)
+			continue
+		}
+
+		if err = imp.importSpan(source); err != nil {
+			imp.reject(file, line, source, err)
+			continue
+		}
+		if len(imp.pending) >= importBatch {
+			if err = imp.build(); err != nil {
+				return fmt.Errorf("%s: %v", file, err)
+			}
+		}
+	}
+
+	if err = scanner.Err(); err != nil {
+		return fmt.Errorf("%s: %v", file, err)
+	}
+	return nil
+}
+
+// importSpan writes a span as it's stored by WriteSpan, with its original timestamps.
+func (imp *spanImport) importSpan(source []byte) error {
+	var s dbmodel.Span
+	if err := json.Unmarshal(source, &s); err != nil {
+		return err
+	}
+	if s.TraceID == "" || s.SpanID == "" || s.StartTime == 0 {
+		return errors.New("not a span, traceID, spanID or startTime is missing")
+	}
+
+	// spans stored with tags as fields are converted to tag lists
+	span, err := imp.to.SpanToDomain(&s)
+	if err != nil {
+		return err
+	}
+
+	// the wave purges by when segments were written, so spans past their ttl would
+	// outlive it by up to the ttl again
+	stored := imp.from.FromDomainEmbedProcess(span)
+	if int64(stored.StartTime) < micros(time.Now().Add(-1*imp.retention.spanTTL(stored))) {
+		atomic.AddInt64(&imp.stats.expired, 1)
+		return nil
+	}
+
+	doc, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+
+	// overlapping dumps within one import however long it takes, a dump imported
+	// again later is collapsed when read
+	k := keyOf(span)
+	if _, ok := imp.seen[k]; ok {
+		atomic.AddInt64(&imp.stats.duplicates, 1)
+		return nil
+	}
+	imp.seen[k] = void{}
+
+	imp.pending = append(imp.pending, newPendingSpan(span, doc))
+	return nil
+}
+
+func (imp *spanImport) reject(file string, line int, data []byte, err error) {
+	n := atomic.AddInt64(&imp.stats.rejected, 1)
+	if n <= maxLoggedRejects {
+		logger.Warn("rejected document", "file", file, "line", line, "error", err)
+	} else if n == maxLoggedRejects+1 {
+		logger.Warn("more documents rejected, only counting them from now on")
+	}
+
+	if imp.rejects != nil {
+		imp.rejects.Write(append(append([]byte{}, data...), '\n'))
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chronowave/chronowave/embed"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/plugin/storage/es/spanstore/dbmodel"
+
+	"chronowave-jaeger/builder"
+)
+
+// TestImportReadBack imports more spans than fit a segment, and reads every span back
+// from the reopened wave.
+func TestImportReadBack(t *testing.T) {
+	dir, err := ioutil.TempDir("", "import")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	const traces, spansPerTrace = 30, 10
+	start := time.Now().Add(-time.Hour)
+	process := model.NewProcess("frontend", nil)
+
+	var dump []byte
+	want := map[string][]string{}
+	for i := 1; i <= traces; i++ {
+		traceID := model.NewTraceID(0, uint64(i))
+		for j := 1; j <= spansPerTrace; j++ {
+			span := &model.Span{
+				TraceID:       traceID,
+				SpanID:        model.NewSpanID(uint64(i*100 + j)),
+				OperationName: fmt.Sprintf("op-%d", j),
+				StartTime:     start.Add(time.Duration(i*spansPerTrace+j) * time.Second),
+				Duration:      time.Millisecond,
+				Process:       process,
+			}
+			doc, err := json.Marshal(dbmodel.FromDomain{}.FromDomainEmbedProcess(span))
+			if err != nil {
+				t.Fatal(err)
+			}
+			dump = append(append(dump, doc...), '\n')
+			want[traceID.String()] = append(want[traceID.String()], span.SpanID.String())
+		}
+	}
+
+	file := filepath.Join(dir, "span.json")
+	if err = ioutil.WriteFile(file, dump, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &conf{dir: filepath.Join(dir, "wave"), ttl: 24 * time.Hour, depBucket: time.Hour}
+	if err = runImport(c, []string{"-progress", "1h", file}); err != nil {
+		t.Fatalf("runImport() error = %v", err)
+	}
+
+	wave := embed.NewWave(c.dir, timestamp, keys)
+	defer wave.Close()
+
+	for traceID, spanIDs := range want {
+		qry, err := builder.Find("s").
+			Where(builder.Path("/traceID").Key(traceID), builder.Var("s", "/")).
+			Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		jdoc, err := wave.Query(context.Background(), qry)
+		if err != nil {
+			t.Fatalf("Query() error = %v", err)
+		}
+
+		var rs []struct{ S dbmodel.Span }
+		if err = json.Unmarshal(jdoc, &rs); err != nil {
+			t.Fatal(err)
+		}
+		got := make([]string, len(rs))
+		for i, r := range rs {
+			got[i] = string(r.S.SpanID)
+		}
+		sort.Strings(got)
+		sort.Strings(spanIDs)
+
+		if fmt.Sprint(got) != fmt.Sprint(spanIDs) {
+			t.Errorf("trace %s spans = %v, want %v", traceID, got, spanIDs)
+		}
+	}
+}
+
+func TestImportFile(t *testing.T) {
+	now := time.Now()
+	span := func(id uint64, service string, start time.Time) string {
+		doc, err := json.Marshal(dbmodel.FromDomain{}.FromDomainEmbedProcess(testSpan(1, id, service, start)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(doc)
+	}
+	frontend, redis := span(1, "frontend", now), span(2, "redis", now)
+
+	tests := []struct {
+		name     string
+		lines    []string
+		services []string // of spans imported, in order
+		stats    importStats
+	}{
+		{"bare spans", []string{frontend, "", redis}, []string{"frontend", "redis"}, importStats{lines: 2}},
+		{
+			"elasticdump",
+			[]string{
+				`{"_index":"jaeger-span-2020-09-13","_type":"_doc","_id":"1","_source":` + frontend + `}`,
+				`{"_index":"prod-jaeger-span-2020-09-13","_type":"_doc","_id":"2","_source":` + redis + `}`,
+				`{"_index":"jaeger-service-2020-09-13","_type":"_doc","_id":"3","_source":{"serviceName":"frontend","operationName":"op"}}`,
+			},
+			[]string{"frontend", "redis"},
+			importStats{lines: 3, skipped: 1},
+		},
+		{
+			"bulk index and create",
+			[]string{
+				`{"index":{"_index":"jaeger-span-2020-09-13","_id":"1"}}`, frontend,
+				`{"create":{"_index":"jaeger-span-2020-09-13"}}`, redis,
+			},
+			[]string{"frontend", "redis"},
+			importStats{lines: 4, skipped: 2},
+		},
+		{
+			"bulk of other index",
+			[]string{`{"index":{"_index":"jaeger-service-2020-09-13"}}`, `{"serviceName":"frontend","operationName":"op"}`, frontend},
+			[]string{"frontend"},
+			importStats{lines: 3, skipped: 2},
+		},
+		{
+			"bulk delete and update",
+			[]string{`{"delete":{"_index":"jaeger-span-2020-09-13","_id":"1"}}`, `{"update":{"_index":"jaeger-span-2020-09-13","_id":"2"}}`, frontend},
+			[]string{"frontend"},
+			importStats{lines: 3, rejected: 2},
+		},
+		{
+			"not spans",
+			[]string{`not json`, `{"traceID":"0000000000000001","spanID":"0000000000000001"}`, `[]`},
+			nil,
+			importStats{lines: 3, rejected: 3},
+		},
+		{"expired", []string{span(1, "frontend", now.Add(-25*time.Hour)), redis}, []string{"redis"}, importStats{lines: 2, expired: 1}},
+		{"duplicates", []string{frontend, redis, frontend}, []string{"frontend", "redis"}, importStats{lines: 3, duplicates: 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "import")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			file := filepath.Join(dir, "dump.json")
+			if err = ioutil.WriteFile(file, []byte(strings.Join(tt.lines, "\n")), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			// duplicates are found in the whole import, whatever the window
+			imp, err := newSpanImport(&conf{dir: filepath.Join(dir, "wave"), ttl: 24 * time.Hour, dedupWindow: 0, depBucket: time.Hour}, "@")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer imp.Close()
+
+			if err = imp.importFile(file); err != nil {
+				t.Fatalf("importFile() error = %v", err)
+			}
+
+			var services []string
+			for _, p := range imp.pending {
+				services = append(services, p.service)
+			}
+			if !reflect.DeepEqual(services, tt.services) {
+				t.Errorf("importFile() services = %v, want %v", services, tt.services)
+			}
+			if imp.stats != tt.stats {
+				t.Errorf("importFile() stats = %+v, want %+v", imp.stats, tt.stats)
+			}
+		})
+	}
+}
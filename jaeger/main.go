@@ -27,6 +27,10 @@ func main() {
 	flag.StringVar(&configPath, "config", "", "A path to the chronowave plugin's configuration file")
 	flag.Parse()
 
+	if flag.NArg() > 0 {
+		os.Exit(runCommand(configPath, flag.Arg(0), flag.Args()[1:]))
+	}
+
 	environ := os.Environ()
 	sort.Strings(environ)
 	for _, env := range environ {
@@ -37,9 +41,44 @@ func main() {
 	rider := newWaveRider(logger, conf)
 	defer rider.Close()
 
+	archive := newArchiveRider(logger, conf.archiveDir, conf.archiveTTL)
+	defer archive.Close()
+
+	plugin := &cwPlugin{
+		store:   rider,
+		archive: archive,
+	}
 	grpc.Serve(&shared.PluginServices{
-		Store: &cwPlugin{
-			store: rider,
-		},
+		Store:        plugin,
+		ArchiveStore: plugin,
+	})
+}
+
+// runCommand runs a command given on the command line instead of serving Jaeger, which
+// starts the plugin with -config only. It returns the exit code.
+func runCommand(configPath, name string, args []string) int {
+	// commands are run by hand, so they log what they do for people to read
+	logger = hclog.New(&hclog.LoggerOptions{
+		Name:  "chronowave",
+		Level: hclog.Info,
 	})
+
+	var err error
+	switch name {
+	case "import":
+		err = runImport(readConfig(configPath), args)
+	case "backup":
+		err = runBackup(readConfig(configPath), args)
+	case "restore":
+		err = runRestore(readConfig(configPath), args)
+	default:
+		logger.Error("unknown command, use import, backup or restore", "command", name)
+		return 2
+	}
+
+	if err != nil {
+		logger.Error(name+" failed", "error", err)
+		return 1
+	}
+	return 0
 }
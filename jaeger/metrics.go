@@ -0,0 +1,379 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chronowave/chronowave/embed"
+
+	"chronowave-jaeger/builder"
+)
+
+const (
+	metricsPath = "/metrics"
+
+	// flushed buckets are served from memory this long, until the wave has indexed them
+	metricsRecent = time.Minute
+)
+
+// promBuckets are upper bounds in seconds of the span duration histogram on /metrics,
+// the Prometheus client default.
+var promBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// metricsDoc is a bucket of RED metrics stored in the wave next to spans. Late spans of
+// a bucket already written go to another document of the same bucket, buckets are
+// summed when read.
+type metricsDoc struct {
+	StartTime int64         `json:"startTime"`
+	Metrics   metricsBucket `json:"metrics"`
+}
+
+type metricsBucket struct {
+	Bucket int64       `json:"bucket"` // bucket start, microseconds since Unix epoch
+	ID     string      `json:"id"`     // unique per document
+	Series []redSeries `json:"series"`
+}
+
+type redKey struct {
+	service   string
+	operation string
+	kind      string
+}
+
+// redSeries counts spans of a service, operation and span kind, with span durations
+// as a histogram, so buckets can be summed into percentiles.
+type redSeries struct {
+	Service   string            `json:"service"`
+	Operation string            `json:"operation"`
+	Kind      string            `json:"kind"`
+	Calls     uint64            `json:"calls"`
+	Errors    uint64            `json:"errors"`
+	Durations durationHistogram `json:"durations,omitempty"`
+}
+
+func (s *redSeries) key() redKey {
+	return redKey{service: s.Service, operation: s.Operation, kind: s.Kind}
+}
+
+func (s *redSeries) merge(other *redSeries) {
+	s.Calls += other.Calls
+	s.Errors += other.Errors
+	s.Durations = s.Durations.merge(other.Durations)
+}
+
+// subtract removes a series merged before.
+func (s *redSeries) subtract(other *redSeries) {
+	s.Calls -= other.Calls
+	s.Errors -= other.Errors
+	s.Durations.subtract(other.Durations)
+}
+
+// promSeries is a series of /metrics, counted since the plugin started.
+type promSeries struct {
+	calls   uint64
+	errors  uint64
+	buckets []uint64 // per promBuckets, not cumulative
+	sum     float64  // seconds
+}
+
+// redMetrics aggregates rate, errors and duration of written spans per service,
+// operation and span kind. Buckets by span start time are stored in the wave once
+// they are a bucket old, counters since start are exposed to Prometheus.
+type redMetrics struct {
+	stream *embed.WaveStream
+	index  *waveIndex
+	size   int64 // microseconds
+	lock   sync.Mutex
+	open   map[int64]map[redKey]*redSeries
+	recent []recentBucket
+	totals map[redKey]*promSeries
+	seq    uint64
+	done   chan void
+	closed sync.WaitGroup
+}
+
+type recentBucket struct {
+	bucket  metricsBucket
+	written time.Time
+}
+
+func newRedMetrics(stream *embed.WaveStream, index *waveIndex, size time.Duration) *redMetrics {
+	m := &redMetrics{
+		stream: stream,
+		index:  index,
+		size:   micros64(size),
+		open:   map[int64]map[redKey]*redSeries{},
+		totals: map[redKey]*promSeries{},
+		done:   make(chan void),
+	}
+
+	m.closed.Add(1)
+	go m.loop(size)
+
+	return m
+}
+
+// Close writes all open buckets.
+func (m *redMetrics) Close() {
+	close(m.done)
+	m.closed.Wait()
+}
+
+func (m *redMetrics) floor(ts int64) int64 {
+	return ts - ts%m.size
+}
+
+// observe counts a batch written to the wave.
+func (m *redMetrics) observe(batch []pendingSpan) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for i := range batch {
+		s := &batch[i]
+		k := redKey{service: s.service, operation: s.op, kind: s.kind}
+
+		b := m.floor(s.startTime)
+		bucket, ok := m.open[b]
+		if !ok {
+			bucket = map[redKey]*redSeries{}
+			m.open[b] = bucket
+		}
+		series, ok := bucket[k]
+		if !ok {
+			series = &redSeries{Service: k.service, Operation: k.operation, Kind: k.kind}
+			bucket[k] = series
+		}
+		series.Calls++
+		series.Durations = series.Durations.add(s.duration)
+
+		total, ok := m.totals[k]
+		if !ok {
+			total = &promSeries{buckets: make([]uint64, len(promBuckets))}
+			m.totals[k] = total
+		}
+		total.calls++
+		seconds := float64(s.duration) / float64(time.Second/time.Microsecond)
+		total.sum += seconds
+		if le := sort.SearchFloat64s(promBuckets, seconds); le < len(promBuckets) {
+			total.buckets[le]++
+		}
+
+		if s.failed {
+			series.Errors++
+			total.errors++
+		}
+	}
+}
+
+func (m *redMetrics) loop(size time.Duration) {
+	defer m.closed.Done()
+
+	ticker := time.NewTicker(size)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.flush(micros(time.Now()) - m.size)
+		case <-m.done:
+			m.flush(micros(time.Now()) + m.size)
+			return
+		}
+	}
+}
+
+// flush writes open buckets ended before until.
+func (m *redMetrics) flush(until int64) {
+	m.lock.Lock()
+	var buckets []metricsBucket
+	for b, bucket := range m.open {
+		if b+m.size > until {
+			continue
+		}
+		m.seq++
+		mb := metricsBucket{Bucket: b, ID: fmt.Sprintf("%x-%x", time.Now().UnixNano(), m.seq)}
+		for _, s := range bucket {
+			mb.Series = append(mb.Series, *s)
+		}
+		buckets = append(buckets, mb)
+		delete(m.open, b)
+	}
+
+	now := time.Now()
+	recent := m.recent[:0]
+	for _, r := range m.recent {
+		if now.Sub(r.written) < metricsRecent {
+			recent = append(recent, r)
+		}
+	}
+	for _, b := range buckets {
+		recent = append(recent, recentBucket{bucket: b, written: now})
+	}
+	m.recent = recent
+	m.lock.Unlock()
+
+	for _, b := range buckets {
+		data, err := json.Marshal(metricsDoc{StartTime: b.Bucket, Metrics: b})
+		if err != nil {
+			logger.Error("failed to encode metrics bucket", "bucket", b.Bucket, "error", err)
+			continue
+		}
+		if err = m.stream.OnNewDocument(data); err != nil {
+			logger.Error("failed to write metrics bucket", "bucket", b.Bucket, "error", err)
+		}
+	}
+}
+
+// stored returns metrics documents of buckets starting within [from, to].
+func (m *redMetrics) stored(ctx context.Context, from, to int64) ([]metricsBucket, error) {
+	qry, err := builder.Find("m").
+		Where(
+			m.index.frame(from, to),
+			builder.Var("m", metricsPath),
+			// unfiltered variables also match spans as null
+			builder.Path(metricsPath+"/bucket").Exist(),
+			builder.Path(timestamp).Timeframe(from, to),
+		).
+		Build()
+	if err != nil {
+		return nil, err
+	}
+
+	jdoc, err := m.stream.Query(ctx, qry)
+	if err != nil {
+		return nil, err
+	}
+
+	var rs []struct{ M metricsBucket }
+	if err = json.Unmarshal(jdoc, &rs); err != nil {
+		return nil, err
+	}
+
+	buckets := make([]metricsBucket, len(rs))
+	for i, r := range rs {
+		buckets[i] = r.M
+	}
+	return buckets, nil
+}
+
+// buckets returns RED series per bucket starting within [from, to], stored ones
+// summed with those not yet indexed or written.
+func (m *redMetrics) buckets(ctx context.Context, from, to int64) (map[int64]map[redKey]*redSeries, error) {
+	stored, err := m.stored(ctx, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	sums := map[int64]map[redKey]*redSeries{}
+	add := func(b int64, s *redSeries) {
+		if b < from || b > to {
+			return
+		}
+		bucket, ok := sums[b]
+		if !ok {
+			bucket = map[redKey]*redSeries{}
+			sums[b] = bucket
+		}
+		if cur, ok := bucket[s.key()]; ok {
+			cur.merge(s)
+			return
+		}
+		sum := &redSeries{Service: s.Service, Operation: s.Operation, Kind: s.Kind}
+		sum.merge(s)
+		bucket[s.key()] = sum
+	}
+
+	seen := make(map[string]bool, len(stored))
+	for _, b := range stored {
+		seen[b.ID] = true
+		for i := range b.Series {
+			add(b.Bucket, &b.Series[i])
+		}
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, r := range m.recent {
+		if seen[r.bucket.ID] {
+			continue
+		}
+		for i := range r.bucket.Series {
+			add(r.bucket.Bucket, &r.bucket.Series[i])
+		}
+	}
+	for b, bucket := range m.open {
+		for _, s := range bucket {
+			add(b, s)
+		}
+	}
+
+	return sums, nil
+}
+
+// writeProm writes counters since start in Prometheus text exposition format.
+func (m *redMetrics) writeProm(w io.Writer) error {
+	m.lock.Lock()
+	keys := make([]redKey, 0, len(m.totals))
+	totals := make(map[redKey]promSeries, len(m.totals))
+	for k, v := range m.totals {
+		keys = append(keys, k)
+		totals[k] = promSeries{calls: v.calls, errors: v.errors, buckets: append([]uint64(nil), v.buckets...), sum: v.sum}
+	}
+	m.lock.Unlock()
+
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.service != b.service {
+			return a.service < b.service
+		}
+		if a.operation != b.operation {
+			return a.operation < b.operation
+		}
+		return a.kind < b.kind
+	})
+
+	var sb strings.Builder
+	sb.WriteString("# HELP chronowave_spans_total Spans written by service, operation and span kind.\n")
+	sb.WriteString("# TYPE chronowave_spans_total counter\n")
+	for _, k := range keys {
+		fmt.Fprintf(&sb, "chronowave_spans_total{%s} %d\n", k.labels(), totals[k].calls)
+	}
+
+	sb.WriteString("# HELP chronowave_span_errors_total Spans written with tag error=true by service, operation and span kind.\n")
+	sb.WriteString("# TYPE chronowave_span_errors_total counter\n")
+	for _, k := range keys {
+		fmt.Fprintf(&sb, "chronowave_span_errors_total{%s} %d\n", k.labels(), totals[k].errors)
+	}
+
+	sb.WriteString("# HELP chronowave_span_duration_seconds Duration of spans written by service, operation and span kind.\n")
+	sb.WriteString("# TYPE chronowave_span_duration_seconds histogram\n")
+	for _, k := range keys {
+		t, labels := totals[k], k.labels()
+		var n uint64
+		for i, le := range promBuckets {
+			n += t.buckets[i]
+			fmt.Fprintf(&sb, "chronowave_span_duration_seconds_bucket{%s,le=\"%s\"} %d\n", labels, strconv.FormatFloat(le, 'g', -1, 64), n)
+		}
+		fmt.Fprintf(&sb, "chronowave_span_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, t.calls)
+		fmt.Fprintf(&sb, "chronowave_span_duration_seconds_sum{%s} %s\n", labels, strconv.FormatFloat(t.sum, 'g', -1, 64))
+		fmt.Fprintf(&sb, "chronowave_span_duration_seconds_count{%s} %d\n", labels, t.calls)
+	}
+
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+var promEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (k redKey) labels() string {
+	return `service="` + promEscaper.Replace(k.service) +
+		`",operation="` + promEscaper.Replace(k.operation) +
+		`",span_kind="` + promEscaper.Replace(k.kind) + `"`
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// testRedMetrics returns RED metrics of size buckets reading the wave of wr, without
+// the loop writing them.
+func testRedMetrics(wr *WaveRider, size time.Duration) *redMetrics {
+	return &redMetrics{
+		stream: wr.stream,
+		index:  wr.index,
+		size:   micros64(size),
+		open:   map[int64]map[redKey]*redSeries{},
+		totals: map[redKey]*promSeries{},
+	}
+}
+
+// testCalls returns n spans of service and operation started at start.
+func testCalls(n int, service, op, kind string, start time.Time, duration time.Duration, failed bool) []pendingSpan {
+	batch := make([]pendingSpan, n)
+	for i := range batch {
+		batch[i] = pendingSpan{
+			service:   service,
+			op:        op,
+			kind:      kind,
+			startTime: micros(start),
+			duration:  micros64(duration),
+			failed:    failed,
+		}
+	}
+	return batch
+}
+
+func TestRedMetricsBuckets(t *testing.T) {
+	wr, close := testWaveRider(t)
+	defer close()
+	m := testRedMetrics(wr, time.Minute)
+
+	base := time.Unix(1599998400, 0)
+	get := redKey{service: "frontend", operation: "GET /", kind: "server"}
+	m.observe(testCalls(1, "frontend", "GET /", "server", base.Add(10*time.Second), time.Millisecond, false))
+	m.observe(testCalls(2, "frontend", "GET /", "server", base.Add(70*time.Second), time.Millisecond, true))
+	// the first bucket is flushed and indexed, the second only flushed
+	m.flush(micros(base.Add(2 * time.Minute)))
+	var docs [][]byte
+	for _, r := range m.recent {
+		if r.bucket.Bucket != micros(base) {
+			continue
+		}
+		data, err := json.Marshal(metricsDoc{StartTime: r.bucket.Bucket, Metrics: r.bucket})
+		if err != nil {
+			t.Fatal(err)
+		}
+		docs = append(docs, data)
+	}
+	if err := testSegment(wr.dir, docs...); err != nil {
+		t.Fatal(err)
+	}
+	// a late span of the first bucket and one of the open third
+	m.observe(testCalls(1, "frontend", "GET /", "server", base.Add(20*time.Second), time.Millisecond, false))
+	m.observe(testCalls(3, "frontend", "GET /", "server", base.Add(130*time.Second), time.Millisecond, false))
+
+	tests := []struct {
+		name     string
+		from, to time.Time
+		want     map[int64][2]uint64 // calls and errors by bucket
+	}{
+		{
+			"stored, flushed and open",
+			base, base.Add(3 * time.Minute),
+			map[int64][2]uint64{micros(base): {2, 0}, micros(base.Add(time.Minute)): {2, 2}, micros(base.Add(2 * time.Minute)): {3, 0}},
+		},
+		{"buckets starting within", base.Add(time.Minute), base.Add(time.Minute), map[int64][2]uint64{micros(base.Add(time.Minute)): {2, 2}}},
+		{"none", base.Add(-time.Hour), base.Add(-time.Minute), map[int64][2]uint64{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buckets, err := m.buckets(context.Background(), micros(tt.from), micros(tt.to))
+			if err != nil {
+				t.Fatalf("buckets() error = %v", err)
+			}
+			got := map[int64][2]uint64{}
+			for b, bucket := range buckets {
+				s := bucket[get]
+				got[b] = [2]uint64{s.Calls, s.Errors}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("buckets() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedMetricsProm(t *testing.T) {
+	m := testRedMetrics(&WaveRider{}, time.Minute)
+	start := time.Unix(1599998400, 0)
+	m.observe(testCalls(1, "frontend", "GET /", "server", start, 3*time.Millisecond, false))
+	m.observe(testCalls(2, "frontend", "GET /", "server", start, 200*time.Millisecond, true))
+	m.observe(testCalls(1, "frontend", "GET /", "server", start, time.Minute, false))
+
+	var sb strings.Builder
+	if err := m.writeProm(&sb); err != nil {
+		t.Fatal(err)
+	}
+	labels := `service="frontend",operation="GET /",span_kind="server"`
+	for _, want := range []string{
+		`chronowave_spans_total{` + labels + `} 4`,
+		`chronowave_span_errors_total{` + labels + `} 2`,
+		// buckets are cumulative, a minute is only counted in +Inf
+		`chronowave_span_duration_seconds_bucket{` + labels + `,le="0.005"} 1`,
+		`chronowave_span_duration_seconds_bucket{` + labels + `,le="0.1"} 1`,
+		`chronowave_span_duration_seconds_bucket{` + labels + `,le="0.25"} 3`,
+		`chronowave_span_duration_seconds_bucket{` + labels + `,le="10"} 3`,
+		`chronowave_span_duration_seconds_bucket{` + labels + `,le="+Inf"} 4`,
+		`chronowave_span_duration_seconds_sum{` + labels + `} 60.403`,
+		`chronowave_span_duration_seconds_count{` + labels + `} 4`,
+	} {
+		if !strings.Contains(sb.String(), want+"\n") {
+			t.Errorf("writeProm() has no line %s", want)
+		}
+	}
+}
+
+func TestListRedMetrics(t *testing.T) {
+	wr, close := testWaveRider(t)
+	defer close()
+	wr.metrics = testRedMetrics(wr, time.Minute)
+
+	base := time.Unix(1599998400, 0)
+	ms := base.UnixNano() / int64(time.Millisecond)
+	for i, n := range []int{1, 2, 3} {
+		start := base.Add(time.Duration(i) * time.Minute)
+		wr.metrics.observe(testCalls(n, "frontend", "GET /", "server", start, time.Millisecond, i == 1))
+		wr.metrics.observe(testCalls(1, "redis", "GET", "client", start, time.Millisecond, false))
+	}
+
+	from, to := "from="+strconv.FormatInt(ms, 10)+"&", "&to="+strconv.FormatInt(ms+180000, 10)
+	type row struct {
+		time          int64 // minutes after base
+		service       string
+		calls, errors uint64
+		rate          float64
+	}
+	tests := []struct {
+		name  string
+		query string
+		want  []row
+	}{
+		{
+			"a step per bucket",
+			"service=frontend" + to,
+			[]row{{0, "frontend", 1, 0, 1.0 / 60}, {1, "frontend", 2, 2, 2.0 / 60}, {2, "frontend", 3, 0, 3.0 / 60}},
+		},
+		{
+			"step rounded up to buckets",
+			"service=frontend&step=90000" + to,
+			[]row{{0, "frontend", 3, 2, 3.0 / 120}, {2, "frontend", 3, 0, 3.0 / 120}},
+		},
+		{"step shorter than a bucket", "kind=client&step=1000" + to, []row{{0, "redis", 1, 0, 1.0 / 60}, {1, "redis", 1, 0, 1.0 / 60}, {2, "redis", 1, 0, 1.0 / 60}}},
+		{"to", "operation=GET&to=" + strconv.FormatInt(ms+60000, 10), []row{{0, "redis", 1, 0, 1.0 / 60}, {1, "redis", 1, 0, 1.0 / 60}}},
+	}
+
+	e := echo.New()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/metrics/red?"+from+tt.query, nil)
+			rec := httptest.NewRecorder()
+			if err := wr.listRedMetrics(e.NewContext(req, rec)); err != nil {
+				t.Fatalf("listRedMetrics() error = %v", err)
+			}
+
+			var points []redPoint
+			if err := json.Unmarshal(rec.Body.Bytes(), &points); err != nil {
+				t.Fatal(err)
+			}
+			got := make([]row, len(points))
+			for i, p := range points {
+				got[i] = row{(p.Time - ms) / 60000, p.Service, p.Calls, p.Errors, p.Rate}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("listRedMetrics() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
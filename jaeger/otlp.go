@@ -0,0 +1,712 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"github.com/labstack/echo/v4"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	_ "google.golang.org/grpc/encoding/gzip" // OTLP exporters may compress requests
+	"google.golang.org/grpc/status"
+)
+
+const (
+	otlpTracesPath = "/v1/traces"
+	mimeProtobuf   = "application/x-protobuf"
+
+	// service name of spans whose resource has no service.name, as the OpenTelemetry SDKs don't allow it
+	otlpNoService = "unknown_service"
+)
+
+var (
+	otlpSpanKinds   = []string{"SPAN_KIND_UNSPECIFIED", "SPAN_KIND_INTERNAL", "SPAN_KIND_SERVER", "SPAN_KIND_CLIENT", "SPAN_KIND_PRODUCER", "SPAN_KIND_CONSUMER"}
+	otlpStatusCodes = []string{"STATUS_CODE_UNSET", "STATUS_CODE_OK", "STATUS_CODE_ERROR"}
+
+	// span.kind tag values by OTLP span kind
+	otlpKindTags = []string{"", "internal", "server", "client", "producer", "consumer"}
+)
+
+const (
+	otlpStatusUnset = iota
+	otlpStatusOK
+	otlpStatusError
+)
+
+// otlpTraces is an OTLP ExportTraceServiceRequest, in the layout of OTLP/JSON. The
+// plugin doesn't depend on generated OTLP protos, OTLP/protobuf is decoded into it
+// field by field, see otlpwire.go.
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans,omitempty"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans,omitempty"`
+	// before OTLP v0.19
+	InstrumentationLibrarySpans []otlpScopeSpans `json:"instrumentationLibrarySpans,omitempty"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope `json:"scope"`
+	// before OTLP v0.19
+	InstrumentationLibrary *otlpScope `json:"instrumentationLibrary,omitempty"`
+	Spans                  []otlpSpan `json:"spans,omitempty"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name,omitempty"`
+	Version string `json:"version,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           otlpID         `json:"traceId"`
+	SpanID            otlpID         `json:"spanId"`
+	TraceState        string         `json:"traceState,omitempty"`
+	ParentSpanID      otlpID         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              otlpSpanKind   `json:"kind,omitempty"`
+	StartTimeUnixNano otlpUint64     `json:"startTimeUnixNano"`
+	EndTimeUnixNano   otlpUint64     `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Events            []otlpEvent    `json:"events,omitempty"`
+	Links             []otlpLink     `json:"links,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpEvent struct {
+	TimeUnixNano otlpUint64     `json:"timeUnixNano"`
+	Name         string         `json:"name"`
+	Attributes   []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpLink struct {
+	TraceID    otlpID         `json:"traceId"`
+	SpanID     otlpID         `json:"spanId"`
+	TraceState string         `json:"traceState,omitempty"`
+	Attributes []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpStatus struct {
+	Message string         `json:"message,omitempty"`
+	Code    otlpStatusCode `json:"code,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+// otlpAnyValue has one of its values set.
+type otlpAnyValue struct {
+	StringValue *string        `json:"stringValue,omitempty"`
+	BoolValue   *bool          `json:"boolValue,omitempty"`
+	IntValue    *otlpInt64     `json:"intValue,omitempty"`
+	DoubleValue *float64       `json:"doubleValue,omitempty"`
+	ArrayValue  *otlpAnyValues `json:"arrayValue,omitempty"`
+	KvlistValue *otlpKeyValues `json:"kvlistValue,omitempty"`
+	BytesValue  []byte         `json:"bytesValue,omitempty"`
+}
+
+type otlpAnyValues struct {
+	Values []otlpAnyValue `json:"values,omitempty"`
+}
+
+type otlpKeyValues struct {
+	Values []otlpKeyValue `json:"values,omitempty"`
+}
+
+// otlpID is a trace or span ID, hex encoded in OTLP/JSON. Base64 as in the protobuf
+// JSON mapping is accepted too, some early exporters sent it.
+type otlpID []byte
+
+func (id *otlpID) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err != nil {
+		return err
+	}
+
+	b, err := hex.DecodeString(text)
+	if err != nil {
+		if b, err = base64.StdEncoding.DecodeString(text); err != nil {
+			return fmt.Errorf("invalid OTLP ID %q", text)
+		}
+	}
+	*id = b
+	return nil
+}
+
+func (id otlpID) MarshalJSON() ([]byte, error) {
+	return json.Marshal(hex.EncodeToString(id))
+}
+
+// otlpUint64 and otlpInt64 are 64 bit integers, given as JSON strings or numbers.
+type otlpUint64 uint64
+
+func (u *otlpUint64) UnmarshalJSON(data []byte) error {
+	v, err := strconv.ParseUint(strings.Trim(string(data), `"`), 10, 64)
+	*u = otlpUint64(v)
+	return err
+}
+
+func (u otlpUint64) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + strconv.FormatUint(uint64(u), 10) + `"`), nil
+}
+
+type otlpInt64 int64
+
+func (i *otlpInt64) UnmarshalJSON(data []byte) error {
+	v, err := strconv.ParseInt(strings.Trim(string(data), `"`), 10, 64)
+	*i = otlpInt64(v)
+	return err
+}
+
+func (i otlpInt64) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + strconv.FormatInt(int64(i), 10) + `"`), nil
+}
+
+// otlpSpanKind and otlpStatusCode are enums, given as JSON integers or names.
+type otlpSpanKind int32
+
+func (k *otlpSpanKind) UnmarshalJSON(data []byte) error {
+	v, err := unmarshalOTLPEnum(data, otlpSpanKinds)
+	*k = otlpSpanKind(v)
+	return err
+}
+
+type otlpStatusCode int32
+
+func (c *otlpStatusCode) UnmarshalJSON(data []byte) error {
+	v, err := unmarshalOTLPEnum(data, otlpStatusCodes)
+	*c = otlpStatusCode(v)
+	return err
+}
+
+func unmarshalOTLPEnum(data []byte, names []string) (int32, error) {
+	if len(data) > 0 && data[0] == '"' {
+		var name string
+		if err := json.Unmarshal(data, &name); err != nil {
+			return 0, err
+		}
+		for i, n := range names {
+			if n == name {
+				return int32(i), nil
+			}
+		}
+		return 0, fmt.Errorf("unknown OTLP enum value %q", name)
+	}
+
+	v, err := strconv.ParseInt(string(data), 10, 32)
+	return int32(v), err
+}
+
+// toDomain converts spans of an export, it returns how many spans were rejected as
+// invalid and why the first was.
+func (t *otlpTraces) toDomain() ([]*model.Span, int64, string) {
+	var (
+		spans    []*model.Span
+		rejected int64
+		reason   string
+	)
+	for i := range t.ResourceSpans {
+		rs := &t.ResourceSpans[i]
+		process := rs.Resource.toDomain()
+
+		scopes := append(rs.ScopeSpans, rs.InstrumentationLibrarySpans...)
+		for j := range scopes {
+			scope := scopes[j].Scope
+			if scope.Name == "" && scopes[j].InstrumentationLibrary != nil {
+				scope = *scopes[j].InstrumentationLibrary
+			}
+
+			for k := range scopes[j].Spans {
+				span, err := scopes[j].Spans[k].toDomain(process, scope)
+				if err != nil {
+					if rejected == 0 {
+						reason = err.Error()
+					}
+					rejected++
+					continue
+				}
+				spans = append(spans, span)
+			}
+		}
+	}
+	return spans, rejected, reason
+}
+
+// toDomain returns the process of spans of a resource, named by its service.name attribute.
+func (r *otlpResource) toDomain() *model.Process {
+	service := otlpNoService
+	tags := make([]model.KeyValue, 0, len(r.Attributes))
+	for _, kv := range r.Attributes {
+		if kv.Key == "service.name" && kv.Value.StringValue != nil {
+			service = *kv.Value.StringValue
+			continue
+		}
+		tags = append(tags, kv.toDomain())
+	}
+	return model.NewProcess(service, tags)
+}
+
+func (s *otlpSpan) toDomain(process *model.Process, scope otlpScope) (*model.Span, error) {
+	// an unset start time would be stored at the Unix epoch, purged at once and
+	// dropped from every search
+	if s.StartTimeUnixNano == 0 {
+		return nil, errors.New("invalid OTLP span, startTimeUnixNano is missing")
+	}
+
+	traceID, err := otlpTraceID(s.TraceID)
+	if err != nil {
+		return nil, err
+	}
+	spanID, err := otlpSpanID(s.SpanID)
+	if err != nil {
+		return nil, err
+	}
+
+	var refs []model.SpanRef
+	if len(s.ParentSpanID) > 0 {
+		parent, err := otlpSpanID(s.ParentSpanID)
+		if err != nil {
+			return nil, err
+		}
+		refs = append(refs, model.NewChildOfRef(traceID, parent))
+	}
+	for _, l := range s.Links {
+		ltid, err := otlpTraceID(l.TraceID)
+		if err != nil {
+			return nil, err
+		}
+		lsid, err := otlpSpanID(l.SpanID)
+		if err != nil {
+			return nil, err
+		}
+		refs = append(refs, model.NewFollowsFromRef(ltid, lsid))
+	}
+
+	tags := make([]model.KeyValue, 0, len(s.Attributes)+6)
+	for _, kv := range s.Attributes {
+		tags = append(tags, kv.toDomain())
+	}
+	if s.Kind > 0 && int(s.Kind) < len(otlpKindTags) {
+		tags = append(tags, model.String("span.kind", otlpKindTags[s.Kind]))
+	}
+	switch s.Status.Code {
+	case otlpStatusOK:
+		tags = append(tags, model.String("otel.status_code", "OK"))
+	case otlpStatusError:
+		tags = append(tags, model.Bool("error", true), model.String("otel.status_code", "ERROR"))
+	}
+	if s.Status.Message != "" {
+		tags = append(tags, model.String("otel.status_description", s.Status.Message))
+	}
+	if scope.Name != "" {
+		tags = append(tags, model.String("otel.scope.name", scope.Name))
+	}
+	if scope.Version != "" {
+		tags = append(tags, model.String("otel.scope.version", scope.Version))
+	}
+	if s.TraceState != "" {
+		tags = append(tags, model.String("w3c.tracestate", s.TraceState))
+	}
+
+	logs := make([]model.Log, len(s.Events))
+	for i, e := range s.Events {
+		fields := make([]model.KeyValue, 0, len(e.Attributes)+1)
+		if e.Name != "" {
+			fields = append(fields, model.String("event", e.Name))
+		}
+		for _, kv := range e.Attributes {
+			fields = append(fields, kv.toDomain())
+		}
+		logs[i] = model.Log{Timestamp: otlpTime(e.TimeUnixNano), Fields: fields}
+	}
+
+	var duration time.Duration
+	if s.EndTimeUnixNano > s.StartTimeUnixNano {
+		duration = time.Duration(s.EndTimeUnixNano - s.StartTimeUnixNano)
+	}
+
+	return &model.Span{
+		TraceID:       traceID,
+		SpanID:        spanID,
+		OperationName: s.Name,
+		References:    refs,
+		Flags:         model.SampledFlag,
+		StartTime:     otlpTime(s.StartTimeUnixNano),
+		Duration:      duration,
+		Tags:          tags,
+		Logs:          logs,
+		Process:       process,
+	}, nil
+}
+
+func otlpTraceID(id otlpID) (model.TraceID, error) {
+	if len(id) != 16 {
+		return model.TraceID{}, fmt.Errorf("invalid OTLP trace ID %x, want 16 bytes", []byte(id))
+	}
+	tid, err := model.TraceIDFromBytes(id)
+	if err == nil && tid.High == 0 && tid.Low == 0 {
+		err = errors.New("invalid OTLP trace ID, all zero")
+	}
+	return tid, err
+}
+
+func otlpSpanID(id otlpID) (model.SpanID, error) {
+	sid, err := model.SpanIDFromBytes(id)
+	if err != nil {
+		return 0, fmt.Errorf("invalid OTLP span ID %x, want 8 bytes", []byte(id))
+	}
+	if sid == 0 {
+		return 0, errors.New("invalid OTLP span ID, all zero")
+	}
+	return sid, nil
+}
+
+func otlpTime(nanos otlpUint64) time.Time {
+	return time.Unix(0, int64(nanos)).UTC()
+}
+
+// toDomain converts an attribute to a tag, arrays and maps are kept as JSON strings.
+func (kv *otlpKeyValue) toDomain() model.KeyValue {
+	v := &kv.Value
+	switch {
+	case v.StringValue != nil:
+		return model.String(kv.Key, *v.StringValue)
+	case v.BoolValue != nil:
+		return model.Bool(kv.Key, *v.BoolValue)
+	case v.IntValue != nil:
+		return model.Int64(kv.Key, int64(*v.IntValue))
+	case v.DoubleValue != nil:
+		return model.Float64(kv.Key, *v.DoubleValue)
+	case v.BytesValue != nil:
+		return model.Binary(kv.Key, v.BytesValue)
+	case v.ArrayValue != nil, v.KvlistValue != nil:
+		text, _ := json.Marshal(v.plain())
+		return model.String(kv.Key, string(text))
+	default:
+		return model.String(kv.Key, "")
+	}
+}
+
+// plain returns the value as plain Go values for JSON.
+func (v *otlpAnyValue) plain() interface{} {
+	switch {
+	case v.StringValue != nil:
+		return *v.StringValue
+	case v.BoolValue != nil:
+		return *v.BoolValue
+	case v.IntValue != nil:
+		return int64(*v.IntValue)
+	case v.DoubleValue != nil:
+		return *v.DoubleValue
+	case v.BytesValue != nil:
+		return v.BytesValue
+	case v.ArrayValue != nil:
+		values := make([]interface{}, len(v.ArrayValue.Values))
+		for i := range v.ArrayValue.Values {
+			values[i] = v.ArrayValue.Values[i].plain()
+		}
+		return values
+	case v.KvlistValue != nil:
+		values := make(map[string]interface{}, len(v.KvlistValue.Values))
+		for i := range v.KvlistValue.Values {
+			values[v.KvlistValue.Values[i].Key] = v.KvlistValue.Values[i].Value.plain()
+		}
+		return values
+	default:
+		return nil
+	}
+}
+
+// otlpFromDomain converts a trace to an export, the inverse of toDomain. Spans are
+// grouped by process into resources, and by the otel.scope tags into scopes.
+func otlpFromDomain(trace *model.Trace) *otlpTraces {
+	t := &otlpTraces{}
+	resources := map[uint64]int{}
+	scopes := map[uint64]map[otlpScope]int{}
+	for _, span := range trace.Spans {
+		s, scope := otlpSpanFromDomain(span)
+
+		pid, _ := model.HashCode(span.Process)
+		ri, ok := resources[pid]
+		if !ok {
+			ri = len(t.ResourceSpans)
+			resources[pid] = ri
+			scopes[pid] = map[otlpScope]int{}
+			t.ResourceSpans = append(t.ResourceSpans, otlpResourceSpans{Resource: otlpResourceFromDomain(span.Process)})
+		}
+
+		rs := &t.ResourceSpans[ri]
+		si, ok := scopes[pid][scope]
+		if !ok {
+			si = len(rs.ScopeSpans)
+			scopes[pid][scope] = si
+			rs.ScopeSpans = append(rs.ScopeSpans, otlpScopeSpans{Scope: scope})
+		}
+		rs.ScopeSpans[si].Spans = append(rs.ScopeSpans[si].Spans, s)
+	}
+	return t
+}
+
+func otlpResourceFromDomain(process *model.Process) otlpResource {
+	if process == nil {
+		return otlpResource{}
+	}
+
+	attrs := make([]otlpKeyValue, 0, len(process.Tags)+1)
+	attrs = append(attrs, otlpAttribute(model.String("service.name", process.ServiceName)))
+	for _, kv := range process.Tags {
+		attrs = append(attrs, otlpAttribute(kv))
+	}
+	return otlpResource{Attributes: attrs}
+}
+
+// otlpSpanFromDomain converts a span and returns it with its scope. Tags toDomain adds
+// are turned back into span fields.
+func otlpSpanFromDomain(span *model.Span) (otlpSpan, otlpScope) {
+	s := otlpSpan{
+		TraceID:           otlpTraceIDBytes(span.TraceID),
+		SpanID:            otlpSpanIDBytes(span.SpanID),
+		Name:              span.OperationName,
+		StartTimeUnixNano: otlpUint64(span.StartTime.UnixNano()),
+		EndTimeUnixNano:   otlpUint64(span.StartTime.Add(span.Duration).UnixNano()),
+	}
+
+	var scope otlpScope
+	for _, kv := range span.Tags {
+		switch kv.Key {
+		case "span.kind":
+			for i, k := range otlpKindTags {
+				if i > 0 && k == kv.AsString() {
+					s.Kind = otlpSpanKind(i)
+				}
+			}
+		case "error":
+			if kv.AsString() == "true" {
+				s.Status.Code = otlpStatusError
+			}
+		case "otel.status_code":
+			if kv.AsString() == "OK" && s.Status.Code == otlpStatusUnset {
+				s.Status.Code = otlpStatusOK
+			}
+		case "otel.status_description":
+			s.Status.Message = kv.AsString()
+		case "otel.scope.name", "otel.library.name":
+			scope.Name = kv.AsString()
+		case "otel.scope.version", "otel.library.version":
+			scope.Version = kv.AsString()
+		case "w3c.tracestate":
+			s.TraceState = kv.AsString()
+		default:
+			s.Attributes = append(s.Attributes, otlpAttribute(kv))
+		}
+	}
+
+	parent := span.ParentSpanID()
+	for _, ref := range span.References {
+		if ref.SpanID == parent && ref.TraceID == span.TraceID && ref.RefType == model.ChildOf {
+			s.ParentSpanID = otlpSpanIDBytes(parent)
+			continue
+		}
+		s.Links = append(s.Links, otlpLink{TraceID: otlpTraceIDBytes(ref.TraceID), SpanID: otlpSpanIDBytes(ref.SpanID)})
+	}
+
+	for _, l := range span.Logs {
+		e := otlpEvent{TimeUnixNano: otlpUint64(l.Timestamp.UnixNano())}
+		for _, kv := range l.Fields {
+			if kv.Key == "event" && e.Name == "" {
+				e.Name = kv.AsString()
+				continue
+			}
+			e.Attributes = append(e.Attributes, otlpAttribute(kv))
+		}
+		s.Events = append(s.Events, e)
+	}
+
+	return s, scope
+}
+
+func otlpTraceIDBytes(tid model.TraceID) otlpID {
+	id := make(otlpID, 16)
+	binary.BigEndian.PutUint64(id[:8], tid.High)
+	binary.BigEndian.PutUint64(id[8:], tid.Low)
+	return id
+}
+
+func otlpSpanIDBytes(sid model.SpanID) otlpID {
+	id := make(otlpID, 8)
+	binary.BigEndian.PutUint64(id, uint64(sid))
+	return id
+}
+
+func otlpAttribute(kv model.KeyValue) otlpKeyValue {
+	attr := otlpKeyValue{Key: kv.Key}
+	switch kv.VType {
+	case model.BoolType:
+		b := kv.Bool()
+		attr.Value.BoolValue = &b
+	case model.Int64Type:
+		i := otlpInt64(kv.Int64())
+		attr.Value.IntValue = &i
+	case model.Float64Type:
+		d := kv.Float64()
+		attr.Value.DoubleValue = &d
+	case model.BinaryType:
+		attr.Value.BytesValue = kv.Binary()
+	default:
+		str := kv.AsString()
+		attr.Value.StringValue = &str
+	}
+	return attr
+}
+
+// otlpPartialSuccess tells an exporter how many spans of its request were rejected.
+type otlpPartialSuccess struct {
+	RejectedSpans int64  `json:"rejectedSpans,string,omitempty"`
+	ErrorMessage  string `json:"errorMessage,omitempty"`
+}
+
+type otlpResponse struct {
+	PartialSuccess *otlpPartialSuccess `json:"partialSuccess,omitempty"`
+}
+
+// otlpReceiver accepts OTLP trace exports over HTTP and gRPC on listeners of their own,
+// and writes their spans like spans from the Jaeger collector.
+type otlpReceiver struct {
+	writer spanstore.Writer
+	http   *echo.Echo
+	grpc   *grpc.Server
+}
+
+// startOTLP listens for OTLP/HTTP on httpPort and OTLP/gRPC on grpcPort, a zero port
+// is off.
+func startOTLP(writer spanstore.Writer, httpPort, grpcPort int) *otlpReceiver {
+	o := &otlpReceiver{writer: writer}
+
+	if httpPort > 0 {
+		o.http = echo.New()
+		o.http.Logger.SetOutput(ioutil.Discard)
+		o.http.POST(otlpTracesPath, o.exportHTTP)
+
+		go func() {
+			if err := o.http.Start(":" + strconv.Itoa(httpPort)); err != http.ErrServerClosed {
+				logger.Error("OTLP/HTTP listener error", "error", err)
+			}
+		}()
+	}
+
+	if grpcPort > 0 {
+		lis, err := net.Listen("tcp", ":"+strconv.Itoa(grpcPort))
+		if err != nil {
+			logger.Error("failed to listen for OTLP/gRPC", "port", grpcPort, "error", err)
+			return o
+		}
+
+		o.grpc = grpc.NewServer(grpc.CustomCodec(otlpCodec{}))
+		o.grpc.RegisterService(&otlpTraceServiceDesc, o)
+
+		go func() {
+			if err := o.grpc.Serve(lis); err != nil {
+				logger.Error("OTLP/gRPC listener error", "error", err)
+			}
+		}()
+	}
+
+	return o
+}
+
+func (o *otlpReceiver) Close() {
+	if o.http != nil {
+		o.http.Shutdown(context.Background())
+	}
+	if o.grpc != nil {
+		o.grpc.GracefulStop()
+	}
+}
+
+// export writes spans of an export. Invalid spans are rejected and counted, and an
+// error stops it, so the exporter retries; spans written before are dropped then as
+// duplicates.
+func (o *otlpReceiver) export(ctx context.Context, traces *otlpTraces) (*otlpPartialSuccess, error) {
+	spans, rejected, reason := traces.toDomain()
+	for _, span := range spans {
+		if err := o.writer.WriteSpan(ctx, span); err != nil {
+			return nil, err
+		}
+	}
+
+	if rejected > 0 {
+		logger.Warn("rejected invalid OTLP spans", "count", rejected, "error", reason)
+		return &otlpPartialSuccess{RejectedSpans: rejected, ErrorMessage: reason}, nil
+	}
+	return nil, nil
+}
+
+// exportHTTP serves OTLP/HTTP in protobuf or JSON encoding, gzip compressed or not.
+func (o *otlpReceiver) exportHTTP(c echo.Context) error {
+	req := c.Request()
+	data, err := readBody(req, maxBody)
+	if err != nil {
+		return err
+	}
+
+	var (
+		traces  otlpTraces
+		isProto bool
+	)
+	switch ct := req.Header.Get(echo.HeaderContentType); {
+	case strings.HasPrefix(ct, echo.MIMEApplicationJSON):
+		err = json.Unmarshal(data, &traces)
+	case strings.HasPrefix(ct, mimeProtobuf):
+		isProto = true
+		err = traces.unmarshalProto(data)
+	default:
+		return echo.NewHTTPError(http.StatusUnsupportedMediaType, "unsupported content type "+ct)
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	partial, err := o.export(req.Context(), &traces)
+	if err != nil {
+		return writeError(err)
+	}
+
+	if isProto {
+		return c.Blob(http.StatusOK, mimeProtobuf, marshalOTLPResponse(partial))
+	}
+	return c.JSON(http.StatusOK, otlpResponse{PartialSuccess: partial})
+}
+
+// exportGRPC serves OTLP/gRPC TraceService.Export.
+func (o *otlpReceiver) exportGRPC(ctx context.Context, req otlpMessage) (otlpMessage, error) {
+	var traces otlpTraces
+	if err := traces.unmarshalProto(req); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	partial, err := o.export(ctx, &traces)
+	if err != nil {
+		return nil, err
+	}
+	return marshalOTLPResponse(partial), nil
+}
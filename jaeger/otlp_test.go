@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/labstack/echo/v4"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// goldenOTLPSpans are the spans of testdata/otlp/traces.*, the same export in OTLP/JSON
+// and protobuf, as an OpenTelemetry Go SDK sends it for a server span and its client span.
+func goldenOTLPSpans() []*model.Span {
+	process := model.NewProcess("frontend", []model.KeyValue{
+		model.String("telemetry.sdk.language", "go"),
+		model.String("telemetry.sdk.name", "opentelemetry"),
+		model.String("telemetry.sdk.version", "1.11.1"),
+	})
+	traceID := model.NewTraceID(0x5b8efff798038103, 0xd269b633813fc60c)
+	server := model.NewSpanID(0xeee19b7ec3c1b174)
+	scope := []model.KeyValue{
+		model.String("otel.scope.name", "go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"),
+		model.String("otel.scope.version", "0.36.4"),
+	}
+
+	return []*model.Span{
+		{
+			TraceID:       traceID,
+			SpanID:        server,
+			OperationName: "GET /dispatch",
+			References: []model.SpanRef{
+				model.NewFollowsFromRef(model.NewTraceID(0x0af7651916cd43dd, 0x8448eb211c80319c), model.NewSpanID(0xb7ad6b7169203331)),
+			},
+			Flags:     model.SampledFlag,
+			StartTime: time.Unix(0, 1544712660000000000).UTC(),
+			Duration:  time.Second,
+			Tags: append([]model.KeyValue{
+				model.String("http.method", "GET"),
+				model.Int64("http.status_code", 500),
+				model.String("span.kind", "server"),
+				model.Bool("error", true),
+				model.String("otel.status_code", "ERROR"),
+				model.String("otel.status_description", "customer not found"),
+			}, scope...),
+			Logs: []model.Log{{
+				Timestamp: time.Unix(0, 1544712660500000000).UTC(),
+				Fields: []model.KeyValue{
+					model.String("event", "exception"),
+					model.String("exception.message", "customer not found"),
+				},
+			}},
+			Process: process,
+		},
+		{
+			TraceID:       traceID,
+			SpanID:        model.NewSpanID(0x00f067aa0ba902b7),
+			OperationName: "HTTP GET",
+			References:    []model.SpanRef{model.NewChildOfRef(traceID, server)},
+			Flags:         model.SampledFlag,
+			StartTime:     time.Unix(0, 1544712660100000000).UTC(),
+			Duration:      300 * time.Millisecond,
+			Tags: append(append([]model.KeyValue{
+				model.String("net.peer.name", "customer"),
+				model.Bool("http.retry", true),
+				model.Float64("sampler.ratio", 0.5),
+				model.String("span.kind", "client"),
+				model.String("otel.status_code", "OK"),
+			}, scope...), model.String("w3c.tracestate", "congo=t61rcWkgMzE")),
+			Logs:    []model.Log{},
+			Process: process,
+		},
+	}
+}
+
+func TestOTLPGolden(t *testing.T) {
+	tests := []struct {
+		name   string
+		file   string
+		decode func(t *otlpTraces, data []byte) error
+	}{
+		{"json", "testdata/otlp/traces.json", func(t *otlpTraces, data []byte) error { return json.Unmarshal(data, t) }},
+		{"protobuf", "testdata/otlp/traces.pb", (*otlpTraces).unmarshalProto},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := ioutil.ReadFile(tt.file)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var traces otlpTraces
+			if err = tt.decode(&traces, data); err != nil {
+				t.Fatalf("decode() error = %v", err)
+			}
+
+			spans, rejected, reason := traces.toDomain()
+			if rejected != 0 {
+				t.Fatalf("toDomain() rejected %d spans, %s", rejected, reason)
+			}
+			if want := goldenOTLPSpans(); !reflect.DeepEqual(spans, want) {
+				t.Errorf("toDomain() = %v, want %v", spans, want)
+			}
+		})
+	}
+}
+
+func TestOTLPReject(t *testing.T) {
+	tests := []struct {
+		name   string
+		span   string
+		reason string
+	}{
+		{"no start time", `{"traceId": "5b8efff798038103d269b633813fc60c", "spanId": "eee19b7ec3c1b174", "endTimeUnixNano": "1544712661000000000"}`, "startTimeUnixNano"},
+		{"zero start time", `{"traceId": "5b8efff798038103d269b633813fc60c", "spanId": "eee19b7ec3c1b174", "startTimeUnixNano": "0"}`, "startTimeUnixNano"},
+		{"short trace ID", `{"traceId": "d269b633813fc60c", "spanId": "eee19b7ec3c1b174", "startTimeUnixNano": "1544712660000000000"}`, "want 16 bytes"},
+		{"zero trace ID", `{"traceId": "00000000000000000000000000000000", "spanId": "eee19b7ec3c1b174", "startTimeUnixNano": "1544712660000000000"}`, "all zero"},
+		{"zero span ID", `{"traceId": "5b8efff798038103d269b633813fc60c", "spanId": "0000000000000000", "startTimeUnixNano": "1544712660000000000"}`, "all zero"},
+		{"bad parent", `{"traceId": "5b8efff798038103d269b633813fc60c", "spanId": "eee19b7ec3c1b174", "parentSpanId": "ee", "startTimeUnixNano": "1544712660000000000"}`, "want 8 bytes"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var traces otlpTraces
+			err := json.Unmarshal([]byte(`{"resourceSpans": [{"scopeSpans": [{"spans": [`+tt.span+`]}]}]}`), &traces)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			spans, rejected, reason := traces.toDomain()
+			if len(spans) != 0 || rejected != 1 {
+				t.Fatalf("toDomain() = %d spans, %d rejected, want 0, 1", len(spans), rejected)
+			}
+			if !strings.Contains(reason, tt.reason) {
+				t.Errorf("toDomain() reason = %q, want %q in it", reason, tt.reason)
+			}
+		})
+	}
+}
+
+// testSpanWriter records spans written, or fails with err.
+type testSpanWriter struct {
+	spans []*model.Span
+	err   error
+}
+
+func (w *testSpanWriter) WriteSpan(ctx context.Context, span *model.Span) error {
+	if w.err != nil {
+		return w.err
+	}
+	w.spans = append(w.spans, span)
+	return nil
+}
+
+// testOTLPSpan is an OTLP/JSON span, rejected without a start time.
+func testOTLPSpan(spanID string, start bool) string {
+	span := `{"traceId": "5b8efff798038103d269b633813fc60c", "spanId": "` + spanID + `"`
+	if start {
+		span += `, "startTimeUnixNano": "1544712660000000000"`
+	}
+	return span + `}`
+}
+
+// testOTLPProto returns an export in protobuf of spans with span IDs, those starting
+// with 0 have no start time.
+func testOTLPProto(spanIDs ...uint64) []byte {
+	var scope []byte
+	for _, sid := range spanIDs {
+		var span []byte
+		span = protowire.AppendTag(span, 1, protowire.BytesType)
+		span = protowire.AppendBytes(span, []byte{0x5b, 0x8e, 0xff, 0xf7, 0x98, 0x03, 0x81, 0x03, 0xd2, 0x69, 0xb6, 0x33, 0x81, 0x3f, 0xc6, 0x0c})
+		span = protowire.AppendTag(span, 2, protowire.BytesType)
+		span = protowire.AppendBytes(span, protowire.AppendFixed64(nil, sid))
+		if sid>>60 != 0 {
+			span = protowire.AppendTag(span, 7, protowire.Fixed64Type)
+			span = protowire.AppendFixed64(span, 1544712660000000000)
+		}
+		scope = protowire.AppendTag(scope, 2, protowire.BytesType)
+		scope = protowire.AppendBytes(scope, span)
+	}
+
+	rs := protowire.AppendTag(nil, 2, protowire.BytesType)
+	rs = protowire.AppendBytes(rs, scope)
+	req := protowire.AppendTag(nil, 1, protowire.BytesType)
+	return protowire.AppendBytes(req, rs)
+}
+
+// testOTLPRejected returns rejected spans and the error message of an
+// ExportTraceServiceResponse in protobuf.
+func testOTLPRejected(t *testing.T, b []byte) (int64, string) {
+	t.Helper()
+
+	var (
+		rejected int64
+		msg      string
+	)
+	err := eachField(b, func(f *wireField) error {
+		if !f.is(1, protowire.BytesType) {
+			return nil
+		}
+		return eachField(f.bytes, func(f *wireField) error {
+			switch {
+			case f.is(1, protowire.VarintType):
+				rejected = int64(f.u64)
+			case f.is(2, protowire.BytesType):
+				msg = string(f.bytes)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rejected, msg
+}
+
+func TestOTLPExportHTTP(t *testing.T) {
+	golden, err := ioutil.ReadFile("testdata/otlp/traces.pb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	partialJSON := `{"resourceSpans": [{"scopeSpans": [{"spans": [` +
+		testOTLPSpan("eee19b7ec3c1b174", true) + `, ` + testOTLPSpan("00f067aa0ba902b7", false) + `]}]}]}`
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write(testOTLPProto(0xeee19b7ec3c1b174, 0x00f067aa0ba902b7))
+	w.Close()
+
+	tests := []struct {
+		name        string
+		contentType string
+		gzip        bool
+		body        []byte
+		err         error // of WriteSpan
+		code        int
+		written     int
+		rejected    int64
+	}{
+		{"protobuf", mimeProtobuf, false, golden, nil, http.StatusOK, 2, 0},
+		{"protobuf partial success", mimeProtobuf, false, testOTLPProto(0xeee19b7ec3c1b174, 0x00f067aa0ba902b7), nil, http.StatusOK, 1, 1},
+		{"gzip protobuf partial success", mimeProtobuf, true, gz.Bytes(), nil, http.StatusOK, 1, 1},
+		{"json partial success", echo.MIMEApplicationJSON, false, []byte(partialJSON), nil, http.StatusOK, 1, 1},
+		{"all rejected", echo.MIMEApplicationJSON, false, []byte(`{"resourceSpans": [{"scopeSpans": [{"spans": [` + testOTLPSpan("00f067aa0ba902b7", false) + `]}]}]}`), nil, http.StatusOK, 0, 1},
+		{"back pressure", mimeProtobuf, false, golden, ErrBackPressure, http.StatusServiceUnavailable, 0, 0},
+		{"bad json", echo.MIMEApplicationJSON, false, []byte(`{"resourceSpans": {}}`), nil, http.StatusBadRequest, 0, 0},
+		{"unsupported content type", echo.MIMETextPlain, false, golden, nil, http.StatusUnsupportedMediaType, 0, 0},
+	}
+
+	e := echo.New()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			writer := &testSpanWriter{err: tt.err}
+			o := &otlpReceiver{writer: writer}
+
+			req := httptest.NewRequest(http.MethodPost, otlpTracesPath, bytes.NewReader(tt.body))
+			req.Header.Set(echo.HeaderContentType, tt.contentType)
+			if tt.gzip {
+				req.Header.Set(echo.HeaderContentEncoding, "gzip")
+			}
+			rec := httptest.NewRecorder()
+			err := o.exportHTTP(e.NewContext(req, rec))
+			code := rec.Code
+			if he, ok := err.(*echo.HTTPError); ok {
+				code = he.Code
+			} else if err != nil {
+				t.Fatalf("exportHTTP() error = %v", err)
+			}
+			if code != tt.code {
+				t.Fatalf("exportHTTP() status = %d, want %d", code, tt.code)
+			}
+			if len(writer.spans) != tt.written {
+				t.Errorf("exportHTTP() wrote %d spans, want %d", len(writer.spans), tt.written)
+			}
+			if code != http.StatusOK {
+				return
+			}
+
+			var rejected int64
+			if tt.contentType == mimeProtobuf {
+				if rec.Header().Get(echo.HeaderContentType) != mimeProtobuf {
+					t.Errorf("response content type = %q, want %q", rec.Header().Get(echo.HeaderContentType), mimeProtobuf)
+				}
+				rejected, _ = testOTLPRejected(t, rec.Body.Bytes())
+			} else {
+				var resp struct {
+					PartialSuccess *struct {
+						RejectedSpans string `json:"rejectedSpans"` // int64 as a string in OTLP/JSON
+						ErrorMessage  string `json:"errorMessage"`
+					} `json:"partialSuccess"`
+				}
+				if err = json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+					t.Fatal(err)
+				}
+				if resp.PartialSuccess != nil {
+					rejected, _ = strconv.ParseInt(resp.PartialSuccess.RejectedSpans, 10, 64)
+				}
+			}
+			if rejected != tt.rejected {
+				t.Errorf("exportHTTP() rejected = %d, want %d, response %q", rejected, tt.rejected, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestOTLPExportGRPC(t *testing.T) {
+	golden, err := ioutil.ReadFile("testdata/otlp/traces.pb")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writer := &testSpanWriter{}
+	o := &otlpReceiver{writer: writer, grpc: grpc.NewServer(grpc.CustomCodec(otlpCodec{}))}
+	o.grpc.RegisterService(&otlpTraceServiceDesc, o)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go o.grpc.Serve(lis)
+	defer o.Close()
+
+	conn, err := grpc.Dial(lis.Addr().String(), grpc.WithInsecure(), grpc.WithDefaultCallOptions(grpc.CallCustomCodec(otlpCodec{})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	tests := []struct {
+		name     string
+		req      otlpMessage
+		err      error // of WriteSpan
+		code     codes.Code
+		written  int
+		rejected int64
+		message  string
+	}{
+		{"export", golden, nil, codes.OK, 2, 0, ""},
+		{"partial success", testOTLPProto(0xeee19b7ec3c1b174, 0x00f067aa0ba902b7), nil, codes.OK, 1, 1, "startTimeUnixNano"},
+		{"back pressure", golden, ErrBackPressure, codes.Unavailable, 0, 0, ""},
+		{"not protobuf", otlpMessage{0x0a, 0xff}, nil, codes.InvalidArgument, 0, 0, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			writer.spans, writer.err = nil, tt.err
+
+			var resp otlpMessage
+			err := conn.Invoke(context.Background(), "/opentelemetry.proto.collector.trace.v1.TraceService/Export", tt.req, &resp)
+			if code := status.Code(err); code != tt.code {
+				t.Fatalf("Export() error = %v, want code %v", err, tt.code)
+			}
+			if len(writer.spans) != tt.written {
+				t.Errorf("Export() wrote %d spans, want %d", len(writer.spans), tt.written)
+			}
+			rejected, msg := testOTLPRejected(t, resp)
+			if rejected != tt.rejected || !strings.Contains(msg, tt.message) {
+				t.Errorf("Export() rejected %d, %q, want %d, %q in it", rejected, msg, tt.rejected, tt.message)
+			}
+		})
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// otlpMessage is an OTLP protobuf message as it is on the wire.
+type otlpMessage []byte
+
+// otlpCodec hands OTLP/gRPC messages over as bytes, they are decoded like OTLP/HTTP
+// protobuf bodies.
+type otlpCodec struct{}
+
+func (otlpCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(otlpMessage)
+	if !ok {
+		return nil, fmt.Errorf("unexpected OTLP message type %T", v)
+	}
+	return m, nil
+}
+
+func (otlpCodec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(*otlpMessage)
+	if !ok {
+		return fmt.Errorf("unexpected OTLP message type %T", v)
+	}
+	*m = append((*m)[:0], data...)
+	return nil
+}
+
+func (otlpCodec) String() string {
+	return "proto"
+}
+
+// otlpTraceServer is opentelemetry.proto.collector.trace.v1.TraceService.
+type otlpTraceServer interface {
+	exportGRPC(ctx context.Context, req otlpMessage) (otlpMessage, error)
+}
+
+var otlpTraceServiceDesc = grpc.ServiceDesc{
+	ServiceName: "opentelemetry.proto.collector.trace.v1.TraceService",
+	HandlerType: (*otlpTraceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Export",
+			Handler:    otlpExportHandler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "opentelemetry/proto/collector/trace/v1/trace_service.proto",
+}
+
+func otlpExportHandler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	var req otlpMessage
+	if err := dec(&req); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(otlpTraceServer).exportGRPC(ctx, req)
+	}
+
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/opentelemetry.proto.collector.trace.v1.TraceService/Export",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(otlpTraceServer).exportGRPC(ctx, req.(otlpMessage))
+	}
+	return interceptor(ctx, req, info, handler)
+}
+
+// marshalOTLPResponse returns an ExportTraceServiceResponse, empty unless spans were rejected.
+func marshalOTLPResponse(partial *otlpPartialSuccess) otlpMessage {
+	if partial == nil {
+		return otlpMessage{}
+	}
+
+	var ps []byte
+	ps = protowire.AppendTag(ps, 1, protowire.VarintType)
+	ps = protowire.AppendVarint(ps, uint64(partial.RejectedSpans))
+	if partial.ErrorMessage != "" {
+		ps = protowire.AppendTag(ps, 2, protowire.BytesType)
+		ps = protowire.AppendString(ps, partial.ErrorMessage)
+	}
+
+	b := protowire.AppendTag(nil, 1, protowire.BytesType)
+	return protowire.AppendBytes(b, ps)
+}
+
+// wireField is a field of a protobuf message, with its value decoded by wire type.
+type wireField struct {
+	num   protowire.Number
+	typ   protowire.Type
+	u64   uint64 // varint, fixed64 and fixed32 values
+	bytes []byte // length delimited values
+}
+
+func (f *wireField) is(num protowire.Number, typ protowire.Type) bool {
+	return f.num == num && f.typ == typ
+}
+
+// eachField calls fn with every field of message b, fields of other wire types are skipped.
+func eachField(b []byte, fn func(f *wireField) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		f := wireField{num: num, typ: typ}
+		switch typ {
+		case protowire.VarintType:
+			f.u64, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed64Type:
+			f.u64, n = protowire.ConsumeFixed64(b)
+		case protowire.Fixed32Type:
+			var v uint32
+			v, n = protowire.ConsumeFixed32(b)
+			f.u64 = uint64(v)
+		case protowire.BytesType:
+			f.bytes, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		if err := fn(&f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The unmarshalProto methods decode OTLP protobuf messages, field numbers are those of
+// opentelemetry-proto.
+
+func (t *otlpTraces) unmarshalProto(b []byte) error {
+	return eachField(b, func(f *wireField) error {
+		if f.is(1, protowire.BytesType) {
+			t.ResourceSpans = append(t.ResourceSpans, otlpResourceSpans{})
+			return t.ResourceSpans[len(t.ResourceSpans)-1].unmarshalProto(f.bytes)
+		}
+		return nil
+	})
+}
+
+func (rs *otlpResourceSpans) unmarshalProto(b []byte) error {
+	return eachField(b, func(f *wireField) error {
+		switch {
+		case f.is(1, protowire.BytesType):
+			return rs.Resource.unmarshalProto(f.bytes)
+		case f.is(2, protowire.BytesType):
+			// scope_spans, instrumentation_library_spans before OTLP v0.15 with the same layout
+			rs.ScopeSpans = append(rs.ScopeSpans, otlpScopeSpans{})
+			return rs.ScopeSpans[len(rs.ScopeSpans)-1].unmarshalProto(f.bytes)
+		case f.is(1000, protowire.BytesType):
+			rs.InstrumentationLibrarySpans = append(rs.InstrumentationLibrarySpans, otlpScopeSpans{})
+			return rs.InstrumentationLibrarySpans[len(rs.InstrumentationLibrarySpans)-1].unmarshalProto(f.bytes)
+		}
+		return nil
+	})
+}
+
+func (r *otlpResource) unmarshalProto(b []byte) error {
+	return eachField(b, func(f *wireField) error {
+		if f.is(1, protowire.BytesType) {
+			return appendKeyValue(&r.Attributes, f.bytes)
+		}
+		return nil
+	})
+}
+
+func (ss *otlpScopeSpans) unmarshalProto(b []byte) error {
+	return eachField(b, func(f *wireField) error {
+		switch {
+		case f.is(1, protowire.BytesType):
+			return ss.Scope.unmarshalProto(f.bytes)
+		case f.is(2, protowire.BytesType):
+			ss.Spans = append(ss.Spans, otlpSpan{})
+			return ss.Spans[len(ss.Spans)-1].unmarshalProto(f.bytes)
+		}
+		return nil
+	})
+}
+
+func (s *otlpScope) unmarshalProto(b []byte) error {
+	return eachField(b, func(f *wireField) error {
+		switch {
+		case f.is(1, protowire.BytesType):
+			s.Name = string(f.bytes)
+		case f.is(2, protowire.BytesType):
+			s.Version = string(f.bytes)
+		}
+		return nil
+	})
+}
+
+func (s *otlpSpan) unmarshalProto(b []byte) error {
+	return eachField(b, func(f *wireField) error {
+		switch {
+		case f.is(1, protowire.BytesType):
+			s.TraceID = otlpID(f.bytes)
+		case f.is(2, protowire.BytesType):
+			s.SpanID = otlpID(f.bytes)
+		case f.is(3, protowire.BytesType):
+			s.TraceState = string(f.bytes)
+		case f.is(4, protowire.BytesType):
+			s.ParentSpanID = otlpID(f.bytes)
+		case f.is(5, protowire.BytesType):
+			s.Name = string(f.bytes)
+		case f.is(6, protowire.VarintType):
+			s.Kind = otlpSpanKind(f.u64)
+		case f.is(7, protowire.Fixed64Type):
+			s.StartTimeUnixNano = otlpUint64(f.u64)
+		case f.is(8, protowire.Fixed64Type):
+			s.EndTimeUnixNano = otlpUint64(f.u64)
+		case f.is(9, protowire.BytesType):
+			return appendKeyValue(&s.Attributes, f.bytes)
+		case f.is(11, protowire.BytesType):
+			s.Events = append(s.Events, otlpEvent{})
+			return s.Events[len(s.Events)-1].unmarshalProto(f.bytes)
+		case f.is(13, protowire.BytesType):
+			s.Links = append(s.Links, otlpLink{})
+			return s.Links[len(s.Links)-1].unmarshalProto(f.bytes)
+		case f.is(15, protowire.BytesType):
+			return s.Status.unmarshalProto(f.bytes)
+		}
+		return nil
+	})
+}
+
+func (e *otlpEvent) unmarshalProto(b []byte) error {
+	return eachField(b, func(f *wireField) error {
+		switch {
+		case f.is(1, protowire.Fixed64Type):
+			e.TimeUnixNano = otlpUint64(f.u64)
+		case f.is(2, protowire.BytesType):
+			e.Name = string(f.bytes)
+		case f.is(3, protowire.BytesType):
+			return appendKeyValue(&e.Attributes, f.bytes)
+		}
+		return nil
+	})
+}
+
+func (l *otlpLink) unmarshalProto(b []byte) error {
+	return eachField(b, func(f *wireField) error {
+		switch {
+		case f.is(1, protowire.BytesType):
+			l.TraceID = otlpID(f.bytes)
+		case f.is(2, protowire.BytesType):
+			l.SpanID = otlpID(f.bytes)
+		case f.is(3, protowire.BytesType):
+			l.TraceState = string(f.bytes)
+		case f.is(4, protowire.BytesType):
+			return appendKeyValue(&l.Attributes, f.bytes)
+		}
+		return nil
+	})
+}
+
+func (s *otlpStatus) unmarshalProto(b []byte) error {
+	return eachField(b, func(f *wireField) error {
+		switch {
+		case f.is(2, protowire.BytesType):
+			s.Message = string(f.bytes)
+		case f.is(3, protowire.VarintType):
+			s.Code = otlpStatusCode(f.u64)
+		}
+		return nil
+	})
+}
+
+func appendKeyValue(kvs *[]otlpKeyValue, b []byte) error {
+	*kvs = append(*kvs, otlpKeyValue{})
+	kv := &(*kvs)[len(*kvs)-1]
+	return eachField(b, func(f *wireField) error {
+		switch {
+		case f.is(1, protowire.BytesType):
+			kv.Key = string(f.bytes)
+		case f.is(2, protowire.BytesType):
+			return kv.Value.unmarshalProto(f.bytes)
+		}
+		return nil
+	})
+}
+
+func (v *otlpAnyValue) unmarshalProto(b []byte) error {
+	return eachField(b, func(f *wireField) error {
+		switch {
+		case f.is(1, protowire.BytesType):
+			s := string(f.bytes)
+			v.StringValue = &s
+		case f.is(2, protowire.VarintType):
+			bv := f.u64 != 0
+			v.BoolValue = &bv
+		case f.is(3, protowire.VarintType):
+			i := otlpInt64(f.u64)
+			v.IntValue = &i
+		case f.is(4, protowire.Fixed64Type):
+			d := math.Float64frombits(f.u64)
+			v.DoubleValue = &d
+		case f.is(5, protowire.BytesType):
+			v.ArrayValue = &otlpAnyValues{}
+			return eachField(f.bytes, func(f *wireField) error {
+				if f.is(1, protowire.BytesType) {
+					v.ArrayValue.Values = append(v.ArrayValue.Values, otlpAnyValue{})
+					return v.ArrayValue.Values[len(v.ArrayValue.Values)-1].unmarshalProto(f.bytes)
+				}
+				return nil
+			})
+		case f.is(6, protowire.BytesType):
+			v.KvlistValue = &otlpKeyValues{}
+			return eachField(f.bytes, func(f *wireField) error {
+				if f.is(1, protowire.BytesType) {
+					return appendKeyValue(&v.KvlistValue.Values, f.bytes)
+				}
+				return nil
+			})
+		case f.is(7, protowire.BytesType):
+			v.BytesValue = append([]byte{}, f.bytes...)
+		}
+		return nil
+	})
+}
@@ -2,22 +2,29 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"strconv"
 
 	"github.com/chronowave/chronowave/embed"
 	"github.com/labstack/echo/v4"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
-func startEcho(stream *embed.WaveStream, port int) *echo.Echo {
+const (
+	// max bytes of a request body spans are posted in, after decompression
+	maxBody = 32 * 1024 * 1024
+)
+
+// startEcho serves the wave over HTTP, routes registers more endpoints, /health among
+// them, before it starts.
+func startEcho(stream *embed.WaveStream, port int, routes ...func(e *echo.Echo)) *echo.Echo {
 	e := echo.New()
 	e.Logger.SetOutput(ioutil.Discard)
 
-	e.GET("/health", func(c echo.Context) error {
-		return c.String(http.StatusOK, http.StatusText(http.StatusOK))
-	})
-
 	e.GET("/query", func(c echo.Context) error {
 		var (
 			data []byte
@@ -41,9 +48,44 @@ func startEcho(stream *embed.WaveStream, port int) *echo.Echo {
 
 		return c.Stream(http.StatusOK, echo.MIMEApplicationJSON, bytes.NewReader(data))
 	})
+	for _, r := range routes {
+		r(e)
+	}
+
 	go func() {
 		err := e.Start(":" + strconv.FormatInt(int64(port), 10))
 		logger.Error("http listener error: %v", err)
 	}()
 	return e
 }
+
+// readBody returns the request body of at most limit bytes, gzip compressed or not.
+func readBody(req *http.Request, limit int64) ([]byte, error) {
+	body := io.Reader(req.Body)
+	if req.Header.Get(echo.HeaderContentEncoding) == "gzip" {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		defer gz.Close()
+		body = gz
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(body, limit+1))
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if int64(len(data)) > limit {
+		return nil, echo.NewHTTPError(http.StatusRequestEntityTooLarge)
+	}
+	return data, nil
+}
+
+// writeError turns the retryable errors of WriteSpan into 503 Service Unavailable, so
+// clients posting spans retry.
+func writeError(err error) error {
+	if s, ok := status.FromError(err); ok && s.Code() == codes.Unavailable {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, s.Message())
+	}
+	return err
+}
@@ -0,0 +1,478 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/chronowave/chronowave/embed"
+	"github.com/chronowave/chronowave/ssd/codec"
+	ssdexec "github.com/chronowave/chronowave/ssd/exec"
+	ssdidx "github.com/chronowave/chronowave/ssd/index"
+	"github.com/chronowave/chronowave/ssql"
+	"github.com/jaegertracing/jaeger/plugin/storage/es/spanstore/dbmodel"
+)
+
+// retentionBatch is the file survivors of a compacted segment are indexed from.
+const retentionBatch = ".retention"
+
+// retentionRuleConfig is a rule of chronowave.retention in plugin.yaml.
+type retentionRuleConfig struct {
+	Service   string
+	Operation string
+	Tags      map[string]interface{}
+	TTL       string
+}
+
+// retentionRule keeps spans of service, operation and tags, all if empty, for ttl.
+type retentionRule struct {
+	service   string
+	operation string
+	tags      []*tagFilter
+	ttl       time.Duration
+}
+
+func parseRetentionRule(rc retentionRuleConfig) (retentionRule, error) {
+	ttl, err := time.ParseDuration(rc.TTL)
+	if err != nil || ttl <= 0 {
+		return retentionRule{}, fmt.Errorf("invalid ttl %q", rc.TTL)
+	}
+
+	r := retentionRule{service: rc.Service, operation: rc.Operation, ttl: ttl}
+	for k, v := range rc.Tags {
+		f, err := parseTagFilter(k, fmt.Sprint(v))
+		if err != nil {
+			return retentionRule{}, err
+		}
+		r.tags = append(r.tags, f)
+	}
+	return r, nil
+}
+
+func (r *retentionRule) match(span *dbmodel.Span, scope tagScope) bool {
+	if len(r.service) > 0 && span.Process.ServiceName != r.service {
+		return false
+	}
+	if len(r.operation) > 0 && span.OperationName != r.operation {
+		return false
+	}
+	if len(r.tags) > 0 {
+		kvs := scope.values(span)
+		for _, f := range r.tags {
+			if !f.match(kvs) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// retentionPolicy keeps a span for the ttl of the first rule it matches, or for
+// chronowave.ttl. ChronoWave only purges whole segments, so the wave is purged after
+// the longest ttl, and segments holding spans past a shorter one are compacted.
+type retentionPolicy struct {
+	rules []retentionRule
+	ttl   time.Duration
+	scope tagScope
+}
+
+// maxTTL returns how long the wave keeps segments.
+func (p *retentionPolicy) maxTTL() time.Duration {
+	ttl := p.ttl
+	for _, r := range p.rules {
+		if r.ttl > ttl {
+			ttl = r.ttl
+		}
+	}
+	return ttl
+}
+
+// minTTL returns how long the shortest lived spans are kept.
+func (p *retentionPolicy) minTTL() time.Duration {
+	ttl := p.ttl
+	for _, r := range p.rules {
+		if r.ttl < ttl {
+			ttl = r.ttl
+		}
+	}
+	return ttl
+}
+
+func (p *retentionPolicy) spanTTL(span *dbmodel.Span) time.Duration {
+	for i := range p.rules {
+		if p.rules[i].match(span, p.scope) {
+			return p.rules[i].ttl
+		}
+	}
+	return p.ttl
+}
+
+// operationTTL returns how long spans of service and operation may be kept, the
+// longest ttl of the rules they may match whatever their tags.
+func (p *retentionPolicy) operationTTL(service, operation string) time.Duration {
+	var ttl time.Duration
+	for _, r := range p.rules {
+		if len(r.service) > 0 && r.service != service || len(r.operation) > 0 && r.operation != operation {
+			continue
+		}
+		if r.ttl > ttl {
+			ttl = r.ttl
+		}
+		if len(r.tags) == 0 {
+			// matches all spans left, the ones after it and chronowave.ttl never apply
+			return ttl
+		}
+	}
+	if p.ttl > ttl {
+		ttl = p.ttl
+	}
+	return ttl
+}
+
+// due returns the longest ttl shorter than maxTTL passed at now for a segment
+// created at created, zero if there is none.
+func (p *retentionPolicy) due(created, now time.Time) time.Duration {
+	max := p.maxTTL()
+	var due time.Duration
+	for _, ttl := range append(p.ttls(), p.ttl) {
+		if ttl < max && ttl > due && !created.Add(ttl).After(now) {
+			due = ttl
+		}
+	}
+	return due
+}
+
+func (p *retentionPolicy) ttls() []time.Duration {
+	ttls := make([]time.Duration, len(p.rules))
+	for i, r := range p.rules {
+		ttls[i] = r.ttl
+	}
+	return ttls
+}
+
+// segmentRetention compacts segments of the wave in dir: once a segment is older than
+// the ttl of some of its spans, its other documents are indexed into a new segment
+// taking its place and creation time, and it's removed. The longest ttl compacted is
+// recorded per segment, so each is read once per ttl.
+type segmentRetention struct {
+	dir    string
+	policy *retentionPolicy
+	db     *sql.DB // the wave's segment tables
+	sum    *summaries
+}
+
+// openSegmentRetention opens the segment tables of the wave in dir for writing, the
+// wave must be opened first.
+func openSegmentRetention(dir string, policy *retentionPolicy, sum *summaries) (*segmentRetention, error) {
+	db, err := sql.Open("sqlite3", "file:"+filepath.Join(dir, "db")+"?_busy_timeout=10000")
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS retention
+                      (
+                        wid INTEGER PRIMARY KEY,
+                        ttl INTEGER NOT NULL
+                      )`)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &segmentRetention{dir: dir, policy: policy, db: db, sum: sum}, nil
+}
+
+func (r *segmentRetention) Close() error {
+	return r.db.Close()
+}
+
+// retentionSegment is a segment of the wave and the longest ttl it was compacted for.
+type retentionSegment struct {
+	wid     int64
+	created time.Time
+	applied time.Duration
+}
+
+// apply compacts segments holding spans past their ttl at now.
+func (r *segmentRetention) apply(now time.Time) error {
+	// segments the wave purged
+	if _, err := r.db.Exec(`DELETE FROM retention WHERE wid NOT IN (SELECT wid FROM wave)`); err != nil {
+		return err
+	}
+
+	rows, err := r.db.Query(`SELECT w.wid, w.created, IFNULL(r.ttl, 0) FROM wave w LEFT JOIN retention r ON r.wid = w.wid
+                             WHERE w.created < ? ORDER BY w.wid`, now.Add(-1*r.policy.minTTL()).UTC())
+	if err != nil {
+		return err
+	}
+	var segments []retentionSegment
+	for rows.Next() {
+		var s retentionSegment
+		if err = rows.Scan(&s.wid, &s.created, &s.applied); err != nil {
+			rows.Close()
+			return err
+		}
+		segments = append(segments, s)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	var compacted int
+	for _, s := range segments {
+		due := r.policy.due(s.created, now)
+		if due <= s.applied {
+			continue
+		}
+		changed, err := r.compact(s, due)
+		if err != nil {
+			logger.Error("failed to compact segment", "segment", s.wid, "error", err)
+			continue
+		}
+		if changed {
+			compacted++
+		}
+	}
+	if compacted > 0 {
+		logger.Warn("compacted segments by retention rules", "segments", compacted)
+	}
+	return nil
+}
+
+// compact removes spans kept for due or less from segment s, it returns false if there
+// were none.
+func (r *segmentRetention) compact(s retentionSegment, due time.Duration) (bool, error) {
+	path := segmentPath(r.dir, s.wid)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		// purged meanwhile
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	docs, err := segmentDocs(data)
+	if err != nil {
+		// kept as it is until the wave purges it
+		r.db.Exec(`INSERT OR REPLACE INTO retention (wid, ttl) VALUES (?, ?)`, s.wid, due)
+		return false, err
+	}
+
+	var (
+		kept       [][]byte
+		dropped    []pendingSpan
+		begin, end int64
+	)
+	for _, doc := range docs {
+		var head struct {
+			TraceID   string `json:"traceID"`
+			StartTime int64  `json:"startTime"`
+		}
+		if err = json.Unmarshal(doc, &head); err != nil {
+			return false, err
+		}
+		// dependency and metrics buckets are kept for chronowave.ttl
+		if head.TraceID == "" {
+			if r.policy.ttl <= due {
+				continue
+			}
+		} else {
+			var span dbmodel.Span
+			if err = json.Unmarshal(doc, &span); err != nil {
+				return false, err
+			}
+			if r.policy.spanTTL(&span) <= due {
+				dropped = append(dropped, storedPendingSpan(&span))
+				continue
+			}
+		}
+
+		start := head.StartTime
+		if len(kept) == 0 || start < begin {
+			begin = start
+		}
+		if len(kept) == 0 || start > end {
+			end = start
+		}
+		kept = append(kept, doc)
+	}
+
+	if len(kept) == len(docs) {
+		_, err = r.db.Exec(`INSERT OR REPLACE INTO retention (wid, ttl) VALUES (?, ?)`, s.wid, due)
+		return false, err
+	}
+
+	if len(kept) > 0 {
+		err = r.replace(s, due, kept, begin, end)
+	} else {
+		err = r.remove(s.wid)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if err = r.sum.forget(dropped); err != nil {
+		logger.Error("failed to forget compacted spans in trace summaries", "error", err)
+	}
+	return true, nil
+}
+
+// replace indexes docs, started within [begin, end], into a new segment which takes
+// the place of segment s.
+func (r *segmentRetention) replace(s retentionSegment, due time.Duration, docs [][]byte, begin, end int64) error {
+	var last int64
+	if err := r.db.QueryRow(`SELECT IFNULL(MAX(wid), 0) FROM wave`).Scan(&last); err != nil {
+		return err
+	}
+
+	batch := filepath.Join(r.dir, retentionBatch)
+	if err := ioutil.WriteFile(batch, bytes.Join(docs, []byte("\n")), 0644); err != nil {
+		return err
+	}
+	defer os.Remove(batch)
+	if err := embed.Build(batch, timestamp, keys); err != nil {
+		return err
+	}
+
+	// ChronoWave doesn't tell the segment it built, the WAL may have been indexed
+	// meanwhile, but not into a segment of the same time range
+	rows, err := r.db.Query(`SELECT wid FROM wave WHERE wid > ? AND beg = ? AND end = ?`, last, begin, end)
+	if err != nil {
+		return err
+	}
+	var wids []int64
+	for rows.Next() {
+		var wid int64
+		if err = rows.Scan(&wid); err != nil {
+			rows.Close()
+			return err
+		}
+		wids = append(wids, wid)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	if len(wids) != 1 {
+		// both are kept and not compacted again, spans read twice are collapsed
+		if _, err = r.db.Exec(`INSERT OR REPLACE INTO retention (wid, ttl) VALUES (?, ?)`, s.wid, due); err != nil {
+			return err
+		}
+		return fmt.Errorf("compacted segment not found, %d segments after %d span [%d, %d]", len(wids), last, begin, end)
+	}
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	qry := []string{
+		`UPDATE wave SET created = (SELECT created FROM wave WHERE wid = $old) WHERE wid = $new`,
+		`UPDATE waveloc SET created = (SELECT created FROM wave WHERE wid = $old) WHERE wid = $new`,
+		`INSERT OR REPLACE INTO retention (wid, ttl) VALUES ($new, $ttl)`,
+		`DELETE FROM retention WHERE wid = $old`,
+		`DELETE FROM waveloc WHERE wid = $old`,
+		`DELETE FROM wave WHERE wid = $old`,
+	}
+	for _, q := range qry {
+		_, err = tx.Exec(q, sql.Named("old", s.wid), sql.Named("new", wids[0]), sql.Named("ttl", due))
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	return removeSegmentFile(r.dir, s.wid)
+}
+
+// remove drops segment wid from the wave.
+func (r *segmentRetention) remove(wid int64) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, q := range []string{
+		`DELETE FROM retention WHERE wid = ?`,
+		`DELETE FROM waveloc WHERE wid = ?`,
+		`DELETE FROM wave WHERE wid = ?`,
+	} {
+		if _, err = tx.Exec(q, wid); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	return removeSegmentFile(r.dir, wid)
+}
+
+func removeSegmentFile(dir string, wid int64) error {
+	if err := os.Remove(segmentPath(dir, wid)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// segmentDocs returns the documents of segment data as they were written.
+func segmentDocs(data []byte) (docs []json.RawMessage, err error) {
+	// ChronoWave fails to decode segments without any text
+	defer func() {
+		if r := recover(); r != nil {
+			docs, err = nil, fmt.Errorf("failed to decode segment: %v", r)
+		}
+	}()
+
+	indexed, err := ssdidx.DecodeIndexBlock(data)
+	if err != nil {
+		return nil, err
+	}
+
+	stmt := &ssql.Statement{
+		Find: []*ssql.Attribute{{Name: "s"}},
+		Where: []*ssql.Expr{{Field: &ssql.Expr_Tuple{
+			Tuple: &ssql.Tuple{Name: "s", Path: "/"},
+		}}},
+	}
+	rs := ssdexec.Exec(indexed, stmt)
+	if rs == nil {
+		return nil, nil
+	}
+
+	var rows []struct {
+		S json.RawMessage `json:"s"`
+	}
+	if err = json.Unmarshal(codec.MarshalResultSet(rs, 0), &rows); err != nil {
+		return nil, err
+	}
+	docs = make([]json.RawMessage, 0, len(rows))
+	for _, r := range rows {
+		docs = append(docs, r.S)
+	}
+	return docs, nil
+}
+
+// storedPendingSpan returns span read from the wave as it was when it was written.
+func storedPendingSpan(span *dbmodel.Span) pendingSpan {
+	s, err := dbmodel.ToDomain{}.SpanToDomain(span)
+	if err != nil {
+		return pendingSpan{traceID: string(span.TraceID)}
+	}
+	return newPendingSpan(s, nil)
+}
+
+func maxDuration(a, b time.Duration) time.Duration {
+	if a > b {
+		return a
+	}
+	return b
+}
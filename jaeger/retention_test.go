@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/plugin/storage/es/spanstore/dbmodel"
+)
+
+// testRetentionPolicy keeps payments for 30 days, failed spans for 14, health checks
+// for an hour and the rest for 3 days.
+func testRetentionPolicy(t *testing.T) *retentionPolicy {
+	t.Helper()
+
+	p := &retentionPolicy{ttl: 72 * time.Hour, scope: allTags}
+	for _, rc := range []retentionRuleConfig{
+		{Service: "payments", TTL: "720h"},
+		{Tags: map[string]interface{}{"error": true}, TTL: "336h"},
+		{Operation: "healthcheck", TTL: "1h"},
+	} {
+		r, err := parseRetentionRule(rc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.rules = append(p.rules, r)
+	}
+	return p
+}
+
+func testRetentionSpan(trace, span uint64, service, op string, start time.Time) *model.Span {
+	s := testSpan(trace, span, service, start)
+	s.OperationName = op
+	return s
+}
+
+func TestParseRetentionRule(t *testing.T) {
+	tests := []struct {
+		name    string
+		rc      retentionRuleConfig
+		wantErr bool
+	}{
+		{"service", retentionRuleConfig{Service: "payments", TTL: "720h"}, false},
+		{"tags", retentionRuleConfig{Tags: map[string]interface{}{"http.status_code": ">=500"}, TTL: "1h"}, false},
+		{"no ttl", retentionRuleConfig{Service: "payments"}, true},
+		{"zero ttl", retentionRuleConfig{Service: "payments", TTL: "0s"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseRetentionRule(tt.rc); (err != nil) != tt.wantErr {
+				t.Errorf("parseRetentionRule() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRetentionPolicy(t *testing.T) {
+	p := testRetentionPolicy(t)
+	now := time.Unix(1600000000, 0)
+
+	failed := testRetentionSpan(1, 1, "frontend", "GET /", now)
+	failed.Tags = []model.KeyValue{model.Bool("error", true)}
+	spans := []struct {
+		name string
+		span *model.Span
+		want time.Duration
+	}{
+		{"service", testRetentionSpan(1, 1, "payments", "charge", now), 720 * time.Hour},
+		{"first rule matched", testRetentionSpan(1, 1, "payments", "healthcheck", now), 720 * time.Hour},
+		{"tags", failed, 336 * time.Hour},
+		{"operation", testRetentionSpan(1, 1, "frontend", "healthcheck", now), time.Hour},
+		{"no rule", testRetentionSpan(1, 1, "frontend", "GET /", now), 72 * time.Hour},
+	}
+	for _, tt := range spans {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := p.spanTTL(dbmodel.FromDomain{}.FromDomainEmbedProcess(tt.span)); got != tt.want {
+				t.Errorf("spanTTL() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	operations := []struct {
+		service, operation string
+		want               time.Duration
+	}{
+		{"payments", "healthcheck", 720 * time.Hour},
+		// may be failed
+		{"frontend", "healthcheck", 336 * time.Hour},
+		{"frontend", "GET /", 336 * time.Hour},
+	}
+	for _, tt := range operations {
+		if got := p.operationTTL(tt.service, tt.operation); got != tt.want {
+			t.Errorf("operationTTL(%q, %q) = %v, want %v", tt.service, tt.operation, got, tt.want)
+		}
+	}
+	untagged := &retentionPolicy{ttl: time.Hour, rules: p.rules[2:]}
+	if got := untagged.operationTTL("frontend", "healthcheck"); got != time.Hour {
+		t.Errorf("operationTTL() without tag rules = %v, want 1h", got)
+	}
+
+	dues := []struct {
+		age  time.Duration // of the segment
+		want time.Duration
+	}{
+		{30 * time.Minute, 0},
+		{time.Hour, time.Hour},
+		{100 * time.Hour, 72 * time.Hour},
+		{400 * time.Hour, 336 * time.Hour},
+		// purged by the wave
+		{800 * time.Hour, 336 * time.Hour},
+	}
+	for _, tt := range dues {
+		if got := p.due(now.Add(-1*tt.age), now); got != tt.want {
+			t.Errorf("due() of a segment %v old = %v, want %v", tt.age, got, tt.want)
+		}
+	}
+}
+
+// testWaveDocs returns operations of spans, or bucket for other documents, by segment
+// of the wave in dir, and when segments were created.
+func testWaveDocs(t *testing.T, r *segmentRetention) ([][]string, []time.Time) {
+	t.Helper()
+
+	rows, err := r.db.Query(`SELECT wid, created FROM wave ORDER BY wid`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	var (
+		segments [][]string
+		created  []time.Time
+	)
+	for rows.Next() {
+		var (
+			wid int64
+			c   time.Time
+		)
+		if err = rows.Scan(&wid, &c); err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadFile(segmentPath(r.dir, wid))
+		if err != nil {
+			t.Fatal(err)
+		}
+		docs, err := segmentDocs(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ops []string
+		for _, doc := range docs {
+			var span dbmodel.Span
+			if err = json.Unmarshal(doc, &span); err != nil {
+				t.Fatal(err)
+			}
+			if span.TraceID == "" {
+				ops = append(ops, "bucket")
+			} else {
+				ops = append(ops, span.OperationName)
+			}
+		}
+		sort.Strings(ops)
+		segments = append(segments, ops)
+		created = append(created, c)
+	}
+	return segments, created
+}
+
+func TestSegmentRetention(t *testing.T) {
+	start := time.Unix(1600000000, 0)
+	wr, close := testWaveRider(t,
+		[]*model.Span{
+			testRetentionSpan(1, 11, "frontend", "GET /", start),
+			testRetentionSpan(1, 12, "frontend", "healthcheck", start.Add(time.Second)),
+			testRetentionSpan(2, 21, "payments", "charge", start.Add(2*time.Second)),
+		},
+		[]*model.Span{testRetentionSpan(3, 31, "frontend", "healthcheck", start)},
+	)
+	defer close()
+	bucket, _ := json.Marshal(dependencyDoc{StartTime: micros(start), Dependencies: dependencyBucket{Bucket: micros(start), Links: []dependencyLink{{Parent: "frontend", Child: "payments", CallCount: 1}}}})
+	if err := testSegment(wr.dir, bucket); err != nil {
+		t.Fatal(err)
+	}
+
+	sum, err := openSummaries(wr.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sum.Close()
+	err = sum.observe([]pendingSpan{
+		testPending(1, "frontend", start, time.Second, true, false),
+		testPending(1, "frontend", start, time.Second, false, false),
+		testPending(2, "payments", start, time.Second, true, false),
+		testPending(3, "frontend", start, time.Second, true, false),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := openSegmentRetention(wr.dir, testRetentionPolicy(t), sum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	now := time.Now().UTC().Truncate(time.Second)
+	one, two, three := traceIDs(1)[0], traceIDs(2)[0], traceIDs(3)[0]
+	steps := []struct {
+		name   string
+		age    time.Duration // of all segments, zero leaves them as they are
+		want   [][]string
+		counts map[string]int // span count by trace
+	}{
+		{"none due", 30 * time.Minute, [][]string{{"GET /", "charge", "healthcheck"}, {"healthcheck"}, {"bucket"}}, map[string]int{one: 2, two: 1, three: 1}},
+		{"health checks", 2 * time.Hour, [][]string{{"bucket"}, {"GET /", "charge"}}, map[string]int{one: 1, two: 1}},
+		{"compacted once per ttl", 0, [][]string{{"bucket"}, {"GET /", "charge"}}, map[string]int{one: 1, two: 1}},
+		{"past chronowave.ttl", 100 * time.Hour, [][]string{{"charge"}}, map[string]int{two: 1}},
+	}
+	for _, s := range steps {
+		var created time.Time
+		if s.age > 0 {
+			created = now.Add(-1 * s.age)
+			for _, q := range []string{`UPDATE wave SET created = ?`, `UPDATE waveloc SET created = ?`} {
+				if _, err = r.db.Exec(q, created); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		if err = r.apply(now); err != nil {
+			t.Fatalf("%s: apply() error = %v", s.name, err)
+		}
+
+		got, times := testWaveDocs(t, r)
+		if !reflect.DeepEqual(got, s.want) {
+			t.Errorf("%s: segments = %v, want %v", s.name, got, s.want)
+		}
+		// compacted segments keep when they were created, for the wave to purge them
+		for _, c := range times {
+			if s.age > 0 && !c.Equal(created) {
+				t.Errorf("%s: segment created = %v, want %v", s.name, c, created)
+			}
+		}
+
+		counts := map[string]int{}
+		err = sum.within(0, micros(now), func(ts *traceSummary) error {
+			counts[ts.TraceID] = ts.SpanCount
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(counts, s.counts) {
+			t.Errorf("%s: summary span counts = %v, want %v", s.name, counts, s.counts)
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/jaegertracing/jaeger/plugin/storage/es/spanstore/dbmodel"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+
+	"chronowave-jaeger/builder"
+)
+
+// searchMode tells whether FindTraces filters must be satisfied by one span or
+// may be satisfied by different spans of a trace.
+type searchMode string
+
+const (
+	spanSearch  searchMode = "span"
+	traceSearch searchMode = "trace"
+)
+
+func parseSearchMode(text string) (searchMode, error) {
+	switch m := searchMode(text); m {
+	case spanSearch, traceSearch:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown search mode %q, expect span or trace", text)
+}
+
+// traceFilter is a part of the search which one span has to satisfy.
+type traceFilter struct {
+	clauses   []builder.Clause
+	tags      []*tagFilter
+	service   string
+	operation string
+}
+
+// exact tells whether selected spans have to be checked again.
+func (f *traceFilter) exact() bool {
+	return len(f.tags) > 0 || len(f.service) > 0 || len(f.operation) > 0
+}
+
+// traceIDQuery finds trace IDs of spans, service, operation and tags are checked
+// again on the selected spans since SSQL can't compare them exactly, a '*' or '\'
+// in a path value matches more than itself.
+type traceIDQuery struct {
+	filter *traceFilter
+	scope  tagScope
+}
+
+func (tq *traceIDQuery) match(span *dbmodel.Span) bool {
+	if len(tq.filter.service) > 0 && span.Process.ServiceName != tq.filter.service {
+		return false
+	}
+	if len(tq.filter.operation) > 0 && span.OperationName != tq.filter.operation {
+		return false
+	}
+	if len(tq.filter.tags) == 0 {
+		return true
+	}
+
+	tags := tq.scope.values(span)
+	for _, f := range tq.filter.tags {
+		if !f.match(tags) {
+			return false
+		}
+	}
+	return true
+}
+
+// statement returns the query for spans started within [from, to], limited to
+// traces tids unless empty. frame selects wave segments, see waveIndex.
+func (tq *traceIDQuery) statement(frame builder.Clause, from, to int64, tids []string) (string, error) {
+	find := []string{"tid", "st"}
+	if tq.filter.exact() {
+		find = append(find, "s")
+	}
+
+	qry := builder.Find(find...).
+		Where(frame, builder.Var("tid", "/traceID").Exist(), builder.Var("st", timestamp).Timeframe(from, to)).
+		Where(tq.filter.clauses...)
+	if len(tids) > 0 {
+		qry.Where(builder.Path("/traceID").In(tids...))
+	}
+	if tq.filter.exact() {
+		qry.Where(builder.Var("s", "/"))
+	}
+
+	return qry.OrderBy("st", true).Build()
+}
+
+// traceIDSearch finds traces started within [min, max] with a span matching each query.
+type traceIDSearch struct {
+	min, max int64
+	queries  []*traceIDQuery
+}
+
+// buildTraceIdQuery returns one query in span mode. In trace mode it returns a query
+// per filter, service and operation, duration and each tag, whose trace IDs are
+// intersected. Operation stays with service since operations are listed per service.
+func buildTraceIdQuery(query *spanstore.TraceQueryParameters, scope tagScope, mode searchMode) (*traceIDSearch, error) {
+	ts := &traceIDSearch{min: 0, max: math.MaxInt64}
+	if !query.StartTimeMin.IsZero() {
+		ts.min = micros(query.StartTimeMin)
+	}
+	if !query.StartTimeMax.IsZero() {
+		ts.max = micros(query.StartTimeMax)
+	}
+
+	var filters []*traceFilter
+
+	svcOp := &traceFilter{service: query.ServiceName, operation: query.OperationName}
+	if len(query.ServiceName) > 0 {
+		svcOp.clauses = append(svcOp.clauses, builder.Path("/process/serviceName").Equal(query.ServiceName))
+	}
+	if len(query.OperationName) > 0 {
+		svcOp.clauses = append(svcOp.clauses, builder.Path("/operationName").Equal(query.OperationName))
+	}
+	if len(svcOp.clauses) > 0 {
+		filters = append(filters, svcOp)
+	}
+
+	// https://github.com/jaegertracing/jaeger/blob/master/plugin/storage/es/spanstore/dbmodel/from_domain.go#L55
+	if query.DurationMin != 0 && query.DurationMax != 0 {
+		filters = append(filters, &traceFilter{clauses: []builder.Clause{
+			builder.Path("/duration").Between(micros64(query.DurationMin), micros64(query.DurationMax)),
+		}})
+	} else if query.DurationMin > 0 {
+		filters = append(filters, &traceFilter{clauses: []builder.Clause{
+			builder.Path("/duration").Ge(builder.Int(micros64(query.DurationMin))),
+		}})
+	} else if query.DurationMax > 0 {
+		filters = append(filters, &traceFilter{clauses: []builder.Clause{
+			builder.Path("/duration").Le(builder.Int(micros64(query.DurationMax))),
+		}})
+	}
+
+	for k, v := range query.Tags {
+		f, err := parseTagFilter(k, v)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, &traceFilter{clauses: []builder.Clause{f.clause(scope)}, tags: []*tagFilter{f}})
+	}
+
+	if mode != traceSearch || len(filters) < 2 {
+		all := &traceFilter{}
+		for _, f := range filters {
+			all.clauses = append(all.clauses, f.clauses...)
+			all.tags = append(all.tags, f.tags...)
+			if len(f.service) > 0 || len(f.operation) > 0 {
+				all.service, all.operation = f.service, f.operation
+			}
+		}
+		filters = []*traceFilter{all}
+	}
+
+	ts.queries = make([]*traceIDQuery, len(filters))
+	for i, f := range filters {
+		ts.queries[i] = &traceIDQuery{filter: f, scope: scope}
+		// fail early on invalid input rather than mid search
+		frame := builder.Path(timestamp).Timeframe(ts.min, ts.max)
+		if _, err := ts.queries[i].statement(frame, ts.min, ts.max, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	return ts, nil
+}
+
+const (
+	// first search window, it grows by searchWindowGrowth each round
+	searchWindow       = int64(5 * time.Minute / time.Microsecond)
+	searchWindowGrowth = 4
+)
+
+// findTraceIDs returns up to limit distinct trace IDs, newest span first, zero limit
+// returns all. SSQL can't limit distinct values, nor a sorted result, so the first
+// query runs over growing time windows going back from max until limit traces are
+// found. Candidates are then checked against the other queries of trace mode.
+func (wr *WaveRider) findTraceIDs(ctx context.Context, ts *traceIDSearch, limit int) ([]string, error) {
+	var (
+		tids = []string{}
+		seen = map[string]void{}
+		to   = ts.max
+		size = searchWindow
+	)
+
+	if to == math.MaxInt64 {
+		// open end only needs the first window to reach back from now
+		to = micros(time.Now())
+	}
+
+	for hi := ts.max; hi >= ts.min; {
+		lo := to - size
+		if lo < ts.min || lo > to {
+			lo = ts.min
+		}
+
+		candidates, err := wr.queryTraceIDs(ctx, ts.queries[0], lo, hi, nil, seen)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, tq := range ts.queries[1:] {
+			if len(candidates) == 0 {
+				break
+			}
+			found, err := wr.queryTraceIDs(ctx, tq, ts.min, ts.max, candidates, nil)
+			if err != nil {
+				return nil, err
+			}
+			candidates = intersect(candidates, found)
+		}
+
+		for _, tid := range candidates {
+			if limit > 0 && len(tids) >= limit {
+				return tids, nil
+			}
+			tids = append(tids, tid)
+		}
+
+		if lo == ts.min || (limit > 0 && len(tids) >= limit) {
+			break
+		}
+		hi, to = lo-1, lo-1
+		if size < math.MaxInt64/searchWindowGrowth {
+			size *= searchWindowGrowth
+		}
+	}
+
+	return tids, nil
+}
+
+// queryTraceIDs returns distinct trace IDs of spans matching tq within [from, to],
+// newest span first. IDs in seen are skipped, and new ones are added to it.
+func (wr *WaveRider) queryTraceIDs(ctx context.Context, tq *traceIDQuery, from, to int64, in []string, seen map[string]void) ([]string, error) {
+	qry, err := tq.statement(wr.index.frame(from, to), from, to, in)
+	if err != nil {
+		return nil, err
+	}
+
+	jdoc, err := wr.stream.Query(ctx, qry)
+	if err != nil {
+		return nil, err
+	}
+
+	var rs []struct {
+		Tid string
+		S   dbmodel.Span
+	}
+	err = json.Unmarshal(jdoc, &rs)
+	if err != nil || len(rs) == 0 {
+		return nil, err
+	}
+
+	if seen == nil {
+		seen = map[string]void{}
+	}
+	tids := make([]string, 0, len(rs))
+	for _, v := range rs {
+		if _, ok := seen[v.Tid]; ok || !tq.match(&v.S) {
+			continue
+		}
+		seen[v.Tid] = void{}
+		tids = append(tids, v.Tid)
+	}
+
+	return tids, nil
+}
+
+// intersect returns tids also in other, in the order of tids.
+func intersect(tids, other []string) []string {
+	in := make(map[string]void, len(other))
+	for _, tid := range other {
+		in[tid] = void{}
+	}
+
+	n := 0
+	for _, tid := range tids {
+		if _, ok := in[tid]; ok {
+			tids[n] = tid
+			n++
+		}
+	}
+
+	return tids[:n]
+}
+
+// searchTraceIDs answers searches by service and time alone from trace summaries,
+// which match traces started within the time range. Other searches, or ones reaching
+// back before summaries were kept, query spans.
+func (wr *WaveRider) searchTraceIDs(ctx context.Context, query *spanstore.TraceQueryParameters, ts *traceIDSearch) ([]string, error) {
+	bySummary := len(query.OperationName) == 0 && len(query.Tags) == 0 &&
+		query.DurationMin == 0 && query.DurationMax == 0
+	if bySummary && wr.summaries.covers(ts.min) {
+		return wr.summaries.traceIDs(query.ServiceName, ts.min, ts.max, query.NumTraces)
+	}
+
+	return wr.findTraceIDs(ctx, ts, query.NumTraces)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/chronowave/chronowave/embed"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/plugin/storage/es/spanstore/dbmodel"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+)
+
+// testWaveRider returns a WaveRider reading a new wave with a segment per batch of
+// spans, close removes it.
+func testWaveRider(t *testing.T, batches ...[]*model.Span) (wr *WaveRider, close func()) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "wave")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wave := embed.NewWave(dir, timestamp, keys)
+	index, err := openWaveIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	close = func() {
+		index.Close()
+		wave.Close()
+		os.RemoveAll(dir)
+	}
+
+	for _, spans := range batches {
+		docs := make([][]byte, len(spans))
+		for i, span := range spans {
+			if docs[i], err = json.Marshal(dbmodel.FromDomain{}.FromDomainEmbedProcess(span)); err != nil {
+				close()
+				t.Fatal(err)
+			}
+		}
+		if err = testSegment(dir, docs...); err != nil {
+			close()
+			t.Fatal(err)
+		}
+	}
+
+	return &WaveRider{dir: dir, stream: wave, index: index, tagScope: allTags, searchMode: spanSearch}, close
+}
+
+// testSegment indexes docs into a segment of the wave opened in dir.
+func testSegment(dir string, docs ...[]byte) error {
+	batch := filepath.Join(dir, "batch")
+	if err := ioutil.WriteFile(batch, bytes.Join(docs, nil), 0644); err != nil {
+		return err
+	}
+	return embed.Build(batch, timestamp, keys)
+}
+
+func testSpan(trace, span uint64, service string, start time.Time) *model.Span {
+	return &model.Span{
+		TraceID:       model.NewTraceID(0, trace),
+		SpanID:        model.NewSpanID(span),
+		OperationName: "op",
+		StartTime:     start,
+		Duration:      time.Millisecond,
+		Process:       model.NewProcess(service, nil),
+	}
+}
+
+func traceIDs(ids ...uint64) []string {
+	tids := make([]string, len(ids))
+	for i, id := range ids {
+		tids[i] = model.NewTraceID(0, id).String()
+	}
+	return tids
+}
+
+func TestFindTraceIDs(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+
+	// trace 1 has many spans in the first window, traces 2 to 4 and 6 are found in
+	// later and larger windows, the oldest segment spans a day
+	wr, close := testWaveRider(t,
+		[]*model.Span{
+			testSpan(4, 41, "frontend", now.Add(-26*time.Hour)),
+			testSpan(6, 61, "frontend", now.Add(-23*time.Hour)),
+			testSpan(4, 42, "frontend", now.Add(-2*time.Hour)),
+		},
+		[]*model.Span{
+			testSpan(3, 31, "frontend", now.Add(-50*time.Minute)),
+			testSpan(5, 51, "redis", now.Add(-45*time.Minute)),
+		},
+		[]*model.Span{
+			testSpan(1, 11, "frontend", now.Add(-1*time.Minute)),
+			testSpan(1, 12, "frontend", now.Add(-2*time.Minute)),
+			testSpan(1, 13, "frontend", now.Add(-3*time.Minute)),
+			testSpan(1, 14, "frontend", now.Add(-4*time.Minute)),
+			testSpan(2, 21, "frontend", now.Add(-4*time.Minute-30*time.Second)),
+			testSpan(2, 22, "frontend", now.Add(-10*time.Minute)),
+		},
+	)
+	defer close()
+
+	tests := []struct {
+		name     string
+		service  string
+		min, max time.Time
+		limit    int
+		want     []string
+	}{
+		{"distinct traces count to limit", "frontend", time.Time{}, time.Time{}, 2, traceIDs(1, 2)},
+		{"windows grow until limit", "frontend", time.Time{}, time.Time{}, 3, traceIDs(1, 2, 3)},
+		{"no limit", "frontend", time.Time{}, time.Time{}, 0, traceIDs(1, 2, 3, 4, 6)},
+		{"ordered by latest matching span", "frontend", now.Add(-3 * time.Hour), now.Add(-3 * time.Minute), 0, traceIDs(1, 2, 3, 4)},
+		{"start time min", "frontend", now.Add(-1 * time.Hour), time.Time{}, 0, traceIDs(1, 2, 3)},
+		{"start time max", "frontend", time.Time{}, now.Add(-5 * time.Minute), 0, traceIDs(2, 3, 4, 6)},
+		{"within the time a segment spans", "frontend", now.Add(-25 * time.Hour), now.Add(-20 * time.Hour), 0, traceIDs(6)},
+		{"other service", "redis", time.Time{}, time.Time{}, 20, traceIDs(5)},
+		{"no match", "driver", time.Time{}, time.Time{}, 20, []string{}},
+		{"service matched exactly", "front*", time.Time{}, time.Time{}, 20, []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts, err := buildTraceIdQuery(&spanstore.TraceQueryParameters{
+				ServiceName:  tt.service,
+				StartTimeMin: tt.min,
+				StartTimeMax: tt.max,
+			}, wr.tagScope, wr.searchMode)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := wr.findTraceIDs(context.Background(), ts, tt.limit)
+			if err != nil {
+				t.Fatalf("findTraceIDs() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("findTraceIDs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIntersect(t *testing.T) {
+	tests := []struct {
+		name        string
+		tids, other []string
+		want        []string
+	}{
+		{"keeps order", []string{"c", "a", "b"}, []string{"b", "c"}, []string{"c", "b"}},
+		{"none", []string{"a"}, []string{"b"}, []string{}},
+		{"empty other", []string{"a"}, nil, []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := intersect(tt.tids, tt.other); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("intersect() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
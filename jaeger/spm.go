@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Service Performance Monitoring reads RED metrics buckets like metricsstore.Reader of
+// newer Jaeger releases, which the v1.20 storage this module builds against has not.
+// No plugin protocol serves a metrics reader either, so it is served over HTTP as
+// Jaeger query's /api/metrics, see routes.
+
+// baseQueryParameters mirrors metricsstore.BaseQueryParameters.
+type baseQueryParameters struct {
+	ServiceNames     []string
+	GroupByOperation bool
+	EndTime          time.Time
+	Lookback         time.Duration
+	Step             time.Duration
+	RatePer          time.Duration
+	SpanKinds        []string
+}
+
+// latenciesQueryParameters mirrors metricsstore.LatenciesQueryParameters.
+type latenciesQueryParameters struct {
+	baseQueryParameters
+	Quantile float64
+}
+
+// metricFamily and its parts encode as metrics.MetricFamily of Jaeger's API.
+type metricFamily struct {
+	Name    string   `json:"name"`
+	Type    string   `json:"type"`
+	Help    string   `json:"help"`
+	Metrics []metric `json:"metrics"`
+}
+
+type metric struct {
+	Labels       []metricLabel `json:"labels"`
+	MetricPoints []metricPoint `json:"metricPoints"`
+}
+
+type metricLabel struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type metricPoint struct {
+	GaugeValue gaugeValue `json:"gaugeValue"`
+	Timestamp  time.Time  `json:"timestamp"`
+}
+
+type gaugeValue struct {
+	DoubleValue float64 `json:"doubleValue"`
+}
+
+var errNoServiceNames = errors.New("please provide at least one service name")
+
+// GetLatencies returns the Quantile of span durations in milliseconds per service,
+// or operation, over RatePer windows every Step.
+func (wr *WaveRider) GetLatencies(ctx context.Context, params *latenciesQueryParameters) (*metricFamily, error) {
+	if params.Quantile <= 0 || params.Quantile > 1 {
+		return nil, errors.New("quantile must be within (0, 1]")
+	}
+	help := strconv.FormatFloat(params.Quantile, 'g', -1, 64) + "th quantile latency, in milliseconds"
+	return wr.spmMetrics(ctx, &params.baseQueryParameters, "latencies", help,
+		func(s *redSeries, window time.Duration) (float64, bool) {
+			if s.Calls == 0 {
+				return 0, false
+			}
+			return float64(s.Durations.percentile(params.Quantile*100)) / float64(time.Millisecond/time.Microsecond), true
+		})
+}
+
+// GetCallRates returns calls per second per service, or operation, over RatePer windows every Step.
+func (wr *WaveRider) GetCallRates(ctx context.Context, params *baseQueryParameters) (*metricFamily, error) {
+	return wr.spmMetrics(ctx, params, "call_rate", "calls/sec",
+		func(s *redSeries, window time.Duration) (float64, bool) {
+			return float64(s.Calls) / window.Seconds(), true
+		})
+}
+
+// GetErrorRates returns the fraction of spans with tag error=true per service, or
+// operation, over RatePer windows every Step.
+func (wr *WaveRider) GetErrorRates(ctx context.Context, params *baseQueryParameters) (*metricFamily, error) {
+	return wr.spmMetrics(ctx, params, "error_rate", "error rate, computed as a fraction of errors/sec over calls/sec",
+		func(s *redSeries, window time.Duration) (float64, bool) {
+			if s.Calls == 0 {
+				return 0, false
+			}
+			return float64(s.Errors) / float64(s.Calls), true
+		})
+}
+
+// GetMinStepDuration returns the bucket size, a smaller step repeats values.
+func (wr *WaveRider) GetMinStepDuration(ctx context.Context) (time.Duration, error) {
+	return time.Duration(wr.metrics.size) * time.Microsecond, nil
+}
+
+// spmMetrics sums buckets of the services and span kinds in params into a window of
+// RatePer, at least a bucket, ending at every Step back from EndTime, and returns
+// value of every window it gives.
+func (wr *WaveRider) spmMetrics(ctx context.Context, params *baseQueryParameters, name, help string,
+	value func(s *redSeries, window time.Duration) (float64, bool)) (*metricFamily, error) {
+	if len(params.ServiceNames) == 0 {
+		return nil, errNoServiceNames
+	}
+
+	size := wr.metrics.size
+	step := max64(micros64(params.Step), size)
+	window := max64(micros64(params.RatePer), size)
+	end := micros(params.EndTime)
+	start := end - micros64(params.Lookback)
+
+	buckets, err := wr.metrics.buckets(ctx, wr.metrics.floor(max64(0, start-window)), end)
+	if err != nil {
+		return nil, err
+	}
+
+	services := make(map[string]bool, len(params.ServiceNames))
+	for _, s := range params.ServiceNames {
+		services[s] = true
+	}
+	kinds := make(map[string]bool, len(params.SpanKinds))
+	for _, k := range params.SpanKinds {
+		kinds[spanKind(k)] = true
+	}
+
+	type group struct{ service, operation string }
+	series := map[group]map[int64]*redSeries{}
+	for b, bucket := range buckets {
+		for k, s := range bucket {
+			if !services[k.service] || (len(kinds) > 0 && !kinds[spanKind(k.kind)]) {
+				continue
+			}
+			g := group{service: k.service}
+			if params.GroupByOperation {
+				g.operation = k.operation
+			}
+			if series[g] == nil {
+				series[g] = map[int64]*redSeries{}
+			}
+			if cur, ok := series[g][b]; ok {
+				cur.merge(s)
+				continue
+			}
+			sum := &redSeries{}
+			sum.merge(s)
+			series[g][b] = sum
+		}
+	}
+
+	family := &metricFamily{Name: "service_" + name, Type: "GAUGE", Help: help + ", grouped by service"}
+	if params.GroupByOperation {
+		family.Name = "service_operation_" + name
+		family.Help = help + ", grouped by service & operation"
+	}
+	family.Metrics = []metric{}
+
+	groups := make([]group, 0, len(series))
+	for g := range series {
+		groups = append(groups, g)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].service != groups[j].service {
+			return groups[i].service < groups[j].service
+		}
+		return groups[i].operation < groups[j].operation
+	})
+
+	windowDuration := time.Duration(window) * time.Microsecond
+	for _, g := range groups {
+		m := metric{Labels: []metricLabel{{Name: "service_name", Value: g.service}}, MetricPoints: []metricPoint{}}
+		if params.GroupByOperation {
+			m.Labels = append(m.Labels, metricLabel{Name: "operation", Value: g.operation})
+		}
+
+		times := make([]int64, 0, len(series[g]))
+		for b := range series[g] {
+			times = append(times, b)
+		}
+		sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+
+		// points oldest first, like a Prometheus range query. The window slides over
+		// buckets in time order, each bucket enters and leaves the sum once.
+		sum := &redSeries{}
+		lo, hi := 0, 0
+		first := end - (end-start)/step*step
+		for t := first; t <= end; t += step {
+			for ; hi < len(times) && times[hi] < t; hi++ {
+				sum.merge(series[g][times[hi]])
+			}
+			for ; lo < hi && times[lo] < t-window; lo++ {
+				sum.subtract(series[g][times[lo]])
+			}
+			if v, ok := value(sum, windowDuration); ok && !math.IsNaN(v) {
+				m.MetricPoints = append(m.MetricPoints, metricPoint{
+					GaugeValue: gaugeValue{DoubleValue: v},
+					Timestamp:  time.Unix(0, t*int64(time.Microsecond)).UTC(),
+				})
+			}
+		}
+		family.Metrics = append(family.Metrics, m)
+	}
+
+	return family, nil
+}
+
+// spanKind returns k as stored in span.kind tags, "SPAN_KIND_SERVER" and "server" alike,
+// unspecified is empty.
+func spanKind(k string) string {
+	k = strings.ToLower(strings.TrimPrefix(strings.ToUpper(k), "SPAN_KIND_"))
+	if k == "unspecified" {
+		return ""
+	}
+	return k
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSpmWindows(t *testing.T) {
+	wr, close := testWaveRider(t)
+	defer close()
+	wr.metrics = testRedMetrics(wr, time.Minute)
+
+	// GET / calls per minute, a failed POST / in the third and client calls in the second
+	base := time.Unix(1599998400, 0)
+	for i, n := range []int{1, 2, 3, 4} {
+		wr.metrics.observe(testCalls(n, "frontend", "GET /", "server", base.Add(time.Duration(i)*time.Minute), time.Millisecond, false))
+	}
+	wr.metrics.observe(testCalls(1, "frontend", "POST /", "server", base.Add(2*time.Minute), time.Millisecond, true))
+	wr.metrics.observe(testCalls(6, "frontend", "GET", "client", base.Add(time.Minute), time.Millisecond, false))
+	wr.metrics.observe(testCalls(5, "redis", "GET", "server", base, time.Millisecond, false))
+
+	type point struct {
+		at    time.Duration // after base
+		value float64
+	}
+	get := []metricLabel{{"service_name", "frontend"}, {"operation", "GET /"}}
+	post := []metricLabel{{"service_name", "frontend"}, {"operation", "POST /"}}
+	tests := []struct {
+		name      string
+		errors    bool // error rates instead of call rates
+		byOp      bool
+		step      time.Duration
+		ratePer   time.Duration
+		kinds     []string
+		operation []metricLabel // labels of the metric compared
+		want      []point
+	}{
+		{
+			"a bucket per window",
+			false, false, time.Minute, time.Minute, []string{"server"}, nil,
+			[]point{{0, 0}, {time.Minute, 1.0 / 60}, {2 * time.Minute, 2.0 / 60}, {3 * time.Minute, 4.0 / 60}, {4 * time.Minute, 4.0 / 60}, {5 * time.Minute, 0}},
+		},
+		{
+			"window of three buckets",
+			false, false, time.Minute, 3 * time.Minute, []string{"server"}, nil,
+			[]point{{0, 0}, {time.Minute, 1.0 / 180}, {2 * time.Minute, 3.0 / 180}, {3 * time.Minute, 7.0 / 180}, {4 * time.Minute, 10.0 / 180}, {5 * time.Minute, 8.0 / 180}},
+		},
+		{
+			"step of two buckets ends at end",
+			false, false, 2 * time.Minute, 2 * time.Minute, []string{"server"}, nil,
+			[]point{{time.Minute, 1.0 / 120}, {3 * time.Minute, 6.0 / 120}, {5 * time.Minute, 4.0 / 120}},
+		},
+		{
+			"step and window shorter than a bucket",
+			false, false, time.Second, time.Second, []string{"server"}, nil,
+			[]point{{0, 0}, {time.Minute, 1.0 / 60}, {2 * time.Minute, 2.0 / 60}, {3 * time.Minute, 4.0 / 60}, {4 * time.Minute, 4.0 / 60}, {5 * time.Minute, 0}},
+		},
+		{
+			"all kinds",
+			false, false, time.Minute, time.Minute, nil, nil,
+			[]point{{0, 0}, {time.Minute, 1.0 / 60}, {2 * time.Minute, 8.0 / 60}, {3 * time.Minute, 4.0 / 60}, {4 * time.Minute, 4.0 / 60}, {5 * time.Minute, 0}},
+		},
+		{
+			"by operation",
+			false, true, time.Minute, time.Minute, []string{"SPAN_KIND_SERVER"}, get,
+			[]point{{0, 0}, {time.Minute, 1.0 / 60}, {2 * time.Minute, 2.0 / 60}, {3 * time.Minute, 3.0 / 60}, {4 * time.Minute, 4.0 / 60}, {5 * time.Minute, 0}},
+		},
+		{
+			"error rate skips windows without calls",
+			true, false, time.Minute, time.Minute, []string{"server"}, nil,
+			[]point{{time.Minute, 0}, {2 * time.Minute, 0}, {3 * time.Minute, 0.25}, {4 * time.Minute, 0}},
+		},
+		{
+			"error rate by operation",
+			true, true, time.Minute, 2 * time.Minute, []string{"server"}, post,
+			[]point{{3 * time.Minute, 1}, {4 * time.Minute, 1}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params := &baseQueryParameters{
+				ServiceNames:     []string{"frontend"},
+				GroupByOperation: tt.byOp,
+				EndTime:          base.Add(5 * time.Minute),
+				Lookback:         5 * time.Minute,
+				Step:             tt.step,
+				RatePer:          tt.ratePer,
+				SpanKinds:        tt.kinds,
+			}
+			get, name := wr.GetCallRates, "call_rate"
+			if tt.errors {
+				get, name = wr.GetErrorRates, "error_rate"
+			}
+			family, err := get(context.Background(), params)
+			if err != nil {
+				t.Fatalf("%s error = %v", name, err)
+			}
+
+			labels := tt.operation
+			if labels == nil {
+				labels = []metricLabel{{"service_name", "frontend"}}
+			}
+			var m *metric
+			for i := range family.Metrics {
+				if reflect.DeepEqual(family.Metrics[i].Labels, labels) {
+					m = &family.Metrics[i]
+				}
+			}
+			if m == nil {
+				t.Fatalf("%s has no metric %v in %+v", name, labels, family.Metrics)
+			}
+
+			got := make([]point, len(m.MetricPoints))
+			for i, p := range m.MetricPoints {
+				got[i] = point{p.Timestamp.Sub(base), p.GaugeValue.DoubleValue}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("%s = %v, want %v", name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSpmNoServices(t *testing.T) {
+	wr := &WaveRider{metrics: &redMetrics{size: micros64(time.Minute)}}
+	if _, err := wr.GetCallRates(context.Background(), &baseQueryParameters{}); err != errNoServiceNames {
+		t.Errorf("GetCallRates() error = %v, want %v", err, errNoServiceNames)
+	}
+	if _, err := wr.GetLatencies(context.Background(), &latenciesQueryParameters{Quantile: 1.5}); err == nil {
+		t.Error("GetLatencies() of quantile 1.5 error = nil")
+	}
+}
@@ -3,10 +3,7 @@ package main
 import (
 	"context"
 	"encoding/json"
-	"math"
-	"strconv"
-	"strings"
-	"sync"
+	"path/filepath"
 	"time"
 
 	"github.com/chronowave/chronowave/embed"
@@ -16,10 +13,16 @@ import (
 	"github.com/jaegertracing/jaeger/storage/dependencystore"
 	"github.com/jaegertracing/jaeger/storage/spanstore"
 	"github.com/labstack/echo/v4"
+	"github.com/opentracing/opentracing-go/ext"
+
+	"chronowave-jaeger/builder"
 )
 
 const (
 	timestamp = "/startTime"
+
+	// traces kept by tail retention are saved under chronowave.dir in
+	keptDir = "kept"
 )
 
 var (
@@ -27,7 +30,8 @@ var (
 )
 
 type cwPlugin struct {
-	store *WaveRider
+	store   *WaveRider
+	archive *ArchiveRider
 }
 
 func (p *cwPlugin) SpanReader() spanstore.Reader {
@@ -42,77 +46,184 @@ func (p *cwPlugin) DependencyReader() dependencystore.Reader {
 	return p.store
 }
 
+func (p *cwPlugin) ArchiveSpanReader() spanstore.Reader {
+	return p.archive
+}
+
+func (p *cwPlugin) ArchiveSpanWriter() spanstore.Writer {
+	return p.archive
+}
+
 type WaveRider struct {
-	logger            hclog.Logger
-	stream            *embed.WaveStream
-	echo              *echo.Echo
-	from              dbmodel.FromDomain
-	to                dbmodel.ToDomain
-	ttlTicker         *time.Ticker
-	once              sync.Once
-	serviceOperations map[string]map[string]bool
-	rwLock            sync.RWMutex
+	logger     hclog.Logger
+	dir        string
+	archiveDir string // of the archive storage, backed up with the wave
+	stream     *embed.WaveStream
+	batcher    *spanBatcher
+	echo       *echo.Echo
+	otlp       *otlpReceiver
+	from       dbmodel.FromDomain
+	to         dbmodel.ToDomain
+	ttlTicker  *time.Ticker
+	catalog    *catalog
+	summaries  *summaries
+	index      *waveIndex
+	retention  *segmentRetention // nil without retention rules
+	deps       *dependencyBuckets
+	metrics    *redMetrics
+	disk       *diskQuota
+	kept       *ArchiveRider // traces kept by tail retention, nil if it's off
+	tail       *tailRetention
+	dedup      *spanDeduper
+	tagScope   tagScope
+	searchMode searchMode
 }
 
 func newWaveRider(logger hclog.Logger, conf *conf) *WaveRider {
 	wave := embed.NewWave(conf.dir, timestamp, keys)
+	cat, err := openCatalog(conf.dir)
+	if err != nil {
+		panic(err)
+	}
+	// catalog predates data written by releases without it
+	backfill := cat.isEmpty()
+
+	sum, err := openSummaries(conf.dir)
+	if err != nil {
+		panic(err)
+	}
+
+	index, err := openWaveIndex(conf.dir)
+	if err != nil {
+		panic(err)
+	}
+
+	policy := &retentionPolicy{rules: conf.retention, ttl: conf.ttl, scope: conf.tagScope}
+	var ret *segmentRetention
+	if len(conf.retention) > 0 {
+		if ret, err = openSegmentRetention(conf.dir, policy, sum); err != nil {
+			panic(err)
+		}
+	}
+
 	var tc *time.Ticker
-	if conf.ttl < time.Hour {
-		tc = time.NewTicker(conf.ttl)
+	if policy.minTTL() < time.Hour {
+		tc = time.NewTicker(policy.minTTL())
 	} else {
 		tc = time.NewTicker(time.Hour)
 	}
-	go purge(tc, conf.ttl, wave)
-	return &WaveRider{
-		logger:            logger,
-		stream:            wave,
-		echo:              startEcho(wave, conf.port),
-		from:              dbmodel.FromDomain{},
-		to:                dbmodel.ToDomain{},
-		ttlTicker:         tc,
-		serviceOperations: map[string]map[string]bool{},
-	}
+	go purge(tc, policy, conf.tailTTL, wave, ret, cat, sum)
+	wr := &WaveRider{
+		logger:     logger,
+		dir:        conf.dir,
+		archiveDir: conf.archiveDir,
+		stream:     wave,
+		from:       dbmodel.FromDomain{},
+		to:         dbmodel.ToDomain{},
+		ttlTicker:  tc,
+		catalog:    cat,
+		summaries:  sum,
+		index:      index,
+		retention:  ret,
+		deps:       newDependencyBuckets(wave, index, conf.depBucket, policy.maxTTL()),
+		metrics:    newRedMetrics(wave, index, conf.metricsBucket),
+		disk:       newDiskQuota(conf.dir, conf.diskQuota, wave, index, cat, sum, conf.tailTTL > 0),
+		dedup:      newSpanDeduper(conf.dedupWindow),
+		tagScope:   conf.tagScope,
+		searchMode: conf.searchMode,
+	}
+	if conf.tailTTL > 0 {
+		wr.kept = newArchiveRider(logger, filepath.Join(conf.dir, keptDir), conf.tailTTL)
+		wr.tail = newTailRetention(wave, index, sum, wr.kept, conf)
+	}
+	wr.echo = startEcho(wave, conf.port, wr.routes)
+	wr.batcher = newSpanBatcher(wave, conf, wr.afterFlush)
+	wr.otlp = startOTLP(wr, conf.otlpHTTP, conf.otlpGRPC)
+
+	if backfill {
+		go wr.queryService(policy.maxTTL())
+	}
+
+	return wr
 }
 
 func (wr *WaveRider) Close() {
 	wr.ttlTicker.Stop()
 	wr.echo.Shutdown(context.Background())
+	wr.otlp.Close()
+	wr.batcher.Close()
+	wr.deps.Close()
+	wr.metrics.Close()
+	wr.disk.Close()
+	if wr.tail != nil {
+		wr.tail.Close()
+		wr.kept.Close()
+	}
+	if wr.retention != nil {
+		wr.retention.Close()
+	}
+	wr.catalog.Close()
+	wr.summaries.Close()
+	wr.index.Close()
 	wr.stream.Close()
 }
 
+// WriteSpan queues span for the wave. It returns ErrBackPressure instead of blocking
+// when the write buffer is full, and ErrDiskQuota while the data directory is over quota.
+// A span with the trace ID, span ID, start time and kind of one written within
+// chronowave.dedup.window is dropped.
 func (wr *WaveRider) WriteSpan(ctx context.Context, span *model.Span) error {
-	wr.updateSvcOp(span)
+	if wr.disk.isDegraded() {
+		return ErrDiskQuota
+	}
+	if !wr.dedup.add(span) {
+		// written already, e.g. by a retry
+		return nil
+	}
 
 	jsonSpan := wr.from.FromDomainEmbedProcess(span)
 	json, err := json.Marshal(jsonSpan)
 	if err == nil {
-		err = wr.stream.OnNewDocument(json)
+		err = wr.batcher.add(span, json)
+	}
+	if err != nil {
+		wr.dedup.forget(span)
 	}
 
 	return err
 }
 
-func (wr *WaveRider) updateSvcOp(span *model.Span) {
-	wr.rwLock.Lock()
-	defer wr.rwLock.Unlock()
-	op, ok := wr.serviceOperations[span.Process.ServiceName]
-	if !ok {
-		op = map[string]bool{}
-		wr.serviceOperations[span.Process.ServiceName] = op
+// afterFlush updates the catalog, trace summaries, RED metrics and dependency buckets with a batch
+// written to the wave.
+func (wr *WaveRider) afterFlush(batch []pendingSpan) {
+	wr.updateSvcOp(batch, micros(time.Now()))
+	wr.metrics.observe(batch)
+	wr.deps.observe(batch)
+	if err := wr.summaries.observe(batch); err != nil {
+		wr.logger.Error("failed to update trace summaries", "error", err)
 	}
+}
 
-	op[span.OperationName] = true
+// updateSvcOp records service and operation names of a batch written at written in
+// the catalog, zero if that's unknown.
+func (wr *WaveRider) updateSvcOp(batch []pendingSpan, written int64) {
+	if err := wr.catalog.observe(batch, written); err != nil {
+		wr.logger.Error("failed to update service catalog", "error", err)
+	}
 }
 
-// GetTrace retrieves the trace with a given id.
+// GetTrace retrieves the trace with a given id, without duplicate spans.
 //
 // If no spans are stored for this trace, it returns ErrTraceNotFound.
 func (wr *WaveRider) GetTrace(ctx context.Context, traceID model.TraceID) (*model.Trace, error) {
-	sb := strings.Builder{}
-	sb.WriteString("FIND $s WHERE [/traceID KEY('")
-	sb.WriteString(traceID.String())
-	sb.WriteString("')] [$s /]")
-	jdoc, err := wr.stream.Query(ctx, sb.String())
+	qry, err := builder.Find("s").
+		Where(builder.Path("/traceID").Key(traceID.String()), builder.Var("s", "/")).
+		Build()
+	if err != nil {
+		return nil, err
+	}
+
+	jdoc, err := wr.stream.Query(ctx, qry)
 	if err != nil {
 		return nil, err
 	}
@@ -122,6 +233,9 @@ func (wr *WaveRider) GetTrace(ctx context.Context, traceID model.TraceID) (*mode
 	if err != nil {
 		return nil, err
 	}
+	if len(rs) == 0 && wr.kept != nil {
+		return wr.kept.GetTrace(ctx, traceID)
+	}
 
 	spans := make([]*model.Span, len(rs))
 	for i, v := range rs {
@@ -130,83 +244,55 @@ func (wr *WaveRider) GetTrace(ctx context.Context, traceID model.TraceID) (*mode
 		}
 	}
 
-	return &model.Trace{Spans: spans}, nil
+	return &model.Trace{Spans: wr.dedup.collapse(spans)}, nil
 }
 
 // GetServices returns all service names known to the backend from spans
 // within its retention period.
 func (wr *WaveRider) GetServices(ctx context.Context) ([]string, error) {
-	wr.once.Do(wr.queryService)
-
-	svc := make([]string, len(wr.serviceOperations))
-	i := 0
-	for k := range wr.serviceOperations {
-		svc[i] = k
-		i++
-	}
-
-	return svc, nil
+	return wr.catalog.services(), nil
 }
 
 // GetOperations returns all operation names for a given service
 // known to the backend from spans within its retention period.
 func (wr *WaveRider) GetOperations(ctx context.Context, query spanstore.OperationQueryParameters) ([]spanstore.Operation, error) {
-	wr.once.Do(wr.queryService)
-
-	wr.rwLock.RLock()
-	ops := wr.serviceOperations[query.ServiceName]
-	wr.rwLock.RUnlock()
-
-	retMe := make([]spanstore.Operation, len(ops))
-	i := 0
-	for k := range ops {
-		retMe[i].Name = k
-		i++
-	}
-
-	return retMe, nil
+	return wr.catalog.operations(query.ServiceName, query.SpanKind), nil
 }
 
 // FindTraces returns all traces matching query parameters. There's currently
 // an implementation-dependent abiguity whether all query filters (such as
 // multiple tags) must apply to the same span within a trace, or can be satisfied
-// by different spans.
+// by different spans. Here it is chronowave.search.mode, span by default.
+//
+// Traces are returned newest first by their latest matching span, NumTraces counts traces.
+//
+// Duplicate spans are left out.
 //
 // If no matching traces are found, the function returns (nil, nil).
 func (wr *WaveRider) FindTraces(ctx context.Context, query *spanstore.TraceQueryParameters) ([]*model.Trace, error) {
-	qry, min, max := buildTraceIdQuery(query)
-	jdoc, err := wr.stream.Query(ctx, qry)
+	ts, err := buildTraceIdQuery(query, wr.tagScope, wr.searchMode)
 	if err != nil {
 		return nil, err
 	}
 
-	var rs []struct{ Tid string }
-	err = json.Unmarshal(jdoc, &rs)
-	if err != nil || len(rs) == 0 {
+	tids, err := wr.searchTraceIDs(ctx, query, ts)
+	if err != nil || len(tids) == 0 {
 		return nil, err
 	}
-	if len(rs) > query.NumTraces {
-		rs = rs[:query.NumTraces]
-	}
 
-	sb := strings.Builder{}
-	sb.WriteString("FIND $s WHERE [$s /] [/startTime TIMEFRAME(")
-	sb.WriteString(strconv.FormatInt(min, 10))
-	sb.WriteString(",")
-	sb.WriteString(strconv.FormatInt(max, 10))
-	sb.WriteString(")] [/traceID IN(")
-
-	comma := ""
-	for _, v := range rs {
-		sb.WriteString(comma)
-		sb.WriteByte('\'')
-		sb.WriteString(v.Tid)
-		sb.WriteByte('\'')
-		comma = ","
+	qry, err := builder.Find("s").
+		Where(
+			wr.index.frame(ts.min, ts.max),
+			builder.Var("s", "/"),
+			builder.Path(timestamp).Timeframe(ts.min, ts.max),
+			builder.Path("/traceID").In(tids...),
+		).
+		Build()
+	if err != nil {
+		return nil, err
 	}
-	sb.WriteString(")]")
 
-	jdoc, err = wr.stream.Query(ctx, sb.String())
+	jdoc, err := wr.stream.Query(ctx, qry)
 	if err != nil {
 		return nil, err
 	}
@@ -217,7 +303,7 @@ func (wr *WaveRider) FindTraces(ctx context.Context, query *spanstore.TraceQuery
 		return nil, err
 	}
 
-	traces := make(map[string]*model.Trace, len(spans))
+	traces := make(map[string]*model.Trace, len(tids))
 	for _, v := range spans {
 		if span, err := wr.to.SpanToDomain(v.S); err == nil {
 			traceid := span.TraceID.String()
@@ -231,12 +317,20 @@ func (wr *WaveRider) FindTraces(ctx context.Context, query *spanstore.TraceQuery
 		}
 	}
 
-	retMe := make([]*model.Trace, len(traces))
-
-	i := 0
-	for _, v := range traces {
-		retMe[i] = v
-		i++
+	// keep the order of tids, the map lost it
+	retMe := make([]*model.Trace, 0, len(traces))
+	for _, tid := range tids {
+		if trace, ok := traces[tid]; ok {
+			trace.Spans = wr.dedup.collapse(trace.Spans)
+			retMe = append(retMe, trace)
+		} else if wr.kept != nil {
+			// purged from the wave, but kept by tail retention
+			if id, err := model.TraceIDFromString(tid); err == nil {
+				if trace, err = wr.kept.GetTrace(ctx, id); err == nil {
+					retMe = append(retMe, trace)
+				}
+			}
+		}
 	}
 
 	return retMe, nil
@@ -247,21 +341,19 @@ func (wr *WaveRider) FindTraces(ctx context.Context, query *spanstore.TraceQuery
 //
 // If no matching traces are found, the function returns (nil, nil).
 func (wr *WaveRider) FindTraceIDs(ctx context.Context, query *spanstore.TraceQueryParameters) ([]model.TraceID, error) {
-	qry, _, _ := buildTraceIdQuery(query)
-	jdoc, err := wr.stream.Query(ctx, qry)
+	ts, err := buildTraceIdQuery(query, wr.tagScope, wr.searchMode)
 	if err != nil {
 		return nil, err
 	}
 
-	var rs []struct{ Tid string }
-	err = json.Unmarshal(jdoc, &rs)
-	if err != nil || len(rs) == 0 {
+	tids, err := wr.searchTraceIDs(ctx, query, ts)
+	if err != nil || len(tids) == 0 {
 		return nil, err
 	}
 
-	retMe := make([]model.TraceID, len(rs))
-	for i, v := range rs {
-		if retMe[i], err = model.TraceIDFromString(v.Tid); err != nil {
+	retMe := make([]model.TraceID, len(tids))
+	for i, v := range tids {
+		if retMe[i], err = model.TraceIDFromString(v); err != nil {
 			return nil, err
 		}
 	}
@@ -269,174 +361,97 @@ func (wr *WaveRider) FindTraceIDs(ctx context.Context, query *spanstore.TraceQue
 	return retMe, nil
 }
 
+// GetDependencies sums precomputed dependency buckets overlapping the lookback, see dependencyBuckets.
+// FollowsFrom links have Source followsFromLinkSource.
 func (wr *WaveRider) GetDependencies(ctx context.Context, endTs time.Time, lookback time.Duration) ([]model.DependencyLink, error) {
-	sb := strings.Builder{}
-	sb.WriteString("FIND $ref, $sid, $svc WHERE [$ref /references][$sid /spanID][$svc /process/serviceName]")
-	sb.WriteString("[/startTime TIMEFRAME(")
-	sb.WriteString(strconv.FormatInt(endTs.Add(-1*lookback).UnixNano()/1000, 10))
-	sb.WriteString(",")
-	sb.WriteString(strconv.FormatInt(endTs.UnixNano()/1000, 10))
-	sb.WriteString(")]")
-
-	jdoc, err := wr.stream.Query(ctx, sb.String())
-	if err != nil {
-		return nil, err
-	}
-
-	var rs []struct {
-		Ref []dbmodel.Reference
-		Sid string
-		Svc string
-	}
-	err = json.Unmarshal(jdoc, &rs)
+	links, err := wr.deps.links(ctx, max64(0, micros(endTs.Add(-1*lookback))), micros(endTs))
 	if err != nil {
 		return nil, err
 	}
 
-	spanMap := make(map[string]int, len(rs))
-	for i, s := range rs {
-		spanMap[s.Sid] = i
-	}
-
-	deps := make(map[string]int, len(rs))
-	retMe := make([]model.DependencyLink, 0, len(rs))
-	for _, v := range rs {
-		var pid string
-		for _, r := range v.Ref {
-			if r.RefType == dbmodel.ChildOf {
-				pid = string(r.SpanID)
-			}
-		}
-		if len(pid) == 0 {
-			continue
-		}
-
-		if parent, ok := spanMap[pid]; ok {
-			if strings.Compare(rs[parent].Svc, v.Svc) == 0 {
-				continue
-			}
-			depKey := rs[parent].Svc + "&&&" + v.Svc
-			if i, ok := deps[depKey]; !ok {
-				deps[depKey] = len(retMe)
-				retMe = append(retMe, model.DependencyLink{
-					Parent:    rs[parent].Svc,
-					Child:     v.Svc,
-					CallCount: 1,
-				})
-			} else {
-				retMe[i].CallCount++
-			}
-		}
+	retMe := make([]model.DependencyLink, len(links))
+	for i, l := range links {
+		retMe[i] = l.toDomain()
 	}
 
 	return retMe, nil
 }
 
-func (wr *WaveRider) queryService() {
-	sb := strings.Builder{}
-	sb.WriteString("FIND $svc, $op WHERE [$svc /process/serviceName][$op /operationName]")
-	sb.WriteString("[/startTime TIMEFRAME(")
-	sb.WriteString(strconv.FormatInt(time.Now().Add(-336*time.Hour).UnixNano()/1000, 10))
-	sb.WriteString(",")
-	sb.WriteString(strconv.FormatInt(time.Now().UnixNano()/1000, 10))
-	sb.WriteString(")]")
-
-	jdoc, err := wr.stream.Query(context.Background(), sb.String())
+// queryService fills the catalog from spans stored within retention period.
+func (wr *WaveRider) queryService(lookback time.Duration) {
+	now := time.Now()
+	qry := builder.Find("svc", "op", "st", "tags").
+		Where(
+			wr.index.frame(micros(now.Add(-1*lookback)), micros(now)),
+			builder.Var("svc", "/process/serviceName").Exist(),
+			builder.Var("op", "/operationName"),
+			builder.Var("tags", "/tags"),
+			builder.Var("st", timestamp).Timeframe(micros(now.Add(-1*lookback)), micros(now)),
+		).
+		MustBuild()
+
+	jdoc, err := wr.stream.Query(context.Background(), qry)
 	if err != nil {
 		return
 	}
 
 	var rs []struct {
-		Svc string
-		Op  string
+		Svc  string
+		Op   string
+		St   int64
+		Tags []dbmodel.KeyValue
 	}
 	err = json.Unmarshal(jdoc, &rs)
 	if err != nil {
 		return
 	}
 
-	wr.rwLock.Lock()
-	defer wr.rwLock.Unlock()
-	for _, v := range rs {
-		op, ok := wr.serviceOperations[v.Svc]
-		if !ok {
-			op = map[string]bool{}
-			wr.serviceOperations[v.Svc] = op
+	batch := make([]pendingSpan, len(rs))
+	for i, v := range rs {
+		batch[i] = pendingSpan{service: v.Svc, op: v.Op, startTime: v.St}
+		for _, kv := range v.Tags {
+			if kv.Key == string(ext.SpanKind) {
+				batch[i].kind, _ = kv.Value.(string)
+			}
 		}
-		op[v.Op] = true
 	}
+	wr.updateSvcOp(batch, 0)
 }
 
-func buildTraceIdQuery(query *spanstore.TraceQueryParameters) (string, int64, int64) {
-	min, max := int64(0), int64(math.MaxInt64)
-	if !query.StartTimeMin.IsZero() {
-		min = query.StartTimeMin.UnixNano() / int64(1000)
-	}
-	if !query.StartTimeMax.IsZero() {
-		max = query.StartTimeMax.UnixNano() / int64(1000)
-	}
-
-	sb := strings.Builder{}
-	sb.WriteString("FIND $tid, $st WHERE [$tid /traceID] [$st /startTime TIMEFRAME(")
-	sb.WriteString(strconv.FormatInt(min, 10))
-	sb.WriteString(",")
-	sb.WriteString(strconv.FormatInt(max, 10))
-	sb.WriteString(")]")
-
-	if len(query.ServiceName) > 0 {
-		sb.WriteString("[/process/serviceName CONTAIN('^")
-		sb.WriteString(query.ServiceName)
-		sb.WriteString("$')]")
-	}
-
-	if len(query.OperationName) > 0 {
-		sb.WriteString("[/operationName CONTAIN('^")
-		sb.WriteString(query.OperationName)
-		sb.WriteString("$')]")
-	}
-
-	// https://github.com/jaegertracing/jaeger/blob/master/plugin/storage/es/spanstore/dbmodel/from_domain.go#L55
-	if query.DurationMin != 0 && query.DurationMax != 0 {
-		sb.WriteString("[/duration BETWEEN(")
-		sb.WriteString(strconv.FormatInt(query.DurationMin.Nanoseconds()/1000, 10))
-		sb.WriteString(",")
-		sb.WriteString(strconv.FormatInt(query.DurationMax.Nanoseconds()/1000, 10))
-		sb.WriteString(")]")
-	} else if query.DurationMin > 0 {
-		sb.WriteString("[/duration GE(")
-		sb.WriteString(strconv.FormatInt(query.DurationMin.Nanoseconds()/1000, 10))
-		sb.WriteString(")]")
-	} else if query.DurationMax > 0 {
-		sb.WriteString("[/duration LE(")
-		sb.WriteString(strconv.FormatInt(query.DurationMax.Nanoseconds()/1000, 10))
-		sb.WriteString(")]")
-	}
-
-	if len(query.Tags) > 0 {
-		for k, v := range query.Tags {
-			sb.WriteString("[/tags ")
-			sb.WriteString("[/key ")
-			sb.WriteString(" CONTAIN('")
-			sb.WriteString(k)
-			sb.WriteString("')]")
-			sb.WriteString("[/value ")
-			sb.WriteString(" CONTAIN('")
-			sb.WriteString(v)
-			sb.WriteString("')]")
-			sb.WriteString("]")
-		}
-	}
-
-	sb.WriteString("order-by $st desc")
+// micros returns t as microseconds since Unix epoch, the unit of /startTime.
+func micros(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Microsecond)
+}
 
-	return sb.String(), min, max
+// micros64 returns d in microseconds, the unit of /duration.
+func micros64(d time.Duration) int64 {
+	return d.Nanoseconds() / int64(time.Microsecond)
 }
 
-func purge(ticker *time.Ticker, ttl time.Duration, wave *embed.WaveStream) {
-	logger.Warn("purge data ttl", "ttl", ttl)
+// purge removes wave data older than the longest ttl, compacts segments holding spans
+// past a shorter ttl of their retention rule, and expires catalog entries and summaries
+// with them, or after tailTTL for traces kept by tail retention.
+func purge(ticker *time.Ticker, policy *retentionPolicy, tailTTL time.Duration, wave *embed.WaveStream, ret *segmentRetention, cat *catalog, sum *summaries) {
+	logger.Warn("purge data ttl", "ttl", policy.maxTTL())
 	for range ticker.C {
-		pt := time.Now().Add(-1 * ttl)
+		now := time.Now()
+		pt := now.Add(-1 * policy.maxTTL())
+		kt := now.Add(-1 * maxDuration(policy.maxTTL(), tailTTL))
 		wave.Purge(context.Background(), pt)
+		if ret != nil {
+			if err := ret.apply(now); err != nil {
+				logger.Error("failed to apply retention rules", "error", err)
+			}
+		}
+		err := cat.expireBy(func(service, operation string) int64 {
+			return micros(now.Add(-1 * maxDuration(policy.operationTTL(service, operation), tailTTL)))
+		})
+		if err != nil {
+			logger.Error("failed to expire service catalog", "error", err)
+		}
+		if err := sum.expire(pt, kt); err != nil {
+			logger.Error("failed to expire trace summaries", "error", err)
+		}
 		logger.Warn("purge data before", "time", pt)
 	}
 }
@@ -0,0 +1,487 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	summaryFile = "summary"
+
+	// summaries read at once by within
+	summaryPage = 500
+)
+
+// traceSummary is what Jaeger UI lists for a trace in search results.
+type traceSummary struct {
+	TraceID       string   `json:"traceID"`
+	RootService   string   `json:"rootService"`
+	RootOperation string   `json:"rootOperation"`
+	StartTime     int64    `json:"startTime"` // microseconds since Unix epoch
+	Duration      int64    `json:"duration"`  // microseconds from first span start to last span end
+	SpanCount     int      `json:"spanCount"`
+	ErrorCount    int      `json:"errorCount"`
+	Services      []string `json:"services"`
+}
+
+// summaries keeps a summary per trace in sqlite next to the wave data, updated as
+// spans are flushed. Spans written before summaries existed are not covered, see since.
+type summaries struct {
+	db    *sql.DB
+	since int64
+}
+
+func openSummaries(dir string) (*summaries, error) {
+	db, err := sql.Open("sqlite3", filepath.Join(dir, summaryFile))
+	if err != nil {
+		return nil, err
+	}
+
+	qry := []string{
+		`CREATE TABLE IF NOT EXISTS summary
+         (
+           trace_id TEXT PRIMARY KEY,
+           root_service TEXT NOT NULL,
+           root_operation TEXT NOT NULL,
+           start_time INTEGER NOT NULL,
+           end_time INTEGER NOT NULL,
+           span_count INTEGER NOT NULL,
+           error_count INTEGER NOT NULL,
+           updated INTEGER NOT NULL DEFAULT 0
+         ) WITHOUT ROWID`,
+		`CREATE INDEX IF NOT EXISTS summary_start ON summary (start_time)`,
+		`CREATE TABLE IF NOT EXISTS summary_service
+         (
+           service TEXT,
+           trace_id TEXT,
+           PRIMARY KEY (service, trace_id)
+         ) WITHOUT ROWID`,
+		`CREATE INDEX IF NOT EXISTS summary_service_trace ON summary_service (trace_id)`,
+		`CREATE TABLE IF NOT EXISTS summary_meta (since INTEGER NOT NULL)`,
+		`CREATE TABLE IF NOT EXISTS summary_kept
+         (
+           trace_id TEXT PRIMARY KEY,
+           kept INTEGER NOT NULL
+         ) WITHOUT ROWID`,
+	}
+	for _, q := range qry {
+		if _, err = db.Exec(q); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	if err = migrateSummaries(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	s := &summaries{db: db}
+	err = db.QueryRow(`SELECT since FROM summary_meta`).Scan(&s.since)
+	if err == sql.ErrNoRows {
+		s.since = micros(time.Now())
+		_, err = db.Exec(`INSERT INTO summary_meta (since) VALUES (?)`, s.since)
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// migrateSummaries adds when summaries were last updated to a table from before it
+// was recorded, as their end time, spans are mostly written right after they end.
+func migrateSummaries(db *sql.DB) error {
+	var updated int
+	err := db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('summary') WHERE name = 'updated'`).Scan(&updated)
+	if err != nil {
+		return err
+	}
+
+	qry := []string{`CREATE INDEX IF NOT EXISTS summary_updated ON summary (updated)`}
+	if updated == 0 {
+		qry = append([]string{
+			`ALTER TABLE summary ADD COLUMN updated INTEGER NOT NULL DEFAULT 0`,
+			`UPDATE summary SET updated = end_time`,
+		}, qry...)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, q := range qry {
+		if _, err = tx.Exec(q); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *summaries) Close() error {
+	return s.db.Close()
+}
+
+// covers returns true if spans started from min on are summarized.
+func (s *summaries) covers(min int64) bool {
+	return min >= s.since
+}
+
+// observe merges spans of a flushed batch into their trace summaries.
+func (s *summaries) observe(batch []pendingSpan) error {
+	type delta struct {
+		rootSvc, rootOp string
+		start, end      int64
+		spans, errors   int
+		services        map[string]void
+	}
+
+	traces := map[string]*delta{}
+	for _, p := range batch {
+		d, ok := traces[p.traceID]
+		if !ok {
+			d = &delta{start: p.startTime, end: p.startTime + p.duration, services: map[string]void{}}
+			traces[p.traceID] = d
+		}
+		if p.root {
+			d.rootSvc, d.rootOp = p.service, p.op
+		}
+		if p.startTime < d.start {
+			d.start = p.startTime
+		}
+		if end := p.startTime + p.duration; end > d.end {
+			d.end = end
+		}
+		d.spans++
+		if p.failed {
+			d.errors++
+		}
+		d.services[p.service] = void{}
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	qry := `INSERT INTO summary (trace_id, root_service, root_operation, start_time, end_time, span_count, error_count, updated)
+            VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+            ON CONFLICT (trace_id) DO UPDATE SET
+              root_service = CASE WHEN excluded.root_service <> '' THEN excluded.root_service ELSE root_service END,
+              root_operation = CASE WHEN excluded.root_service <> '' THEN excluded.root_operation ELSE root_operation END,
+              start_time = MIN(start_time, excluded.start_time),
+              end_time = MAX(end_time, excluded.end_time),
+              span_count = span_count + excluded.span_count,
+              error_count = error_count + excluded.error_count,
+              updated = MAX(updated, excluded.updated)`
+	updated := micros(time.Now())
+	for tid, d := range traces {
+		if _, err = tx.Exec(qry, tid, d.rootSvc, d.rootOp, d.start, d.end, d.spans, d.errors, updated); err != nil {
+			tx.Rollback()
+			return err
+		}
+		for svc := range d.services {
+			if _, err = tx.Exec(`INSERT OR IGNORE INTO summary_service (service, trace_id) VALUES (?, ?)`, svc, tid); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+// expire removes summaries of traces started before, or keptBefore for traces kept
+// by tail retention.
+func (s *summaries) expire(before, keptBefore time.Time) error {
+	ts, kts := micros(before), micros(keptBefore)
+	expired := `SELECT trace_id FROM summary WHERE start_time < ? AND (start_time < ? OR trace_id NOT IN (SELECT trace_id FROM summary_kept WHERE kept = 1))`
+	qry := []string{
+		`DELETE FROM summary_service WHERE trace_id IN (` + expired + `)`,
+		`DELETE FROM summary_kept WHERE trace_id IN (` + expired + `)`,
+		`DELETE FROM summary WHERE trace_id IN (` + expired + `)`,
+	}
+	for _, q := range qry {
+		if _, err := s.db.Exec(q, ts, kts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// forget removes spans dropped by retention rules from the counts of their trace
+// summaries, and summaries left without spans. Start, end time and services stay as
+// they were.
+func (s *summaries) forget(spans []pendingSpan) error {
+	if len(spans) == 0 {
+		return nil
+	}
+
+	type delta struct{ spans, errors int }
+	traces := map[string]*delta{}
+	for _, p := range spans {
+		d, ok := traces[p.traceID]
+		if !ok {
+			d = &delta{}
+			traces[p.traceID] = d
+		}
+		d.spans++
+		if p.failed {
+			d.errors++
+		}
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	qry := []string{
+		`UPDATE summary SET span_count = span_count - ?, error_count = MAX(error_count - ?, 0) WHERE trace_id = ?`,
+		`DELETE FROM summary_service WHERE trace_id = ? AND trace_id IN (SELECT trace_id FROM summary WHERE span_count <= 0)`,
+		`DELETE FROM summary_kept WHERE trace_id = ? AND trace_id IN (SELECT trace_id FROM summary WHERE span_count <= 0)`,
+		`DELETE FROM summary WHERE trace_id = ? AND span_count <= 0`,
+	}
+	for tid, d := range traces {
+		if _, err = tx.Exec(qry[0], d.spans, d.errors, tid); err != nil {
+			tx.Rollback()
+			return err
+		}
+		for _, q := range qry[1:] {
+			if _, err = tx.Exec(q, tid); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+// settled returns summaries of traces without spans written since before, and not
+// classified by tail retention yet, the earliest updated first. Spans written late,
+// whenever they ended, put it off.
+func (s *summaries) settled(before int64, limit int) ([]*traceSummary, error) {
+	rows, err := s.db.Query(`SELECT trace_id, start_time, end_time, error_count FROM summary
+                             WHERE updated < ? AND trace_id NOT IN (SELECT trace_id FROM summary_kept)
+                             ORDER BY updated LIMIT ?`, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var found []*traceSummary
+	for rows.Next() {
+		var (
+			ts  traceSummary
+			end int64
+		)
+		if err = rows.Scan(&ts.TraceID, &ts.StartTime, &end, &ts.ErrorCount); err != nil {
+			return nil, err
+		}
+		ts.Duration = end - ts.StartTime
+		found = append(found, &ts)
+	}
+
+	return found, rows.Err()
+}
+
+// classify records whether tail retention kept traces.
+func (s *summaries) classify(kept map[string]bool) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	for tid, k := range kept {
+		if _, err = tx.Exec(`INSERT OR REPLACE INTO summary_kept (trace_id, kept) VALUES (?, ?)`, tid, k); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// traceIDs returns IDs of traces started within [min, max] with spans of service,
+// empty service matches all, newest first. Zero limit returns all.
+func (s *summaries) traceIDs(service string, min, max int64, limit int) ([]string, error) {
+	qry, args := s.search(`s.trace_id`, service, min, max, limit)
+	rows, err := s.db.Query(qry, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tids []string
+	for rows.Next() {
+		var tid string
+		if err = rows.Scan(&tid); err != nil {
+			return nil, err
+		}
+		tids = append(tids, tid)
+	}
+
+	return tids, rows.Err()
+}
+
+// find returns summaries of traces like traceIDs.
+func (s *summaries) find(service string, min, max int64, limit int) ([]*traceSummary, error) {
+	qry, args := s.search(`s.trace_id, s.root_service, s.root_operation, s.start_time, s.end_time, s.span_count, s.error_count`,
+		service, min, max, limit)
+	rows, err := s.db.Query(qry, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var found []*traceSummary
+	for rows.Next() {
+		var (
+			ts  traceSummary
+			end int64
+		)
+		if err = rows.Scan(&ts.TraceID, &ts.RootService, &ts.RootOperation, &ts.StartTime, &end, &ts.SpanCount, &ts.ErrorCount); err != nil {
+			return nil, err
+		}
+		ts.Duration = end - ts.StartTime
+		ts.Services = []string{}
+		found = append(found, &ts)
+	}
+	if err = rows.Err(); err != nil || len(found) == 0 {
+		return found, err
+	}
+
+	return found, s.addServices(found)
+}
+
+// addServices fills in the services of summaries found.
+func (s *summaries) addServices(found []*traceSummary) error {
+	byID := make(map[string]*traceSummary, len(found))
+	args := make([]interface{}, 0, len(found))
+	for _, ts := range found {
+		byID[ts.TraceID] = ts
+		args = append(args, ts.TraceID)
+	}
+	rows, err := s.db.Query(`SELECT trace_id, service FROM summary_service WHERE trace_id IN (?`+
+		strings.Repeat(`, ?`, len(args)-1)+`)`, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var tid, svc string
+		if err = rows.Scan(&tid, &svc); err != nil {
+			return err
+		}
+		ts := byID[tid]
+		ts.Services = append(ts.Services, svc)
+	}
+	for _, ts := range found {
+		sort.Strings(ts.Services)
+	}
+
+	return rows.Err()
+}
+
+// within calls fn with summaries of traces overlapping [from, to], by trace ID. They
+// are read a page at a time, so flushed spans aren't held up by a long read.
+func (s *summaries) within(from, to int64, fn func(*traceSummary) error) error {
+	after := ""
+	for {
+		rows, err := s.db.Query(`SELECT trace_id, root_service, root_operation, start_time, end_time, span_count, error_count
+                                 FROM summary WHERE trace_id > ? AND start_time <= ? AND end_time >= ?
+                                 ORDER BY trace_id LIMIT ?`, after, to, from, summaryPage)
+		if err != nil {
+			return err
+		}
+
+		var page []*traceSummary
+		for rows.Next() {
+			var (
+				ts  traceSummary
+				end int64
+			)
+			if err = rows.Scan(&ts.TraceID, &ts.RootService, &ts.RootOperation, &ts.StartTime, &end, &ts.SpanCount, &ts.ErrorCount); err != nil {
+				rows.Close()
+				return err
+			}
+			ts.Duration = end - ts.StartTime
+			ts.Services = []string{}
+			page = append(page, &ts)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil || len(page) == 0 {
+			return err
+		}
+
+		if err = s.addServices(page); err != nil {
+			return err
+		}
+		for _, ts := range page {
+			if err = fn(ts); err != nil {
+				return err
+			}
+		}
+		after = page[len(page)-1].TraceID
+	}
+}
+
+// merge adds summaries restored from a backup, for traces it has no summary of.
+func (s *summaries) merge(batch []*traceSummary) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	for _, ts := range batch {
+		// as updated when the trace ended, restored traces settled long ago
+		_, err = tx.Exec(`INSERT OR IGNORE INTO summary (trace_id, root_service, root_operation, start_time, end_time, span_count, error_count, updated)
+                          VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			ts.TraceID, ts.RootService, ts.RootOperation, ts.StartTime, ts.StartTime+ts.Duration, ts.SpanCount, ts.ErrorCount,
+			ts.StartTime+ts.Duration)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		for _, svc := range ts.Services {
+			if _, err = tx.Exec(`INSERT OR IGNORE INTO summary_service (service, trace_id) VALUES (?, ?)`, svc, ts.TraceID); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+// cover sets since, the start time from which traces are summarized.
+func (s *summaries) cover(since int64) error {
+	if _, err := s.db.Exec(`UPDATE summary_meta SET since = ?`, since); err != nil {
+		return err
+	}
+	s.since = since
+	return nil
+}
+
+func (s *summaries) search(columns, service string, min, max int64, limit int) (string, []interface{}) {
+	qry := `SELECT ` + columns + ` FROM summary s`
+	args := []interface{}{}
+	if len(service) > 0 {
+		qry += ` JOIN summary_service v ON v.trace_id = s.trace_id AND v.service = ?`
+		args = append(args, service)
+	}
+	qry += ` WHERE s.start_time BETWEEN ? AND ? ORDER BY s.start_time DESC`
+	args = append(args, min, max)
+	if limit > 0 {
+		qry += ` LIMIT ?`
+		args = append(args, limit)
+	}
+
+	return qry, args
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testPending(trace uint64, service string, start time.Time, duration time.Duration, root, failed bool) pendingSpan {
+	return pendingSpan{
+		traceID:   traceIDs(trace)[0],
+		service:   service,
+		op:        service + " op",
+		startTime: micros(start),
+		duration:  micros64(duration),
+		root:      root,
+		failed:    failed,
+	}
+}
+
+func TestSummariesObserve(t *testing.T) {
+	dir, err := ioutil.TempDir("", "summary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := openSummaries(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	now := time.Unix(1600000000, 0)
+	// spans of a trace arrive over several batches, the root last
+	batches := [][]pendingSpan{
+		{
+			testPending(1, "redis", now.Add(10*time.Millisecond), 5*time.Millisecond, false, false),
+			testPending(2, "driver", now, time.Second, true, false),
+		},
+		{testPending(1, "customer", now.Add(20*time.Millisecond), 50*time.Millisecond, false, true)},
+		{testPending(1, "frontend", now, 100*time.Millisecond, true, false)},
+	}
+	for _, b := range batches {
+		if err = s.observe(b); err != nil {
+			t.Fatalf("observe() error = %v", err)
+		}
+	}
+
+	var got []traceSummary
+	err = s.within(0, micros(now.Add(time.Hour)), func(ts *traceSummary) error {
+		got = append(got, *ts)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("within() error = %v", err)
+	}
+	want := []traceSummary{
+		{
+			TraceID: traceIDs(1)[0], RootService: "frontend", RootOperation: "frontend op", StartTime: micros(now),
+			Duration: micros64(100 * time.Millisecond), SpanCount: 3, ErrorCount: 1, Services: []string{"customer", "frontend", "redis"},
+		},
+		{
+			TraceID: traceIDs(2)[0], RootService: "driver", RootOperation: "driver op", StartTime: micros(now),
+			Duration: micros64(time.Second), SpanCount: 1, Services: []string{"driver"},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("within() = %+v, want %+v", got, want)
+	}
+}
+
+func TestSummariesExpire(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	tests := []struct {
+		name     string
+		kept     map[string]bool
+		before   time.Time
+		keptLong time.Time // keptBefore
+		want     []string
+	}{
+		{"none expired", nil, now.Add(-3 * time.Hour), now.Add(-3 * time.Hour), traceIDs(1, 2, 3)},
+		{"started before", nil, now.Add(-90 * time.Minute), now.Add(-90 * time.Minute), traceIDs(2, 3)},
+		{"all", nil, now, now, nil},
+		{
+			"kept for longer",
+			map[string]bool{traceIDs(1)[0]: true, traceIDs(2)[0]: false},
+			now, now.Add(-3 * time.Hour),
+			traceIDs(1),
+		},
+		{
+			"kept until keptBefore",
+			map[string]bool{traceIDs(1)[0]: true},
+			now, now,
+			nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "summary")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			s, err := openSummaries(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+
+			batch := []pendingSpan{
+				testPending(1, "frontend", now.Add(-2*time.Hour), time.Second, true, false),
+				testPending(2, "frontend", now.Add(-time.Hour), time.Second, true, false),
+				testPending(3, "redis", now.Add(-time.Minute), time.Second, true, false),
+			}
+			if err = s.observe(batch); err != nil {
+				t.Fatal(err)
+			}
+			if err = s.classify(tt.kept); err != nil {
+				t.Fatal(err)
+			}
+			if err = s.expire(tt.before, tt.keptLong); err != nil {
+				t.Fatalf("expire() error = %v", err)
+			}
+
+			got, err := s.traceIDs("", 0, micros(now), 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// newest first
+			for i, j := 0, len(got)-1; i < j; i, j = i+1, j-1 {
+				got[i], got[j] = got[j], got[i]
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("traceIDs() after expire() = %v, want %v", got, tt.want)
+			}
+
+			// services of expired traces are gone too
+			var services int
+			if err = s.db.QueryRow(`SELECT COUNT(*) FROM summary_service`).Scan(&services); err != nil {
+				t.Fatal(err)
+			}
+			if services != len(tt.want) {
+				t.Errorf("summary_service rows = %d, want %d", services, len(tt.want))
+			}
+		})
+	}
+}
+
+func TestSummariesCover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "summary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := openSummaries(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opened := s.since
+
+	tests := []struct {
+		name  string
+		cover int64 // zero leaves since as it is
+		min   int64
+		want  bool
+	}{
+		{"since opened", 0, opened, true},
+		{"before opened", 0, opened - 1, false},
+		{"covered back", opened - 100, opened - 100, true},
+		{"before covered", opened - 100, opened - 101, false},
+	}
+	for _, tt := range tests {
+		if tt.cover != 0 {
+			if err = s.cover(tt.cover); err != nil {
+				t.Fatalf("cover() error = %v", err)
+			}
+		}
+		if got := s.covers(tt.min); got != tt.want {
+			t.Errorf("%s: covers(%d) = %v, want %v", tt.name, tt.min, got, tt.want)
+		}
+	}
+	s.Close()
+
+	// since is kept across restarts
+	if s, err = openSummaries(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if s.since != opened-100 {
+		t.Errorf("since after reopening = %d, want %d", s.since, opened-100)
+	}
+}
+
+func TestSummariesMigrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "summary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a summary table from before updated was recorded
+	db, err := sql.Open("sqlite3", filepath.Join(dir, summaryFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, q := range []string{
+		`CREATE TABLE summary (trace_id TEXT PRIMARY KEY, root_service TEXT NOT NULL, root_operation TEXT NOT NULL,
+           start_time INTEGER NOT NULL, end_time INTEGER NOT NULL, span_count INTEGER NOT NULL, error_count INTEGER NOT NULL) WITHOUT ROWID`,
+		`INSERT INTO summary VALUES ('1', 'frontend', 'GET /', 100, 200, 1, 0)`,
+	} {
+		if _, err = db.Exec(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db.Close()
+
+	s, err := openSummaries(dir)
+	if err != nil {
+		t.Fatalf("openSummaries() error = %v", err)
+	}
+	defer s.Close()
+
+	var updated int64
+	if err = s.db.QueryRow(`SELECT updated FROM summary WHERE trace_id = '1'`).Scan(&updated); err != nil {
+		t.Fatal(err)
+	}
+	if updated != 200 {
+		t.Errorf("updated after migration = %d, want the end time 200", updated)
+	}
+}
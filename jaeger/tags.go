@@ -0,0 +1,266 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/jaegertracing/jaeger/plugin/storage/es/spanstore/dbmodel"
+
+	"chronowave-jaeger/builder"
+)
+
+// tagScope is the set of span locations searched for tags.
+type tagScope uint8
+
+const (
+	spanTags tagScope = 1 << iota
+	processTags
+	logFields
+
+	allTags = spanTags | processTags | logFields
+)
+
+var tagScopes = []struct {
+	name  string
+	scope tagScope
+	path  string
+}{
+	{"span", spanTags, "/tags"},
+	{"process", processTags, "/process/tags"},
+	{"log", logFields, "/logs/fields"},
+}
+
+// parseTagScope parses a comma separated list of span, process and log.
+func parseTagScope(text string) (tagScope, error) {
+	var scope tagScope
+	for _, name := range strings.Split(text, ",") {
+		name = strings.TrimSpace(name)
+		if len(name) == 0 {
+			continue
+		}
+		found := false
+		for _, s := range tagScopes {
+			if s.name == name {
+				scope |= s.scope
+				found = true
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown tag scope %q, expect span, process or log", name)
+		}
+	}
+	if scope == 0 {
+		return 0, errors.New("empty tag scope")
+	}
+	return scope, nil
+}
+
+// values returns tags and log fields of span in scope.
+func (s tagScope) values(span *dbmodel.Span) []dbmodel.KeyValue {
+	var kvs []dbmodel.KeyValue
+	if s&spanTags != 0 {
+		kvs = append(kvs, span.Tags...)
+	}
+	if s&processTags != 0 {
+		kvs = append(kvs, span.Process.Tags...)
+	}
+	if s&logFields != 0 {
+		for _, l := range span.Logs {
+			kvs = append(kvs, l.Fields...)
+		}
+	}
+	return kvs
+}
+
+type tagOp int
+
+const (
+	tagEqual tagOp = iota
+	tagPrefix
+	tagRegex
+	tagLt
+	tagLe
+	tagGt
+	tagGe
+)
+
+// tagFilter is a tag search term of Jaeger UI. The value is matched exactly unless
+//
+//	key=^value   value starts with value
+//	key=~regex   value matches regular expression
+//	key>=n, key>n, key<=n, key<n
+//	             value of a int64 or float64 tag compares to n
+//
+// Numeric operators can also lead the value, e.g. {"http.status_code": ">=500"}.
+type tagFilter struct {
+	key   string
+	op    tagOp
+	value string
+	re    *regexp.Regexp
+	num   float64
+}
+
+var numericOps = []struct {
+	text string
+	op   tagOp
+}{
+	// two character operators go first
+	{">=", tagGe},
+	{"<=", tagLe},
+	{">", tagGt},
+	{"<", tagLt},
+}
+
+// parseTagFilter parses a tag search term as Jaeger UI sends it. The UI splits
+// key and value on the first '=', so "code>=500" arrives as "code>" and "500", and
+// "duration_ms<20" without '=' arrives as a key with an empty or "true" value.
+// A comparison to something that isn't a number is matched exactly instead.
+func parseTagFilter(key, value string) (*tagFilter, error) {
+	switch {
+	case strings.HasSuffix(key, ">") && len(key) > 1:
+		if f, ok := numericTagFilter(key[:len(key)-1], tagGe, value); ok {
+			return f, nil
+		}
+	case strings.HasSuffix(key, "<") && len(key) > 1:
+		if f, ok := numericTagFilter(key[:len(key)-1], tagLe, value); ok {
+			return f, nil
+		}
+	}
+
+	if i := strings.IndexAny(key, "<>"); i > 0 && (len(value) == 0 || value == "true") {
+		op := tagLt
+		if key[i] == '>' {
+			op = tagGt
+		}
+		if f, ok := numericTagFilter(key[:i], op, key[i+1:]); ok {
+			return f, nil
+		}
+	}
+
+	for _, n := range numericOps {
+		if strings.HasPrefix(value, n.text) {
+			if f, ok := numericTagFilter(key, n.op, value[len(n.text):]); ok {
+				return f, nil
+			}
+			break
+		}
+	}
+
+	switch {
+	case strings.HasPrefix(value, "~"):
+		re, err := regexp.Compile(value[1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid regular expression for tag %s: %v", key, err)
+		}
+		return &tagFilter{key: key, op: tagRegex, value: value[1:], re: re}, nil
+	case strings.HasPrefix(value, "^") && len(value) > 1:
+		return &tagFilter{key: key, op: tagPrefix, value: value[1:]}, nil
+	}
+
+	return &tagFilter{key: key, op: tagEqual, value: value}, nil
+}
+
+func numericTagFilter(key string, op tagOp, value string) (*tagFilter, bool) {
+	key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+	num, err := strconv.ParseFloat(value, 64)
+	if err != nil || len(key) == 0 {
+		return nil, false
+	}
+	return &tagFilter{key: key, op: op, value: value, num: num}, true
+}
+
+// clause narrows spans in SSQL to those with a tag in scope, it may match more than
+// the filter, see match.
+func (f *tagFilter) clause(scope tagScope) builder.Clause {
+	kv := []builder.Clause{builder.Path("/key").Equal(f.key)}
+	switch f.op {
+	case tagEqual:
+		if len(f.value) > 0 {
+			kv = append(kv, builder.Path("/value").Equal(f.value))
+		}
+	case tagPrefix:
+		kv = append(kv, builder.Path("/value").Prefix(f.value))
+	case tagRegex:
+		// only an anchored expression tells what the value starts with
+		if strings.HasPrefix(f.value, "^") {
+			if re, err := regexp.Compile(f.value[1:]); err == nil {
+				if prefix, _ := re.LiteralPrefix(); len(prefix) > 0 {
+					kv = append(kv, builder.Path("/value").Prefix(prefix))
+				}
+			}
+		}
+	}
+
+	var paths []builder.Clause
+	for _, s := range tagScopes {
+		if scope&s.scope != 0 {
+			paths = append(paths, builder.Path(s.path).Nested(kv...))
+		}
+	}
+	if len(paths) == 1 {
+		return paths[0]
+	}
+
+	return builder.Or(paths...)
+}
+
+// match returns true if one of kvs satisfies the filter.
+func (f *tagFilter) match(kvs []dbmodel.KeyValue) bool {
+	for _, kv := range kvs {
+		if kv.Key == f.key && f.matchValue(kv) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *tagFilter) matchValue(kv dbmodel.KeyValue) bool {
+	value, ok := kv.Value.(string)
+	if !ok {
+		value = fmt.Sprint(kv.Value)
+	}
+
+	switch f.op {
+	case tagEqual:
+		return value == f.value
+	case tagPrefix:
+		return strings.HasPrefix(value, f.value)
+	case tagRegex:
+		return f.re.MatchString(value)
+	}
+
+	var num float64
+	switch kv.Type {
+	case dbmodel.Int64Type:
+		i, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return false
+		}
+		num = float64(i)
+	case dbmodel.Float64Type:
+		d, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return false
+		}
+		num = d
+	default:
+		// numbers recorded as string or bool tags aren't compared
+		return false
+	}
+
+	switch f.op {
+	case tagLt:
+		return num < f.num
+	case tagLe:
+		return num <= f.num
+	case tagGt:
+		return num > f.num
+	case tagGe:
+		return num >= f.num
+	}
+
+	return false
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/jaegertracing/jaeger/plugin/storage/es/spanstore/dbmodel"
+
+	"chronowave-jaeger/builder"
+)
+
+func TestParseTagFilter(t *testing.T) {
+	tests := []struct {
+		name       string
+		key, value string
+		want       tagFilter
+	}{
+		{"exact", "http.status_code", "500", tagFilter{key: "http.status_code", op: tagEqual, value: "500"}},
+		{"empty", "error", "", tagFilter{key: "error", op: tagEqual}},
+		{"prefix", "http.url", "^/api", tagFilter{key: "http.url", op: tagPrefix, value: "/api"}},
+		{"caret alone", "note", "^", tagFilter{key: "note", op: tagEqual, value: "^"}},
+		{"regex", "http.url", "~^/api/v[12]/", tagFilter{key: "http.url", op: tagRegex, value: "^/api/v[12]/"}},
+		{"ge split by UI", "http.status_code>", "500", tagFilter{key: "http.status_code", op: tagGe, value: "500", num: 500}},
+		{"le split by UI", "duration_ms<", "20", tagFilter{key: "duration_ms", op: tagLe, value: "20", num: 20}},
+		{"lt in key", "duration_ms<20", "", tagFilter{key: "duration_ms", op: tagLt, value: "20", num: 20}},
+		{"gt in key", "retries>2", "true", tagFilter{key: "retries", op: tagGt, value: "2", num: 2}},
+		{"ge in value", "http.status_code", ">=500", tagFilter{key: "http.status_code", op: tagGe, value: "500", num: 500}},
+		{"le in value", "ratio", "<=0.5", tagFilter{key: "ratio", op: tagLe, value: "0.5", num: 0.5}},
+		{"gt in value", "http.status_code", "> 499", tagFilter{key: "http.status_code", op: tagGt, value: "499", num: 499}},
+		{"lt in value", "ratio", "<1e-3", tagFilter{key: "ratio", op: tagLt, value: "1e-3", num: 1e-3}},
+		{"compare to text", "version", ">=beta", tagFilter{key: "version", op: tagEqual, value: ">=beta"}},
+		{"ge to text split by UI", "arrow>", "x", tagFilter{key: "arrow>", op: tagEqual, value: "x"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := parseTagFilter(tt.key, tt.value)
+			if err != nil {
+				t.Fatalf("parseTagFilter() error = %v", err)
+			}
+			f.re = nil
+			if *f != tt.want {
+				t.Errorf("parseTagFilter() = %+v, want %+v", *f, tt.want)
+			}
+		})
+	}
+
+	if _, err := parseTagFilter("http.url", "~("); err == nil {
+		t.Error("parseTagFilter() of an invalid regular expression error = nil")
+	}
+}
+
+func TestTagFilterMatch(t *testing.T) {
+	tests := []struct {
+		name       string
+		key, value string
+		kv         dbmodel.KeyValue
+		want       bool
+	}{
+		{"exact", "http.status_code", "500", dbmodel.KeyValue{Key: "http.status_code", Type: dbmodel.Int64Type, Value: "500"}, true},
+		{"exact is not contain", "http.status_code", "500", dbmodel.KeyValue{Key: "http.status_code", Type: dbmodel.Int64Type, Value: "5000"}, false},
+		{"other key", "error", "true", dbmodel.KeyValue{Key: "error.kind", Type: dbmodel.BoolType, Value: "true"}, false},
+		{"bool", "error", "true", dbmodel.KeyValue{Key: "error", Type: dbmodel.BoolType, Value: true}, true},
+		{"prefix", "http.url", "^/api", dbmodel.KeyValue{Key: "http.url", Type: dbmodel.StringType, Value: "/api/v1"}, true},
+		{"prefix mismatch", "http.url", "^/api", dbmodel.KeyValue{Key: "http.url", Type: dbmodel.StringType, Value: "/v1/api"}, false},
+		{"regex", "http.url", "~v[12]$", dbmodel.KeyValue{Key: "http.url", Type: dbmodel.StringType, Value: "/api/v2"}, true},
+		{"regex mismatch", "http.url", "~v[12]$", dbmodel.KeyValue{Key: "http.url", Type: dbmodel.StringType, Value: "/api/v3"}, false},
+		{"ge int", "http.status_code", ">=500", dbmodel.KeyValue{Key: "http.status_code", Type: dbmodel.Int64Type, Value: "500"}, true},
+		{"ge int below", "http.status_code", ">=500", dbmodel.KeyValue{Key: "http.status_code", Type: dbmodel.Int64Type, Value: "404"}, false},
+		{"gt int equal", "http.status_code", ">500", dbmodel.KeyValue{Key: "http.status_code", Type: dbmodel.Int64Type, Value: "500"}, false},
+		{"lt float", "duration_ms<20", "", dbmodel.KeyValue{Key: "duration_ms", Type: dbmodel.Float64Type, Value: "19.5"}, true},
+		{"le float", "ratio", "<=0.5", dbmodel.KeyValue{Key: "ratio", Type: dbmodel.Float64Type, Value: "0.5"}, true},
+		{"le float above", "ratio", "<=0.5", dbmodel.KeyValue{Key: "ratio", Type: dbmodel.Float64Type, Value: "0.51"}, false},
+		{"number as string", "http.status_code", ">=500", dbmodel.KeyValue{Key: "http.status_code", Type: dbmodel.StringType, Value: "503"}, false},
+		{"bad int", "http.status_code", ">=500", dbmodel.KeyValue{Key: "http.status_code", Type: dbmodel.Int64Type, Value: "5xx"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := parseTagFilter(tt.key, tt.value)
+			if err != nil {
+				t.Fatalf("parseTagFilter() error = %v", err)
+			}
+			if got := f.match([]dbmodel.KeyValue{tt.kv}); got != tt.want {
+				t.Errorf("match(%v) = %v, want %v", tt.kv, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTagScope(t *testing.T) {
+	tests := []struct {
+		text    string
+		want    tagScope
+		wantErr bool
+	}{
+		{"span", spanTags, false},
+		{"span,process,log", allTags, false},
+		{" log , process ", processTags | logFields, false},
+		{"span,span", spanTags, false},
+		{"", 0, true},
+		{" , ", 0, true},
+		{"span,tags", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			got, err := parseTagScope(tt.text)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseTagScope() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseTagScope() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTagScope(t *testing.T) {
+	span := &dbmodel.Span{
+		Tags:    []dbmodel.KeyValue{{Key: "span.kind", Type: dbmodel.StringType, Value: "server"}},
+		Process: dbmodel.Process{Tags: []dbmodel.KeyValue{{Key: "hostname", Type: dbmodel.StringType, Value: "foo"}}},
+		Logs: []dbmodel.Log{
+			{Fields: []dbmodel.KeyValue{{Key: "event", Type: dbmodel.StringType, Value: "error"}}},
+			{Fields: []dbmodel.KeyValue{{Key: "message", Type: dbmodel.StringType, Value: "retry"}}},
+		},
+	}
+
+	tests := []struct {
+		name  string
+		scope tagScope
+		keys  []string
+		query string
+	}{
+		{"span", spanTags, []string{"span.kind"},
+			`FIND $s WHERE [$s /][/tags [/key CONTAIN('^hostname$')] [/value CONTAIN('^foo$')]]`},
+		{"process", processTags, []string{"hostname"},
+			`FIND $s WHERE [$s /][/process/tags [/key CONTAIN('^hostname$')] [/value CONTAIN('^foo$')]]`},
+		{"log", logFields, []string{"event", "message"},
+			`FIND $s WHERE [$s /][/logs/fields [/key CONTAIN('^hostname$')] [/value CONTAIN('^foo$')]]`},
+		{"all", allTags, []string{"span.kind", "hostname", "event", "message"},
+			`FIND $s WHERE [$s /]{[/tags [/key CONTAIN('^hostname$')] [/value CONTAIN('^foo$')]]` +
+				`[/process/tags [/key CONTAIN('^hostname$')] [/value CONTAIN('^foo$')]]` +
+				`[/logs/fields [/key CONTAIN('^hostname$')] [/value CONTAIN('^foo$')]]}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var keys []string
+			for _, kv := range tt.scope.values(span) {
+				keys = append(keys, kv.Key)
+			}
+			if !reflect.DeepEqual(keys, tt.keys) {
+				t.Errorf("values() keys = %v, want %v", keys, tt.keys)
+			}
+
+			f, err := parseTagFilter("hostname", "foo")
+			if err != nil {
+				t.Fatal(err)
+			}
+			qry, err := builder.Find("s").Where(builder.Var("s", "/"), f.clause(tt.scope)).Build()
+			if err != nil {
+				t.Fatalf("Build() error = %v", err)
+			}
+			if qry != tt.query {
+				t.Errorf("clause() = %s, want %s", qry, tt.query)
+			}
+		})
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"hash/fnv"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chronowave/chronowave/embed"
+	"github.com/jaegertracing/jaeger/plugin/storage/es/spanstore/dbmodel"
+
+	"chronowave-jaeger/builder"
+)
+
+const (
+	// settled traces are classified this often
+	tailCheck = time.Minute
+	// traces classified per query
+	tailBatch = 256
+)
+
+// tailRules tell which traces tail retention keeps.
+type tailRules struct {
+	errors   bool          // traces with a span tagged error=true
+	duration time.Duration // traces lasting longer, zero for none
+	tags     []tailTag     // traces with a span having one of the tags
+	sample   float64       // fraction of other traces
+}
+
+// tailTag is a tag key, or a tag filter when given as key=value.
+type tailTag struct {
+	key    string
+	filter *tagFilter
+}
+
+func parseTailTag(text string) (tailTag, error) {
+	i := strings.Index(text, "=")
+	if i < 0 {
+		return tailTag{key: text}, nil
+	}
+	f, err := parseTagFilter(text[:i], text[i+1:])
+	if err != nil {
+		return tailTag{}, err
+	}
+	return tailTag{key: f.key, filter: f}, nil
+}
+
+func (t *tailTag) match(kvs []dbmodel.KeyValue) bool {
+	if t.filter != nil {
+		return t.filter.match(kvs)
+	}
+	for _, kv := range kvs {
+		if kv.Key == t.key {
+			return true
+		}
+	}
+	return false
+}
+
+// tailRetention classifies every trace once no span of it was written for the settle
+// delay.
+// Traces matching the rules, and a sample of the others, are copied to the kept store
+// and live on there after the wave purged them at chronowave.ttl.
+type tailRetention struct {
+	stream    *embed.WaveStream
+	index     *waveIndex
+	summaries *summaries
+	kept      *ArchiveRider
+	rules     tailRules
+	settle    time.Duration
+	scope     tagScope
+	done      chan void
+	closed    sync.WaitGroup
+}
+
+func newTailRetention(stream *embed.WaveStream, index *waveIndex, sum *summaries, kept *ArchiveRider, conf *conf) *tailRetention {
+	t := &tailRetention{
+		stream:    stream,
+		index:     index,
+		summaries: sum,
+		kept:      kept,
+		rules:     conf.tailRules,
+		settle:    conf.tailSettle,
+		scope:     conf.tagScope,
+		done:      make(chan void),
+	}
+
+	t.closed.Add(1)
+	go t.loop()
+
+	return t
+}
+
+func (t *tailRetention) Close() {
+	close(t.done)
+	t.closed.Wait()
+}
+
+func (t *tailRetention) loop() {
+	defer t.closed.Done()
+
+	ticker := time.NewTicker(tailCheck)
+	defer ticker.Stop()
+
+	for {
+		for {
+			n, err := t.classify(context.Background())
+			if err != nil {
+				logger.Error("failed to classify traces for tail retention", "error", err)
+			}
+			if err != nil || n < tailBatch {
+				break
+			}
+
+			select {
+			case <-t.done:
+				return
+			default:
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-t.done:
+			return
+		}
+	}
+}
+
+// classify keeps a batch of settled traces, and returns how many were classified.
+func (t *tailRetention) classify(ctx context.Context) (int, error) {
+	settled, err := t.summaries.settled(micros(time.Now().Add(-1*t.settle)), tailBatch)
+	if err != nil || len(settled) == 0 {
+		return 0, err
+	}
+
+	kept := make(map[string]bool, len(settled))
+	var (
+		tids     []string
+		from, to int64 = math.MaxInt64, 0
+	)
+	for _, ts := range settled {
+		kept[ts.TraceID] = (t.rules.errors && ts.ErrorCount > 0) ||
+			(t.rules.duration > 0 && ts.Duration > micros64(t.rules.duration)) ||
+			t.sampled(ts.TraceID)
+
+		// spans are read for kept traces to copy, and for tag rules
+		if kept[ts.TraceID] || len(t.rules.tags) > 0 {
+			tids = append(tids, ts.TraceID)
+			from, to = min64(from, ts.StartTime), max64(to, ts.StartTime+ts.Duration)
+		}
+	}
+
+	traces := map[string][]*dbmodel.Span{}
+	if len(tids) > 0 {
+		if traces, err = t.spans(ctx, from, to, tids); err != nil {
+			return 0, err
+		}
+	}
+
+	for _, tid := range tids {
+		spans := traces[tid]
+		if !kept[tid] {
+			kept[tid] = t.tagged(spans)
+		}
+		if kept[tid] && len(spans) > 0 {
+			if err = t.kept.writeTrace(tid, spans); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	return len(settled), t.summaries.classify(kept)
+}
+
+// sampled keeps a fraction of traces by their ID, so a trace is kept or not wherever
+// it's decided.
+func (t *tailRetention) sampled(tid string) bool {
+	if t.rules.sample <= 0 {
+		return false
+	}
+	h := fnv.New32a()
+	h.Write([]byte(tid))
+	return float64(h.Sum32()) < t.rules.sample*float64(math.MaxUint32)
+}
+
+func (t *tailRetention) tagged(spans []*dbmodel.Span) bool {
+	for _, s := range spans {
+		kvs := t.scope.values(s)
+		for i := range t.rules.tags {
+			if t.rules.tags[i].match(kvs) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// spans returns spans of traces tids started within [from, to] by trace ID.
+func (t *tailRetention) spans(ctx context.Context, from, to int64, tids []string) (map[string][]*dbmodel.Span, error) {
+	qry, err := builder.Find("s").
+		Where(
+			t.index.frame(from, to),
+			builder.Var("s", "/"),
+			builder.Path(timestamp).Timeframe(from, to),
+			builder.Path("/traceID").In(tids...),
+		).
+		Build()
+	if err != nil {
+		return nil, err
+	}
+
+	jdoc, err := t.stream.Query(ctx, qry)
+	if err != nil {
+		return nil, err
+	}
+
+	var rs []struct{ S *dbmodel.Span }
+	if err = json.Unmarshal(jdoc, &rs); err != nil {
+		return nil, err
+	}
+
+	traces := make(map[string][]*dbmodel.Span, len(tids))
+	for _, r := range rs {
+		tid := string(r.S.TraceID)
+		traces[tid] = append(traces[tid], r.S)
+	}
+	return traces, nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+)
+
+func testTailTags(t *testing.T, texts ...string) []tailTag {
+	t.Helper()
+
+	tags := make([]tailTag, len(texts))
+	for i, text := range texts {
+		tag, err := parseTailTag(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tags[i] = tag
+	}
+	return tags
+}
+
+func TestTailClassify(t *testing.T) {
+	start := time.Unix(1600000000, 0)
+	failed := testSpan(1, 11, "frontend", start)
+	failed.Tags = []model.KeyValue{model.Bool("error", true)}
+	long := testSpan(2, 21, "frontend", start)
+	long.Duration = 2 * time.Second
+	debug := testSpan(3, 31, "frontend", start)
+	debug.Tags = []model.KeyValue{model.String("debug", "1")}
+	plain := testSpan(4, 41, "frontend", start)
+	unavailable := testSpan(5, 51, "frontend", start)
+	unavailable.Tags = []model.KeyValue{model.Int64("http.status_code", 503)}
+	spans := []*model.Span{failed, long, debug, plain, unavailable}
+
+	tests := []struct {
+		name  string
+		rules tailRules
+		kept  []string
+	}{
+		{"errors", tailRules{errors: true}, traceIDs(1)},
+		{"duration", tailRules{duration: time.Second}, traceIDs(2)},
+		{"tags", tailRules{tags: testTailTags(t, "debug", "http.status_code=>=500")}, traceIDs(3, 5)},
+		{"all rules", tailRules{errors: true, duration: time.Second, tags: testTailTags(t, "debug")}, traceIDs(1, 2, 3)},
+		{"sampled", tailRules{sample: 1}, traceIDs(1, 2, 3, 4, 5)},
+		{"none", tailRules{}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wr, close := testWaveRider(t, spans)
+			defer close()
+			sum, err := openSummaries(wr.dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sum.Close()
+			kept := newArchiveRider(logger, filepath.Join(wr.dir, keptDir), 0)
+			defer kept.Close()
+
+			batch := make([]pendingSpan, len(spans))
+			for i, s := range spans {
+				batch[i] = newPendingSpan(s, nil)
+			}
+			if err = sum.observe(batch); err != nil {
+				t.Fatal(err)
+			}
+
+			tr := &tailRetention{stream: wr.stream, index: wr.index, summaries: sum, kept: kept, rules: tt.rules, settle: time.Minute, scope: allTags}
+			ctx := context.Background()
+			// written just now
+			if n, err := tr.classify(ctx); err != nil || n != 0 {
+				t.Fatalf("classify() of unsettled traces = %d, %v, want 0", n, err)
+			}
+			if _, err = sum.db.Exec(`UPDATE summary SET updated = ?`, micros(time.Now().Add(-2*time.Minute))); err != nil {
+				t.Fatal(err)
+			}
+			if n, err := tr.classify(ctx); err != nil || n != len(spans) {
+				t.Fatalf("classify() = %d, %v, want %d", n, err, len(spans))
+			}
+
+			var got []string
+			for _, s := range spans {
+				tid := s.TraceID.String()
+				var k bool
+				if err = sum.db.QueryRow(`SELECT kept FROM summary_kept WHERE trace_id = ?`, tid).Scan(&k); err != nil {
+					t.Fatalf("trace %s isn't classified: %v", tid, err)
+				}
+				trace, err := kept.GetTrace(ctx, s.TraceID)
+				if k != (err == nil) {
+					t.Errorf("trace %s kept = %v, but GetTrace() error = %v", tid, k, err)
+				}
+				if k {
+					got = append(got, tid)
+					if len(trace.Spans) != 1 {
+						t.Errorf("trace %s kept with %d spans, want 1", tid, len(trace.Spans))
+					}
+				}
+			}
+			if !reflect.DeepEqual(got, tt.kept) {
+				t.Errorf("kept = %v, want %v", got, tt.kept)
+			}
+
+			// classified once
+			if n, err := tr.classify(ctx); err != nil || n != 0 {
+				t.Errorf("classify() again = %d, %v, want 0", n, err)
+			}
+		})
+	}
+}
+
+func TestSummariesSettled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "summary")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sum, err := openSummaries(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sum.Close()
+
+	// trace 1 ended long ago, but a span of it is written just now
+	now := time.Now()
+	err = sum.observe([]pendingSpan{
+		testPending(1, "frontend", now.Add(-time.Hour), time.Second, true, false),
+		testPending(2, "frontend", now, time.Second, true, false),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		updated map[string]time.Time
+		want    []string
+	}{
+		{"written just now", nil, nil},
+		{"updated before", map[string]time.Time{traceIDs(2)[0]: now.Add(-10 * time.Minute)}, traceIDs(2)},
+		{"earliest updated first", map[string]time.Time{traceIDs(1)[0]: now.Add(-20 * time.Minute)}, traceIDs(1, 2)},
+	}
+	for _, tt := range tests {
+		for tid, at := range tt.updated {
+			if _, err = sum.db.Exec(`UPDATE summary SET updated = ? WHERE trace_id = ?`, micros(at), tid); err != nil {
+				t.Fatal(err)
+			}
+		}
+		settled, err := sum.settled(micros(now.Add(-5*time.Minute)), tailBatch)
+		if err != nil {
+			t.Fatalf("%s: settled() error = %v", tt.name, err)
+		}
+		var got []string
+		for _, ts := range settled {
+			got = append(got, ts.TraceID)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: settled() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
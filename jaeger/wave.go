@@ -0,0 +1,95 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"path/filepath"
+	"time"
+
+	"chronowave-jaeger/builder"
+)
+
+// waveIndex reads time ranges of wave segments. ChronoWave picks segments for the
+// first TIMEFRAME of a query by their begin or end falling within it, so a segment
+// spanning the whole timeframe, e.g. with late spans or dependency buckets, is
+// missed. Queries lead with frame, widened to cover every overlapping segment.
+type waveIndex struct {
+	db *sql.DB
+}
+
+// openWaveIndex opens the segment table of the wave in dir read only, the wave must
+// be opened first.
+func openWaveIndex(dir string) (*waveIndex, error) {
+	db, err := sql.Open("sqlite3", "file:"+filepath.Join(dir, "db")+"?mode=ro")
+	if err != nil {
+		return nil, err
+	}
+	return &waveIndex{db: db}, nil
+}
+
+func (x *waveIndex) Close() error {
+	return x.db.Close()
+}
+
+// frame returns a timeframe on span start time selecting all segments with spans
+// started within [from, to]. Documents are not filtered by it, the query still
+// needs its own timeframe.
+func (x *waveIndex) frame(from, to int64) builder.Clause {
+	var lo, hi sql.NullInt64
+	err := x.db.QueryRow(`SELECT MIN(beg), MAX(end) FROM wave WHERE beg <= ? AND end >= ?`, to, from).Scan(&lo, &hi)
+	if err != nil {
+		logger.Error("failed to read wave segments, query all", "error", err)
+		return builder.Path(timestamp).Timeframe(0, math.MaxInt64)
+	}
+
+	if lo.Valid && lo.Int64 < from {
+		from = lo.Int64
+	}
+	if hi.Valid && hi.Int64 > to {
+		to = hi.Int64
+	}
+
+	return builder.Path(timestamp).Timeframe(max64(0, from), to)
+}
+
+// segment is an index segment file of the wave.
+type segment struct {
+	wid     int64
+	created time.Time
+}
+
+// oldest returns segments created first, up to limit.
+func (x *waveIndex) oldest(limit int) ([]segment, error) {
+	rows, err := x.db.Query(`SELECT wid, created FROM wave ORDER BY created, wid LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var segments []segment
+	for rows.Next() {
+		var s segment
+		if err = rows.Scan(&s.wid, &s.created); err != nil {
+			return nil, err
+		}
+		segments = append(segments, s)
+	}
+	return segments, rows.Err()
+}
+
+// endBefore returns the latest span start time in segments created before before.
+func (x *waveIndex) endBefore(before time.Time) (int64, error) {
+	var end sql.NullInt64
+	err := x.db.QueryRow(`SELECT MAX(end) FROM wave WHERE created < ?`, before).Scan(&end)
+	return end.Int64, err
+}
+
+// segmentDir holds the index segments of a wave.
+const segmentDir = "index"
+
+// segmentPath returns the file of segment wid in the wave in dir, as ChronoWave names it.
+func segmentPath(dir string, wid int64) string {
+	name := fmt.Sprintf("%016X", wid)
+	return filepath.Join(dir, segmentDir, name[:4], name[8:12], name)
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	zipkinSpansPath = "/api/v2/spans"
+
+	// service name of spans without a local endpoint, as Jaeger's Zipkin receiver names it
+	zipkinNoService = "unknown-service-name"
+)
+
+// zipkinSpan is a span in Zipkin v2 JSON, times are in microseconds.
+type zipkinSpan struct {
+	TraceID        string             `json:"traceId"`
+	ID             string             `json:"id"`
+	ParentID       string             `json:"parentId,omitempty"`
+	Name           string             `json:"name,omitempty"`
+	Kind           string             `json:"kind,omitempty"`
+	Timestamp      uint64             `json:"timestamp,omitempty"`
+	Duration       uint64             `json:"duration,omitempty"`
+	Debug          bool               `json:"debug,omitempty"`
+	Shared         bool               `json:"shared,omitempty"`
+	LocalEndpoint  *zipkinEndpoint    `json:"localEndpoint,omitempty"`
+	RemoteEndpoint *zipkinEndpoint    `json:"remoteEndpoint,omitempty"`
+	Annotations    []zipkinAnnotation `json:"annotations,omitempty"`
+	Tags           map[string]string  `json:"tags,omitempty"`
+}
+
+type zipkinEndpoint struct {
+	ServiceName string `json:"serviceName,omitempty"`
+	IPv4        string `json:"ipv4,omitempty"`
+	IPv6        string `json:"ipv6,omitempty"`
+	Port        int64  `json:"port,omitempty"`
+}
+
+type zipkinAnnotation struct {
+	Timestamp uint64 `json:"timestamp"`
+	Value     string `json:"value"`
+}
+
+// postZipkinSpans takes a list of Zipkin v2 JSON spans, like the Zipkin collector. The
+// whole list is rejected if a span is invalid.
+func (wr *WaveRider) postZipkinSpans(c echo.Context) error {
+	req := c.Request()
+	if ct := req.Header.Get(echo.HeaderContentType); ct != "" && !strings.HasPrefix(ct, echo.MIMEApplicationJSON) {
+		return echo.NewHTTPError(http.StatusUnsupportedMediaType, "unsupported content type "+ct)
+	}
+
+	data, err := readBody(req, maxBody)
+	if err != nil {
+		return err
+	}
+
+	var zspans []zipkinSpan
+	if err = json.Unmarshal(data, &zspans); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	spans := make([]*model.Span, len(zspans))
+	for i := range zspans {
+		if spans[i], err = zspans[i].toDomain(); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+	}
+
+	for _, span := range spans {
+		if err = wr.WriteSpan(req.Context(), span); err != nil {
+			return writeError(err)
+		}
+	}
+
+	return c.NoContent(http.StatusAccepted)
+}
+
+// toDomain converts a Zipkin span as Jaeger's Zipkin receiver does. 64 bit trace IDs
+// become trace IDs with high bits zero. A shared server span keeps the span ID of its
+// client span and references it as its parent; Jaeger query gives the server span an
+// ID of its own when the trace is loaded.
+func (zs *zipkinSpan) toDomain() (*model.Span, error) {
+	if zs.TraceID == "" || zs.ID == "" {
+		return nil, errors.New("zipkin span without traceId or id")
+	}
+
+	traceID, err := model.TraceIDFromString(zs.TraceID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid zipkin traceId %q: %v", zs.TraceID, err)
+	}
+	spanID, err := zipkinSpanID(zs.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	var refs []model.SpanRef
+	if zs.Shared && strings.EqualFold(zs.Kind, "server") {
+		// the parent of the client span is the parent of the RPC, not of this span
+		refs = []model.SpanRef{model.NewChildOfRef(traceID, spanID)}
+	} else if zs.ParentID != "" {
+		parent, err := zipkinSpanID(zs.ParentID)
+		if err != nil {
+			return nil, err
+		}
+		refs = model.MaybeAddParentSpanID(traceID, parent, refs)
+	}
+
+	// late annotations may come without the span timestamp
+	start := zs.Timestamp
+	if start == 0 {
+		for _, a := range zs.Annotations {
+			if a.Timestamp > 0 && (start == 0 || a.Timestamp < start) {
+				start = a.Timestamp
+			}
+		}
+	}
+	if start == 0 {
+		return nil, fmt.Errorf("zipkin span %s without timestamp", zs.ID)
+	}
+
+	tags := make([]model.KeyValue, 0, len(zs.Tags)+6)
+	for k, v := range zs.Tags {
+		if k == "error" {
+			// Zipkin tags errors with a message, Jaeger with true
+			tags = append(tags, model.Bool("error", v != "false"))
+			if v != "" && v != "true" && v != "false" {
+				tags = append(tags, model.String("error.message", v))
+			}
+			continue
+		}
+		tags = append(tags, model.String(k, v))
+	}
+	if zs.Kind != "" {
+		tags = append(tags, model.String("span.kind", strings.ToLower(zs.Kind)))
+	}
+	if ep := zs.RemoteEndpoint; ep != nil {
+		if ep.ServiceName != "" {
+			tags = append(tags, model.String("peer.service", ep.ServiceName))
+		}
+		if ep.IPv4 != "" {
+			tags = append(tags, model.String("peer.ipv4", ep.IPv4))
+		}
+		if ep.IPv6 != "" {
+			tags = append(tags, model.String("peer.ipv6", ep.IPv6))
+		}
+		if ep.Port != 0 {
+			tags = append(tags, model.Int64("peer.port", ep.Port))
+		}
+	}
+	// Zipkin tags are a map, sorted they are stored the same way every time
+	model.KeyValues(tags).Sort()
+
+	var logs []model.Log
+	for _, a := range zs.Annotations {
+		if a.Value == "" {
+			continue
+		}
+		logs = append(logs, model.Log{
+			Timestamp: model.EpochMicrosecondsAsTime(a.Timestamp),
+			Fields:    []model.KeyValue{model.String("event", a.Value)},
+		})
+	}
+
+	var flags model.Flags
+	if zs.Debug {
+		flags.SetDebug()
+	}
+	flags.SetSampled()
+
+	return &model.Span{
+		TraceID:       traceID,
+		SpanID:        spanID,
+		OperationName: zs.Name,
+		References:    refs,
+		Flags:         flags,
+		StartTime:     model.EpochMicrosecondsAsTime(start),
+		Duration:      model.MicrosecondsAsDuration(zs.Duration),
+		Tags:          tags,
+		Logs:          logs,
+		Process:       zs.LocalEndpoint.process(),
+	}, nil
+}
+
+// zipkinSpanID parses a span ID, of which some clients send 128 bits; the low 64 bits are kept.
+func zipkinSpanID(id string) (model.SpanID, error) {
+	if len(id) > 16 {
+		id = id[len(id)-16:]
+	}
+	sid, err := model.SpanIDFromString(id)
+	if err != nil {
+		return 0, fmt.Errorf("invalid zipkin span id %q: %v", id, err)
+	}
+	return sid, nil
+}
+
+// process returns the process of spans reported by local endpoint ep.
+func (ep *zipkinEndpoint) process() *model.Process {
+	if ep == nil {
+		return model.NewProcess(zipkinNoService, nil)
+	}
+
+	service := ep.ServiceName
+	if service == "" {
+		service = zipkinNoService
+	}
+
+	var tags []model.KeyValue
+	if ep.IPv4 != "" {
+		tags = append(tags, model.String("ip", ep.IPv4))
+	} else if ep.IPv6 != "" {
+		tags = append(tags, model.String("ip", ep.IPv6))
+	}
+	return model.NewProcess(service, tags)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+)
+
+func TestZipkinToDomain(t *testing.T) {
+	start := time.Unix(0, 1544712660000000000).UTC()
+	frontend := &zipkinEndpoint{ServiceName: "frontend", IPv4: "10.0.0.1"}
+	traceID := model.NewTraceID(0, 0x463ac35c9f6413ad)
+	sampled := model.Flags(0)
+	sampled.SetSampled()
+
+	tests := []struct {
+		name string
+		zs   zipkinSpan
+		want *model.Span
+	}{
+		{
+			"64 bit trace ID",
+			zipkinSpan{TraceID: "463ac35c9f6413ad", ID: "72485a3953bb6124", Name: "get", Timestamp: 1544712660000000, Duration: 1500, LocalEndpoint: frontend},
+			&model.Span{
+				TraceID: traceID, SpanID: model.NewSpanID(0x72485a3953bb6124), OperationName: "get", Flags: sampled,
+				StartTime: start, Duration: 1500 * time.Microsecond, Tags: []model.KeyValue{},
+				Process: model.NewProcess("frontend", []model.KeyValue{model.String("ip", "10.0.0.1")}),
+			},
+		},
+		{
+			"128 bit trace ID",
+			zipkinSpan{TraceID: "5b8efff798038103d269b633813fc60c", ID: "72485a3953bb6124", Timestamp: 1544712660000000},
+			&model.Span{
+				TraceID: model.NewTraceID(0x5b8efff798038103, 0xd269b633813fc60c), SpanID: model.NewSpanID(0x72485a3953bb6124), Flags: sampled,
+				StartTime: start, Tags: []model.KeyValue{}, Process: model.NewProcess(zipkinNoService, nil),
+			},
+		},
+		{
+			"server span",
+			zipkinSpan{TraceID: "463ac35c9f6413ad", ID: "72485a3953bb6124", ParentID: "0c3a5a3953bb6124", Kind: "SERVER", Timestamp: 1544712660000000, LocalEndpoint: frontend},
+			&model.Span{
+				TraceID: traceID, SpanID: model.NewSpanID(0x72485a3953bb6124), Flags: sampled,
+				References: []model.SpanRef{model.NewChildOfRef(traceID, model.NewSpanID(0x0c3a5a3953bb6124))},
+				StartTime:  start, Tags: []model.KeyValue{model.String("span.kind", "server")},
+				Process: model.NewProcess("frontend", []model.KeyValue{model.String("ip", "10.0.0.1")}),
+			},
+		},
+		{
+			"shared server span references the client span",
+			zipkinSpan{TraceID: "463ac35c9f6413ad", ID: "72485a3953bb6124", ParentID: "0c3a5a3953bb6124", Kind: "SERVER", Shared: true, Timestamp: 1544712660000000, LocalEndpoint: frontend},
+			&model.Span{
+				TraceID: traceID, SpanID: model.NewSpanID(0x72485a3953bb6124), Flags: sampled,
+				References: []model.SpanRef{model.NewChildOfRef(traceID, model.NewSpanID(0x72485a3953bb6124))},
+				StartTime:  start, Tags: []model.KeyValue{model.String("span.kind", "server")},
+				Process: model.NewProcess("frontend", []model.KeyValue{model.String("ip", "10.0.0.1")}),
+			},
+		},
+		{
+			"client kind and remote endpoint",
+			zipkinSpan{
+				TraceID: "463ac35c9f6413ad", ID: "72485a3953bb6124", Kind: "CLIENT", Timestamp: 1544712660000000, Debug: true,
+				RemoteEndpoint: &zipkinEndpoint{ServiceName: "redis", IPv6: "::1", Port: 6379},
+				Tags:           map[string]string{"error": "timeout", "db.type": "redis"},
+			},
+			&model.Span{
+				TraceID: traceID, SpanID: model.NewSpanID(0x72485a3953bb6124), Flags: model.DebugFlag | model.SampledFlag,
+				StartTime: start,
+				Tags: []model.KeyValue{
+					model.String("db.type", "redis"),
+					model.Bool("error", true),
+					model.String("error.message", "timeout"),
+					model.String("peer.ipv6", "::1"),
+					model.Int64("peer.port", 6379),
+					model.String("peer.service", "redis"),
+					model.String("span.kind", "client"),
+				},
+				Process: model.NewProcess(zipkinNoService, nil),
+			},
+		},
+		{
+			"annotations become logs",
+			zipkinSpan{
+				TraceID: "463ac35c9f6413ad", ID: "72485a3953bb6124",
+				Annotations: []zipkinAnnotation{{Timestamp: 1544712660200000, Value: "ws"}, {Timestamp: 1544712660000000, Value: "wr"}, {Timestamp: 1544712660300000}},
+			},
+			&model.Span{
+				TraceID: traceID, SpanID: model.NewSpanID(0x72485a3953bb6124), Flags: sampled,
+				StartTime: start, Tags: []model.KeyValue{},
+				Logs: []model.Log{
+					{Timestamp: start.Add(200 * time.Millisecond), Fields: []model.KeyValue{model.String("event", "ws")}},
+					{Timestamp: start, Fields: []model.KeyValue{model.String("event", "wr")}},
+				},
+				Process: model.NewProcess(zipkinNoService, nil),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.zs.toDomain()
+			if err != nil {
+				t.Fatalf("toDomain() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("toDomain() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestZipkinReject(t *testing.T) {
+	tests := []struct {
+		name string
+		zs   zipkinSpan
+	}{
+		{"no trace ID", zipkinSpan{ID: "72485a3953bb6124", Timestamp: 1544712660000000}},
+		{"no span ID", zipkinSpan{TraceID: "463ac35c9f6413ad", Timestamp: 1544712660000000}},
+		{"bad trace ID", zipkinSpan{TraceID: "463ac35c9f64zzzz", ID: "72485a3953bb6124", Timestamp: 1544712660000000}},
+		{"bad span ID", zipkinSpan{TraceID: "463ac35c9f6413ad", ID: "span", Timestamp: 1544712660000000}},
+		{"bad parent ID", zipkinSpan{TraceID: "463ac35c9f6413ad", ID: "72485a3953bb6124", ParentID: "parent", Timestamp: 1544712660000000}},
+		{"no timestamp", zipkinSpan{TraceID: "463ac35c9f6413ad", ID: "72485a3953bb6124"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if span, err := tt.zs.toDomain(); err == nil {
+				t.Errorf("toDomain() = %v, want error", span)
+			}
+		})
+	}
+}